@@ -2,10 +2,15 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"reflect"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -13,6 +18,12 @@ const (
 	Auth = "auth"
 )
 
+// AuthParam defines the name of the URL query parameter of the auth
+// token (?auth=xxx by default).  Change it if the default name
+// collides with the parameters of a gateway.  Clients and services
+// must use the same name.
+var AuthParam = Auth
+
 // LoginRequest defines the login data.
 type LoginRequest struct {
 	Email    string `json:"email"`
@@ -81,12 +92,14 @@ type SplitPackage struct {
 	Owner     int   `json:"owner"`
 }
 
-// User defines basic users.
+// User defines basic users.  The ID of a user is always assigned by
+// the server.  Any ID sent by a client to create a new user is
+// ignored.
 type User struct {
 	Name      string `json:"name"`
 	Email     string `json:"email"`
 	Institute string `json:"institute"`
-	ID        int64  `json:"id"`
+	ID        int64  `json:"id,omitempty"`
 	Admin     bool   `json:"admin"`
 }
 
@@ -98,6 +111,16 @@ func (u User) String() string {
 	return fmt.Sprintf("%s(%d%s)", u.Email, u.ID, adm)
 }
 
+// User roles.  The roles are ordered: admins can do everything
+// coordinators can do and coordinators can do everything users can
+// do.  Coordinators manage the projects of the users of their
+// institute.
+const (
+	RoleUser        = "user"
+	RoleCoordinator = "coordinator"
+	RoleAdmin       = "admin"
+)
+
 // Users defines the repsonse data for requests to list the system's users.
 type Users struct {
 	Users []User `json:"users"`
@@ -119,6 +142,7 @@ type Book struct {
 	ProfilerURL  string          `json:"profilerUrl"`
 	Description  string          `json:"description"`
 	HistPatterns string          `json:"histPatterns"`
+	OCRModel     string          `json:"ocrModel"`
 	Year         int             `json:"year"`
 	BookID       int             `json:"bookId"`
 	ProjectID    int             `json:"projectId"`
@@ -144,6 +168,37 @@ type Page struct {
 	ImgFile    string `json:"imgFile"`
 	Box        Box    `json:"box"`
 	Lines      []Line `json:"lines"`
+	// Number of corrected and total characters on the page.
+	CorrectedChars int `json:"correctedChars"`
+	TotalChars     int `json:"totalChars"`
+}
+
+// Text returns the corrected text of the page.  The corrected lines
+// of the page are separated by newlines.  Empty lines result in
+// blank lines.
+func (p Page) Text() string {
+	var b strings.Builder
+	for i, l := range p.Lines {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(l.Cor)
+	}
+	return b.String()
+}
+
+// CorrectionStats returns the accumulated number of corrected and
+// total characters of the page's lines.  If the page has no lines,
+// the page's CorrectedChars and TotalChars are returned.
+func (p Page) CorrectionStats() (corrected, total int) {
+	if len(p.Lines) == 0 {
+		return p.CorrectedChars, p.TotalChars
+	}
+	for _, l := range p.Lines {
+		corrected += l.CorrectedChars
+		total += l.TotalChars
+	}
+	return corrected, total
 }
 
 // ID returns page's ID as string.
@@ -167,6 +222,49 @@ type Line struct {
 	IsManuallyCorrected      bool      `json:"isManuallyCorrected"`
 	Box                      Box       `json:"box"`
 	Tokens                   []Token   `json:"tokens"`
+	// Number of corrected and total characters on the line.
+	CorrectedChars int `json:"correctedChars"`
+	TotalChars     int `json:"totalChars"`
+	// Highlighted matches of searches (see SetHighlights).
+	Highlights []Highlight `json:"highlights,omitempty"`
+	// Version of the line.  Clients send the version back with
+	// updates; updates of outdated versions are rejected.
+	Version int `json:"version"`
+}
+
+// Highlight defines the range of a search match in the corrected
+// text of a line.  Start and End are rune (not byte) indices; the
+// match covers the runes [Start, End).
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// SetHighlights sets the highlights of the line from its matching
+// tokens (tokens with IsMatch set).
+func (l *Line) SetHighlights() {
+	l.Highlights = nil
+	for _, t := range l.Tokens {
+		if !t.IsMatch {
+			continue
+		}
+		l.Highlights = append(l.Highlights, Highlight{
+			Start: t.Offset,
+			End:   t.Offset + utf8.RuneCountInString(t.Cor),
+		})
+	}
+}
+
+// TokenAt returns the token of the line that contains the given rune
+// offset (see Token.Contains).  It returns false if no token contains
+// the offset (e.g. for offsets of whitespace between tokens).
+func (l Line) TokenAt(runeOffset int) (Token, bool) {
+	for _, t := range l.Tokens {
+		if t.Contains(runeOffset) {
+			return t, true
+		}
+	}
+	return Token{}, false
 }
 
 // ID returns line's ID as string.
@@ -199,6 +297,14 @@ func (t *Token) ID() string {
 	return fmt.Sprintf("%d:%d:%d:%d", t.ProjectID, t.PageID, t.LineID, t.TokenID)
 }
 
+// Contains returns true if the given offset lies within the token.
+// Offsets are rune (not byte) indices into the corrected line.  The
+// token covers the runes [Offset, Offset+len([]rune(Cor))).
+func (t Token) Contains(runeOffset int) bool {
+	return runeOffset >= t.Offset &&
+		runeOffset < t.Offset+utf8.RuneCountInString(t.Cor)
+}
+
 // CharMap represents a freqency list of characters.
 type CharMap struct {
 	ProjectID int            `json:"projectId"`
@@ -280,6 +386,48 @@ type CorrectionRequest struct {
 	Type       CorType `json:"type"`
 }
 
+// NewCorrectionRequest creates a new correction request for the given
+// correction.  The type of the request is CorManual for manual
+// corrections and CorAutomatic otherwise.  Use Normalize to normalize
+// and validate the correction.
+func NewCorrectionRequest(correction string, manual bool) CorrectionRequest {
+	typ := CorAutomatic
+	if manual {
+		typ = CorManual
+	}
+	return CorrectionRequest{Correction: correction, Type: typ}
+}
+
+// Normalize removes leading and trailing whitespace from the
+// correction.  It returns an error if the correction contains control
+// characters.
+func (r *CorrectionRequest) Normalize() error {
+	cor := strings.TrimSpace(r.Correction)
+	for _, c := range cor {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("invalid correction %q: control character %U", r.Correction, c)
+		}
+	}
+	r.Correction = cor
+	return nil
+}
+
+// BatchCorrectionRequest defines the payload for batch correction
+// requests of multiple tokens.
+type BatchCorrectionRequest struct {
+	Corrections []TokenCorrection `json:"corrections"`
+}
+
+// TokenCorrection defines the correction of one token in a batch
+// correction request.
+type TokenCorrection struct {
+	PageID     int     `json:"pageId"`
+	LineID     int     `json:"lineId"`
+	TokenID    int     `json:"tokenId"`
+	Correction string  `json:"correction"`
+	Type       CorType `json:"type"`
+}
+
 // CorType defines the type of corrections
 type CorType string
 
@@ -297,6 +445,16 @@ type Match struct {
 	Total int    `json:"total"`
 }
 
+// SetHighlights sets the highlights of all matching lines of the
+// search results (see Line.SetHighlights).
+func (r *SearchResults) SetHighlights() {
+	for _, m := range r.Matches {
+		for i := range m.Lines {
+			m.Lines[i].SetHighlights()
+		}
+	}
+}
+
 // Suggestions defines the profiler's suggestions for tokens.
 type Suggestions struct {
 	Suggestions map[string][]Suggestion `json:"suggestions"`
@@ -363,6 +521,20 @@ type AdditionalLexicon struct {
 	Tokens []string `json:"tokens"`
 }
 
+// Validate checks that all tokens of the additional lexicon are not
+// empty and do not contain any whitespace.
+func (l AdditionalLexicon) Validate() error {
+	for _, t := range l.Tokens {
+		if t == "" {
+			return fmt.Errorf("invalid additional lexicon: empty token")
+		}
+		if strings.IndexFunc(t, unicode.IsSpace) != -1 {
+			return fmt.Errorf("invalid additional lexicon: token %q contains whitespace", t)
+		}
+	}
+	return nil
+}
+
 // PostCorrection represents the result of the post correction.  It
 // maps tokens with unique id strings (bookID:pageID:lineID:tokenID)
 // to correction decisions of the automatical post correction.
@@ -399,6 +571,18 @@ type JobStatus struct {
 	StatusName string `json:"statusName"`
 	JobName    string `json:"jobName"`
 	Timestamp  int64  `json:"timestamp"`
+	StartedAt  int64  `json:"startedAt"`
+	FinishedAt int64  `json:"finishedAt"`
+}
+
+// BatchStatus defines the aggregated status of a batch of jobs.  Jobs
+// with any other status than running or failed count as done.
+type BatchStatus struct {
+	BatchID int `json:"batchId"`
+	Total   int `json:"total"`
+	Running int `json:"running"`
+	Done    int `json:"done"`
+	Failed  int `json:"failed"`
 }
 
 // Time returns the time object for the job's timestamp.
@@ -406,12 +590,37 @@ func (js JobStatus) Time() time.Time {
 	return time.Unix(js.Timestamp, 0)
 }
 
+// Duration returns the duration of the job.  For finished jobs the
+// total duration is returned.  For running jobs the elapsed time
+// since the start of the job is returned.  If the start time of the
+// job is unknown, 0 is returned.
+func (js JobStatus) Duration() time.Duration {
+	if js.StartedAt == 0 {
+		return 0
+	}
+	if js.FinishedAt == 0 {
+		return time.Since(time.Unix(js.StartedAt, 0))
+	}
+	return time.Unix(js.FinishedAt, 0).Sub(time.Unix(js.StartedAt, 0))
+}
+
 // Languages defines the object that contains the profiler's
 // configured languages.
 type Languages struct {
 	Languages []string `json:"languages"`
 }
 
+// Contains returns true if the given language is one of the
+// languages.  The languages are compared case-insensitively.
+func (ls Languages) Contains(lang string) bool {
+	for _, l := range ls.Languages {
+		if strings.EqualFold(l, lang) {
+			return true
+		}
+	}
+	return false
+}
+
 // Model defines the ocr models.
 type Model struct {
 	Name        string `json:"name"`
@@ -448,9 +657,40 @@ func (err ErrorResponse) Error() string {
 	return fmt.Sprintf("%s [%s]", err.Cause, err.Status)
 }
 
+// Sentinel error responses for common status codes.  Use them with
+// errors.Is to check the status code of returned errors (see
+// ErrorResponse.Is).
+var (
+	ErrBadRequest     = NewErrorResponse(http.StatusBadRequest, "")
+	ErrUnauthorized   = NewErrorResponse(http.StatusUnauthorized, "")
+	ErrForbidden      = NewErrorResponse(http.StatusForbidden, "")
+	ErrNotFound       = NewErrorResponse(http.StatusNotFound, "")
+	ErrConflict       = NewErrorResponse(http.StatusConflict, "")
+	ErrInternalServer = NewErrorResponse(http.StatusInternalServerError, "")
+)
+
+// Is returns true if the target is an ErrorResponse with the same
+// status code.  The causes of the errors are not compared.
+func (err ErrorResponse) Is(target error) bool {
+	t, ok := target.(ErrorResponse)
+	return ok && t.StatusCode == err.StatusCode
+}
+
+// StatusCode returns the status code of the (wrapped) ErrorResponse
+// of the given error.  If the error does not wrap an ErrorResponse, 0
+// is returned.
+func StatusCode(err error) int {
+	var errresp ErrorResponse
+	if errors.As(err, &errresp) {
+		return errresp.StatusCode
+	}
+	return 0
+}
+
 // IsValidJSONResponse returns true if the given response matches one
 // of the given codes and if response is either empty or its
-// Content-Type is `application/json`.
+// Content-Type is `application/json`.  Parameters of the Content-Type
+// (e.g. `; charset=utf-8`) are ignored.
 func IsValidJSONResponse(res *http.Response, codes ...int) bool {
 	// Order matters here. Check first for the return codes.
 	var codeOK bool
@@ -469,7 +709,7 @@ func IsValidJSONResponse(res *http.Response, codes ...int) bool {
 	}
 	// Finally check for a matching content type.
 	for _, ct := range res.Header["Content-Type"] {
-		if ct == "application/json" {
+		if mt, _, err := mime.ParseMediaType(ct); err == nil && mt == "application/json" {
 			return true
 		}
 	}
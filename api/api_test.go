@@ -0,0 +1,172 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestLanguagesContains(t *testing.T) {
+	langs := Languages{Languages: []string{"german", "Latin", "greek"}}
+	tests := []struct {
+		lang string
+		want bool
+	}{
+		{"german", true},
+		{"German", true},
+		{"latin", true},
+		{"GREEK", true},
+		{"english", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.lang, func(t *testing.T) {
+			if got := langs.Contains(tc.lang); got != tc.want {
+				t.Fatalf("expected %t; got %t", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPageText(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []Line
+		want  string
+	}{
+		{"no-lines", nil, ""},
+		{"one-line", []Line{{Cor: "first"}}, "first"},
+		{"ordered", []Line{{Cor: "first"}, {Cor: "second"}}, "first\nsecond"},
+		{"empty-lines", []Line{{Cor: "first"}, {}, {Cor: "third"}, {}}, "first\n\nthird\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := (Page{Lines: tc.lines}).Text(); got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLineTokenAt(t *testing.T) {
+	// "ſchön übel€" with the tokens "ſchön" (5 runes) and "übel€" (5 runes)
+	line := Line{Cor: "ſchön übel€", Tokens: []Token{
+		{TokenID: 1, Cor: "ſchön", Offset: 0},
+		{TokenID: 2, Cor: "übel€", Offset: 6},
+	}}
+	tests := []struct {
+		offset int
+		want   int // token id; 0 if not found
+	}{
+		{-1, 0},
+		{0, 1},
+		{4, 1},
+		{5, 0}, // whitespace
+		{6, 2},
+		{10, 2},
+		{11, 0},
+		{len(line.Cor), 0}, // byte offsets are not rune offsets
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprint(tc.offset), func(t *testing.T) {
+			got, ok := line.TokenAt(tc.offset)
+			if ok != (tc.want != 0) {
+				t.Fatalf("expected found=%t; got %t", tc.want != 0, ok)
+			}
+			if ok && got.TokenID != tc.want {
+				t.Fatalf("expected token %d; got %d", tc.want, got.TokenID)
+			}
+		})
+	}
+}
+
+func TestSearchResultsSetHighlights(t *testing.T) {
+	// "ſchön übel ſchön" with matches for the token "ſchön"
+	line := Line{Cor: "ſchön übel ſchön", Tokens: []Token{
+		{TokenID: 1, Cor: "ſchön", Offset: 0, IsMatch: true},
+		{TokenID: 2, Cor: "übel", Offset: 6},
+		{TokenID: 3, Cor: "ſchön", Offset: 11, IsMatch: true},
+	}}
+	res := SearchResults{Matches: map[string]Match{
+		"ſchön": {Lines: []Line{line}, Total: 2},
+		"none":  {Lines: []Line{{Cor: "x", Tokens: []Token{{Cor: "x"}}}}},
+	}}
+	res.SetHighlights()
+	want := []Highlight{{Start: 0, End: 5}, {Start: 11, End: 16}}
+	if got := res.Matches["ſchön"].Lines[0].Highlights; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	if got := res.Matches["none"].Lines[0].Highlights; got != nil {
+		t.Fatalf("expected no highlights; got %v", got)
+	}
+	hl := res.Matches["ſchön"].Lines[0].Highlights[1]
+	if got := string([]rune(line.Cor)[hl.Start:hl.End]); got != "ſchön" {
+		t.Fatalf("expected %q; got %q", "ſchön", got)
+	}
+}
+
+func TestCorrectionRequestNormalize(t *testing.T) {
+	tests := []struct {
+		cor, want string
+		manual    bool
+		wantErr   bool
+	}{
+		{"correction", "correction", true, false},
+		{"  two words\n", "two words", false, false},
+		{"\tſchön ", "ſchön", true, false},
+		{"", "", true, false},
+		{"tab\tinside", "", true, true},
+		{"null\x00", "", false, true},
+		{"del\u007f", "", false, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.cor, func(t *testing.T) {
+			r := NewCorrectionRequest(tc.cor, tc.manual)
+			if tc.manual && r.Type != CorManual || !tc.manual && r.Type != CorAutomatic {
+				t.Fatalf("invalid type: %s", r.Type)
+			}
+			err := r.Normalize()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if r.Correction != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, r.Correction)
+			}
+		})
+	}
+}
+
+func TestErrorResponseStatusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+		is   error
+	}{
+		{"not-found", NewErrorResponse(http.StatusNotFound, "no such book"), http.StatusNotFound, ErrNotFound},
+		{"wrapped", fmt.Errorf("GET x: %w", NewErrorResponse(http.StatusUnauthorized, "")), http.StatusUnauthorized, ErrUnauthorized},
+		{"other", errors.New("other"), 0, nil},
+		{"nil", nil, 0, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := StatusCode(tc.err); got != tc.want {
+				t.Fatalf("expected %d; got %d", tc.want, got)
+			}
+			if tc.is != nil && !errors.Is(tc.err, tc.is) {
+				t.Fatalf("expected %v to be %v", tc.err, tc.is)
+			}
+			if errors.Is(tc.err, ErrForbidden) {
+				t.Fatalf("expected %v not to be %v", tc.err, ErrForbidden)
+			}
+		})
+	}
+}
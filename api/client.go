@@ -3,20 +3,33 @@ package api
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/ulog"
 )
 
 // Client implements the api calls for the pcw backend.
 // Use Login to initalize the client.
 type Client struct {
-	client  *http.Client
-	Host    string
-	Session Session // active session
+	client    *http.Client
+	languages *languageCache // cached profiler languages
+	reauth    *reauth        // credentials for automatic re-authentication
+	plog      *payloadLog
+	retry     *retryPolicy // retry policy for idempotent requests
+	Host      string
+	Session   Session // active session
 }
 
 // NewClient creates a new client with the given host (and it default
@@ -26,11 +39,21 @@ func NewClient(host string, skipVerify bool) *Client {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerify},
 	}
 	return &Client{
-		Host:   host,
-		client: &http.Client{Transport: tr},
+		Host:      host,
+		client:    &http.Client{Transport: tr},
+		languages: &languageCache{},
 	}
 }
 
+// NewClientWithTimeout creates a new client like NewClient, whose
+// requests fail if they do not complete within the given timeout.  A
+// timeout of zero means no timeout.
+func NewClientWithTimeout(host string, skipVerify bool, timeout time.Duration) *Client {
+	c := NewClient(host, skipVerify)
+	c.client.Timeout = timeout
+	return c
+}
+
 // Authenticate creates a new Client from a given auth-token.
 func Authenticate(host, authToken string, skipVerify bool) *Client {
 	c := NewClient(host, skipVerify)
@@ -55,32 +78,341 @@ func Login(host, email, password string, skipVerify bool) (*Client, error) {
 	return client, nil
 }
 
+// WithTransport sets the transport of the client's underlying HTTP
+// client.  It can be used to intercept or replay the requests of the
+// client (e.g. in tests).
+func (c *Client) WithTransport(rt http.RoundTripper) *Client {
+	hc := *c.client
+	hc.Transport = rt
+	c.client = &hc
+	return c
+}
+
+// reauth holds the credentials and the renewed session for
+// automatic re-authentication.  It is shared between all copies of a
+// client.
+type reauth struct {
+	mu              sync.Mutex
+	email, password string
+	session         *Session
+}
+
+// WithAutoReauth enables automatic re-authentication of the client.
+// If an authenticated request fails with 401 Unauthorized, the client
+// logs in again using the given credentials and retries the original
+// request once.  If the re-login fails, the original 401 response is
+// returned.  The renewed session is used for all subsequent requests
+// (the client's Session field is not updated) and can be retrieved
+// with CurrentSession.
+func (c *Client) WithAutoReauth(email, password string) *Client {
+	c.reauth = &reauth{email: email, password: password}
+	return c
+}
+
+// retryPolicy defines the maximal number of attempts and the initial
+// backoff of retried requests.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// SetRetry configures the client to retry idempotent requests (GET,
+// PUT and DELETE) at most maxAttempts times in total on connection
+// errors and on 502 Bad Gateway, 503 Service Unavailable and 504
+// Gateway Timeout responses.  The client waits backoff before the
+// second attempt and doubles the waiting time for every subsequent
+// attempt.  POST requests are never retried.  Retrying stops early if
+// the request's context is done or if its deadline would be exceeded
+// by the next wait.  A maxAttempts value smaller than 2 disables
+// retrying.
+func (c *Client) SetRetry(maxAttempts int, backoff time.Duration) {
+	if maxAttempts < 2 {
+		c.retry = nil
+		return
+	}
+	c.retry = &retryPolicy{attempts: maxAttempts, backoff: backoff}
+}
+
+// send sends the request using the client's underlying HTTP client.
+// Idempotent requests are retried according to the client's retry
+// policy (see SetRetry).
+func (c Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if c.retry == nil || !retryable(req) {
+		return resp, err
+	}
+	wait := c.retry.backoff
+	for i := 1; i < c.retry.attempts && mustRetry(resp, err); i++ {
+		ctx := req.Context()
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		retry := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			retry.Body = body
+		}
+		resp, err = c.client.Do(retry)
+		wait *= 2
+	}
+	return resp, err
+}
+
+// retryable returns true if the given request can be safely resent.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	default:
+		return false
+	}
+}
+
+// mustRetry returns true if the result of a request indicates a
+// temporary failure of the backend.
+func mustRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// MaxLoggedPayload defines the maximal number of bytes of logged
+// request payloads (see WithPayloadLog).  Longer payloads are
+// truncated.
+var MaxLoggedPayload = 1024
+
+type payloadLog struct {
+	log    ulog.ULog
+	redact func([]byte) []byte
+}
+
+// WithPayloadLog enables the logging of the json payloads of Put
+// requests with the given logger.  The payloads are redacted with the
+// given function before they are logged.  If redact is nil,
+// RedactPayload is used.  Logged payloads are truncated to
+// MaxLoggedPayload bytes.  By default no payloads are logged.
+func (c *Client) WithPayloadLog(log ulog.ULog, redact func([]byte) []byte) *Client {
+	if redact == nil {
+		redact = RedactPayload
+	}
+	c.plog = &payloadLog{log: log, redact: redact}
+	return c
+}
+
+func (c Client) logPayload(method, url string, body []byte) {
+	if c.plog == nil {
+		return
+	}
+	payload := c.plog.redact(body)
+	if len(payload) > MaxLoggedPayload {
+		payload = append(payload[:MaxLoggedPayload:MaxLoggedPayload], "..."...)
+	}
+	c.plog.log.Write(method, "url", url, "payload", string(payload))
+}
+
+// RedactPayload masks the values of all fields of the given json
+// payload whose names contain `password` (case insensitive).  Fields
+// of nested objects and arrays are masked as well.  Payloads that are
+// not valid json are replaced completely.
+func RedactPayload(payload []byte) []byte {
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return []byte(redacted)
+	}
+	out, err := json.Marshal(redact(v))
+	if err != nil {
+		return []byte(redacted)
+	}
+	return out
+}
+
+const redacted = "***"
+
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			if strings.Contains(strings.ToLower(k), "password") {
+				t[k] = redacted
+				continue
+			}
+			t[k] = redact(v)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redact(t[i])
+		}
+	}
+	return v
+}
+
+// CurrentSession returns the active session of the client.  If the
+// client was re-authenticated automatically, the renewed session is
+// returned.
+func (c Client) CurrentSession() Session {
+	if c.reauth != nil {
+		c.reauth.mu.Lock()
+		defer c.reauth.mu.Unlock()
+		if c.reauth.session != nil {
+			return *c.reauth.session
+		}
+	}
+	return c.Session
+}
+
+// relogin logs in again unless the session was already renewed since
+// the request with the given failed auth token was sent.  It returns
+// the auth token of the renewed session.
+func (c Client) relogin(failed string) (string, error) {
+	c.reauth.mu.Lock()
+	defer c.reauth.mu.Unlock()
+	if c.reauth.session != nil && c.reauth.session.Auth != failed {
+		return c.reauth.session.Auth, nil
+	}
+	login := LoginRequest{Email: c.reauth.email, Password: c.reauth.password}
+	var s Session
+	// Use a client without re-authentication to login.
+	nc := Client{client: c.client, Host: c.Host}
+	if err := nc.Post(nc.URL("login"), login, &s); err != nil {
+		return "", err
+	}
+	c.reauth.session = &s
+	return s.Auth, nil
+}
+
 // URL returns the formated url with the client's host prepended.
 func (c Client) URL(format string, args ...interface{}) string {
 	return strings.TrimRight(c.Host, "/") + "/" + strings.TrimLeft(fmt.Sprintf(format, args...), "/")
 }
 
+// AuthURL returns the formated url with the client's host prepended
+// and the client's auth token appended as query parameter (see
+// AuthParam).  Use it for requests that cannot set the Authorization
+// header (e.g. links to images).
+func (c Client) AuthURL(format string, args ...interface{}) string {
+	sep := "?"
+	u := c.URL(format, args...)
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + url.QueryEscape(AuthParam) + "=" + url.QueryEscape(c.Session.Auth)
+}
+
 // Do performes an authenticated HTTP request against a pocoweb
-// service.
+// service.  If automatic re-authentication is enabled, a request that
+// fails with 401 Unauthorized is retried once after a re-login (see
+// WithAutoReauth).
 func (c Client) Do(req *http.Request) (*http.Response, error) {
-	req.Header.Add("Authorization", c.Session.Auth)
-	return c.client.Do(req)
+	if c.reauth == nil {
+		return c.DoAs(c.Session.Auth, req)
+	}
+	// Buffer the request body for a possible replay.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	auth := c.CurrentSession().Auth
+	req.Header.Set("Authorization", auth)
+	resp, err := c.send(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	newAuth, err := c.relogin(auth)
+	if err != nil { // return the original 401 response
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	resp.Body.Close()
+	retry.Header.Set("Authorization", newAuth)
+	return c.send(retry)
+}
+
+// DoAs performes an HTTP request against a pocoweb service that is
+// authenticated with the given auth token instead of the token of the
+// client's session.  The client's session is not changed and no
+// automatic re-authentication is done.
+func (c Client) DoAs(auth string, req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", auth)
+	return c.send(req)
+}
+
+// doFunc defines the function that performes the requests.
+type doFunc func(*http.Request) (*http.Response, error)
+
+// as returns a doFunc that authenticates requests with the given auth
+// token.
+func (c Client) as(auth string) doFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		return c.DoAs(auth, req)
+	}
 }
 
 // Get performes an authenticated HTTP get request against a pocoweb
 // service.  The response of the request is marshaled into the out
 // parameter unless the out parameter is set to nil.
 func (c Client) Get(url string, out interface{}) error {
-	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	return c.GetContext(context.Background(), url, out)
+}
+
+// GetContext performes an HTTP get request like Get with the given
+// context.  The request is aborted if the context is canceled.
+func (c Client) GetContext(ctx context.Context, url string, out interface{}) error {
+	return get(ctx, c.Do, url, out)
+}
+
+// GetAs performes an HTTP get request like Get, that is authenticated
+// with the given auth token (see DoAs).
+func (c Client) GetAs(auth, url string, out interface{}) error {
+	return get(context.Background(), c.as(auth), url, out)
+}
+
+func get(ctx context.Context, do doFunc, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
 	if err != nil {
-		return fmt.Errorf("GET %s: %v", url, err)
+		return fmt.Errorf("GET %s: %w", url, err)
 	}
-	resp, err := c.Do(req)
+	resp, err := do(req)
 	if err != nil {
-		return fmt.Errorf("GET %s: %v", url, err)
+		return fmt.Errorf("GET %s: %w", url, err)
 	}
 	if err := UnmarshalResponse(resp, out); err != nil {
-		return fmt.Errorf("GET %s: %v", url, err)
+		return fmt.Errorf("GET %s: %w", url, err)
 	}
 	return nil
 }
@@ -90,21 +422,37 @@ func (c Client) Get(url string, out interface{}) error {
 // the request is marshaled into the out parameter unless the out
 // parameter is set to nil.
 func (c Client) Post(url string, payload, out interface{}) error {
+	return c.PostContext(context.Background(), url, payload, out)
+}
+
+// PostContext performes an HTTP post request like Post with the given
+// context.  The request is aborted if the context is canceled.
+func (c Client) PostContext(ctx context.Context, url string, payload, out interface{}) error {
+	return post(ctx, c.Do, url, payload, out)
+}
+
+// PostAs performes an HTTP post request like Post, that is
+// authenticated with the given auth token (see DoAs).
+func (c Client) PostAs(auth, url string, payload, out interface{}) error {
+	return post(context.Background(), c.as(auth), url, payload, out)
+}
+
+func post(ctx context.Context, do doFunc, url string, payload, out interface{}) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("POST %s: %v", url, err)
+		return fmt.Errorf("POST %s: %w", url, err)
 	}
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("POST %s: %v", url, err)
+		return fmt.Errorf("POST %s: %w", url, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
-	resp, err := c.Do(req)
+	resp, err := do(req)
 	if err != nil {
-		return fmt.Errorf("POST %s: %v", url, err)
+		return fmt.Errorf("POST %s: %w", url, err)
 	}
 	if err := UnmarshalResponse(resp, out); err != nil {
-		return fmt.Errorf("POST %s: %v", url, err)
+		return fmt.Errorf("POST %s: %w", url, err)
 	}
 	return nil
 }
@@ -114,21 +462,28 @@ func (c Client) Post(url string, payload, out interface{}) error {
 // the request is marshaled into the out parameter unless the out
 // parameter is set to nil.
 func (c Client) Put(url string, payload, out interface{}) error {
+	return c.PutContext(context.Background(), url, payload, out)
+}
+
+// PutContext performes an HTTP put request like Put with the given
+// context.  The request is aborted if the context is canceled.
+func (c Client) PutContext(ctx context.Context, url string, payload, out interface{}) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("PUT %s: %v", url, err)
+		return fmt.Errorf("PUT %s: %w", url, err)
 	}
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	c.logPayload(http.MethodPut, url, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("PUT %s: %v", url, err)
+		return fmt.Errorf("PUT %s: %w", url, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	resp, err := c.Do(req)
 	if err != nil {
-		return fmt.Errorf("PUT %s: %v", url, err)
+		return fmt.Errorf("PUT %s: %w", url, err)
 	}
 	if err := UnmarshalResponse(resp, out); err != nil {
-		return fmt.Errorf("PUT %s: %v", url, err)
+		return fmt.Errorf("PUT %s: %w", url, err)
 	}
 	return nil
 }
@@ -138,26 +493,330 @@ func (c Client) Put(url string, payload, out interface{}) error {
 // response of the request is marshaled into the out parameter unless
 // the out parameter is set to nil.
 func (c Client) Delete(url string, out interface{}) error {
-	req, err := http.NewRequest(http.MethodDelete, url, http.NoBody)
+	return c.DeleteContext(context.Background(), url, out)
+}
+
+// DeleteContext performes an HTTP delete request like Delete with the
+// given context.  The request is aborted if the context is canceled.
+func (c Client) DeleteContext(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, http.NoBody)
 	if err != nil {
-		return fmt.Errorf("DELETE %s: %v", url, err)
+		return fmt.Errorf("DELETE %s: %w", url, err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	resp, err := c.Do(req)
 	if err != nil {
-		return fmt.Errorf("DELETE %s: %v", url, err)
+		return fmt.Errorf("DELETE %s: %w", url, err)
 	}
 	if err := UnmarshalResponse(resp, out); err != nil {
-		return fmt.Errorf("DELETE %s: %v", url, err)
+		return fmt.Errorf("DELETE %s: %w", url, err)
 	}
 	return nil
 }
 
+// GetBook returns the book (or project) with the given project id.
+func (c Client) GetBook(projectID int) (*Book, error) {
+	var book Book
+	if err := c.Get(c.URL("books/%d", projectID), &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// ListBooks returns the books (or projects) of the client's session.
+func (c Client) ListBooks() (*Books, error) {
+	var books Books
+	if err := c.Get(c.URL("books"), &books); err != nil {
+		return nil, err
+	}
+	return &books, nil
+}
+
+// DeleteProject deletes the project with the given id.  The client's
+// session must own the project.  Projects that do not exist (404 Not
+// Found) are treated as already deleted and no error is returned.
+// Other errors of the api are returned as wrapped ErrorResponse
+// values.
+func (c Client) DeleteProject(projectID int) error {
+	err := c.Delete(c.URL("books/%d", projectID), nil)
+	var errresp ErrorResponse
+	if errors.As(err, &errresp) && errresp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// GetLine returns the line with the given project, page and line IDs
+// including its tokens.  Errors of the api are returned as wrapped
+// ErrorResponse values.
+func (c Client) GetLine(projectID, pageID, lineID int) (*Line, error) {
+	var line Line
+	url := c.URL("books/%d/pages/%d/lines/%d", projectID, pageID, lineID)
+	if err := c.Get(url, &line); err != nil {
+		return nil, err
+	}
+	return &line, nil
+}
+
+// CorrectLine corrects the line with the given project, page and line
+// IDs and returns the updated line.  The correction type of the
+// request (manual or automatic) is sent unchanged.
+func (c Client) CorrectLine(projectID, pageID, lineID int, req CorrectionRequest) (*Line, error) {
+	var line Line
+	url := c.URL("books/%d/pages/%d/lines/%d", projectID, pageID, lineID)
+	if err := c.Put(url, req, &line); err != nil {
+		return nil, err
+	}
+	return &line, nil
+}
+
+// CorrectToken corrects the token with the given project, page, line
+// and token IDs and returns the updated token.  The correction type of
+// the request (manual or automatic) is sent unchanged.
+func (c Client) CorrectToken(projectID, pageID, lineID, tokenID int, req CorrectionRequest) (*Token, error) {
+	var token Token
+	url := c.URL("books/%d/pages/%d/lines/%d/tokens/%d", projectID, pageID, lineID, tokenID)
+	if err := c.Put(url, req, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// GetLines returns the lines with the given ids of the given page.
+// The lines are requested concurrently with at most concurrency
+// parallel requests.  The returned lines have the order of the given
+// line ids.  All pending requests are aborted if the given context is
+// canceled or if any request fails.
+func (c Client) GetLines(ctx context.Context, projectID, pageID int, lineIDs []int, concurrency int) ([]Line, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lines := make([]Line, len(lineIDs))
+	ids := make(chan int)
+	var once sync.Once
+	var err error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(lineIDs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ids {
+				url := c.URL("books/%d/pages/%d/lines/%d", projectID, pageID, lineIDs[i])
+				if e := get(ctx, c.Do, url, &lines[i]); e != nil {
+					once.Do(func() {
+						err = e
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+loop:
+	for i := range lineIDs {
+		select {
+		case ids <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(ids)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil { // canceled by the caller
+		return nil, ctx.Err()
+	}
+	return lines, nil
+}
+
+// UpdateBook updates the editable metadata (author, title and
+// description) of the given project and returns the updated book.
+// All other fields of the given book are ignored.
+func (c Client) UpdateBook(projectID int, b Book) (*Book, error) {
+	data := struct {
+		Author      string `json:"author"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}{b.Author, b.Title, b.Description}
+	var book Book
+	if err := c.Put(c.URL("books/%d", projectID), data, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// CorrectBatch sends a batch of token corrections for the given
+// project and returns the updated tokens.  The corrections are
+// applied all at once: if any of the corrections fails, none of the
+// corrections are applied.
+func (c Client) CorrectBatch(projectID int, req BatchCorrectionRequest) (*Tokens, error) {
+	var tokens Tokens
+	if err := c.Post(c.URL("books/%d/corrections", projectID), req, &tokens); err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
+
+// StartPostCorrection starts the post correction of the given project
+// and returns the id of the post correction job.  The additional
+// lexicon is optional (it may be empty).  It is validated before the
+// request is sent.
+func (c Client) StartPostCorrection(projectID int, lex AdditionalLexicon) (int, error) {
+	if err := lex.Validate(); err != nil {
+		return 0, err
+	}
+	var job Job
+	if err := c.Post(c.URL("postcorrect/books/%d", projectID), lex, &job); err != nil {
+		return 0, err
+	}
+	return job.ID, nil
+}
+
+// GetPostCorrection returns the results of the post correction of the
+// given project.
+func (c Client) GetPostCorrection(projectID int) (*PostCorrection, error) {
+	var pc PostCorrection
+	if err := c.Get(c.URL("postcorrect/books/%d", projectID), &pc); err != nil {
+		return nil, err
+	}
+	return &pc, nil
+}
+
+// GetSuggestionsForToken returns the profiler's suggestions for the
+// given token of the given project.  Only the suggestions of the
+// given token are requested.
+func (c Client) GetSuggestionsForToken(projectID int, token string) ([]Suggestion, error) {
+	var suggs Suggestions
+	q := url.QueryEscape(token)
+	if err := c.Get(c.URL("profile/books/%d?q=%s", projectID, q), &suggs); err != nil {
+		return nil, err
+	}
+	return suggs.Suggestions[token], nil
+}
+
+// Search searches the given project for the given query and returns
+// at most max matches after skipping the first skip matches.  If
+// errorPattern is true, the query is interpreted as an error pattern
+// instead of a token.
+func (c Client) Search(projectID int, query string, skip, max int, errorPattern bool) (*SearchResults, error) {
+	typ := SearchToken
+	if errorPattern {
+		typ = SearchPattern
+	}
+	q := url.Values{}
+	q.Set("q", query)
+	q.Set("type", string(typ))
+	q.Set("skip", strconv.Itoa(skip))
+	q.Set("max", strconv.Itoa(max))
+	var res SearchResults
+	if err := c.Get(c.URL("books/%d/search?%s", projectID, q.Encode()), &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// SearchAll pages through all results of the given search (see
+// Search) requesting at most max matches per page and calls f for each
+// page.  Paging stops if f returns an error, which is then returned.
+func (c Client) SearchAll(projectID int, query string, max int, errorPattern bool, f func(*SearchResults) error) error {
+	for skip := 0; ; {
+		res, err := c.Search(projectID, query, skip, max, errorPattern)
+		if err != nil {
+			return err
+		}
+		if err := f(res); err != nil {
+			return err
+		}
+		n := 0
+		for _, m := range res.Matches {
+			n += len(m.Lines)
+		}
+		if n == 0 || res.Skip+n >= res.Total {
+			return nil
+		}
+		skip = res.Skip + n
+	}
+}
+
+// GetLanguages returns the profiler's configured languages.
+func (c Client) GetLanguages() (*Languages, error) {
+	var langs Languages
+	if err := c.Get(c.URL("profile/languages"), &langs); err != nil {
+		return nil, err
+	}
+	return &langs, nil
+}
+
+// languageCache caches the profiler's languages.  It is shared
+// between all copies of a client.
+type languageCache struct {
+	mu        sync.Mutex
+	languages *Languages
+	fetching  chan struct{} // closed if the running fetch is done
+}
+
+// get returns the cached languages.  If the languages are not yet
+// cached, they are fetched with the given function.  The lock is not
+// held during the fetch; concurrent callers wait for the running fetch
+// instead of starting their own.  Errors are not cached, so a failed
+// fetch is retried by the next caller.
+func (lc *languageCache) get(fetch func() (*Languages, error)) (*Languages, error) {
+	for {
+		lc.mu.Lock()
+		if lc.languages != nil {
+			langs := lc.languages
+			lc.mu.Unlock()
+			return langs, nil
+		}
+		if wait := lc.fetching; wait != nil {
+			lc.mu.Unlock()
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		lc.fetching = done
+		lc.mu.Unlock()
+		langs, err := fetch()
+		lc.mu.Lock()
+		lc.fetching = nil
+		if err == nil {
+			lc.languages = langs
+		}
+		lc.mu.Unlock()
+		close(done)
+		return langs, err
+	}
+}
+
+// ValidateLanguage returns true if the given language is supported by
+// the profiler.  The languages are compared case-insensitively.  The
+// profiler's languages are requested once and cached in the client.
+// It is safe to call ValidateLanguage concurrently.
+func (c Client) ValidateLanguage(lang string) (bool, error) {
+	fetch := c.GetLanguages
+	var langs *Languages
+	var err error
+	if c.languages == nil { // client was not created with NewClient
+		langs, err = fetch()
+	} else {
+		langs, err = c.languages.get(fetch)
+	}
+	if err != nil {
+		return false, err
+	}
+	return langs.Contains(lang), nil
+}
+
 // UnmarshalResponse unmarshals the response of a pocoweb api into to
 // the given output parameter.  The content of the response is assumed
 // to be (gzipped) json-encoded.  The response body is closed and
 // possible api errors are handled.  If out is set to nil, the
-// response data (if any) is discarded.
+// response data (if any) is discarded.  If the response is not empty
+// and its Content-Type is not `application/json`, an error is
+// returned.
 func UnmarshalResponse(resp *http.Response, out interface{}) error {
 	body, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
@@ -175,9 +834,13 @@ func UnmarshalResponse(resp *http.Response, out interface{}) error {
 		}
 		return errresp
 	}
-	if out == nil {
+	if out == nil || len(body) == 0 {
 		return nil
 	}
+	if !IsValidJSONResponse(resp, resp.StatusCode) {
+		return fmt.Errorf("invalid response: %s: invalid content type: %q",
+			resp.Status, resp.Header.Get("Content-Type"))
+	}
 	if resp.Header.Get("Content-Encoding") == "gzip" {
 		gzip, err := gzip.NewReader(bytes.NewReader(body))
 		if err != nil {
@@ -0,0 +1,791 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/ulog"
+)
+
+func withTestServer(t *testing.T, h http.HandlerFunc, f func(*Client)) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	f(NewClient(srv.URL, false))
+}
+
+func TestUnmarshalResponseHTML(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>login</body></html>"))
+	}, func(c *Client) {
+		var v Version
+		err := c.Get(c.URL("api-version"), &v)
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+		if !strings.Contains(err.Error(), "text/html") {
+			t.Fatalf("invalid error: %v", err)
+		}
+	})
+}
+
+func TestUnmarshalResponseNoContent(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, func(c *Client) {
+		var v Version
+		if err := c.Get(c.URL("api-version"), &v); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	})
+}
+
+func TestUnmarshalResponseJSON(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"version":"1.0"}`))
+	}, func(c *Client) {
+		var v Version
+		if err := c.Get(c.URL("api-version"), &v); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if v.Version != "1.0" {
+			t.Fatalf("expected version 1.0; got %s", v.Version)
+		}
+	})
+}
+
+func TestGetLine(t *testing.T) {
+	const payload = `{"lineId":3,"pageId":2,"projectId":1,"bookId":1,
+"ocr":"Vnd dcr","cor":"Und der",
+"tokens":[
+{"tokenId":0,"lineId":3,"offset":0,"ocr":"Vnd","cor":"Und"},
+{"tokenId":4,"lineId":3,"offset":4,"ocr":"dcr","cor":"der"}]}`
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/books/1/pages/2/lines/3" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(payload))
+	}, func(c *Client) {
+		line, err := c.GetLine(1, 2, 3)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if line.ID() != "1:2:3" || len(line.Tokens) != 2 {
+			t.Fatalf("invalid line: %v", line)
+		}
+		if line.Tokens[1].Offset != 4 || line.Tokens[1].Cor != "der" {
+			t.Fatalf("invalid token: %v", line.Tokens[1])
+		}
+		_, err = c.GetLine(1, 2, 4)
+		var errresp ErrorResponse
+		if !errors.As(err, &errresp) || errresp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected not found error; got %v", err)
+		}
+	})
+}
+
+func TestValidateLanguage(t *testing.T) {
+	var n int
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"languages":["german","latin"]}`))
+	}, func(c *Client) {
+		for _, lang := range []string{"German", "latin"} {
+			ok, err := c.ValidateLanguage(lang)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !ok {
+				t.Fatalf("invalid language: %s", lang)
+			}
+		}
+		if ok, _ := c.ValidateLanguage("english"); ok {
+			t.Fatalf("english should not be valid")
+		}
+		// copies of the client share the cache
+		cc := *c
+		if ok, _ := cc.ValidateLanguage("latin"); !ok {
+			t.Fatalf("latin should be valid")
+		}
+		if n != 1 {
+			t.Fatalf("expected 1 request; got %d", n)
+		}
+	})
+}
+
+func TestValidateLanguageConcurrent(t *testing.T) {
+	var n int32
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"languages":["german","latin"]}`))
+	}, func(c *Client) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(c Client) {
+				defer wg.Done()
+				if ok, err := c.ValidateLanguage("german"); err != nil || !ok {
+					t.Errorf("expected german to be valid: %v", err)
+				}
+			}(*c)
+		}
+		wg.Wait()
+		if got := atomic.LoadInt32(&n); got != 1 {
+			t.Fatalf("expected 1 request; got %d", got)
+		}
+	})
+}
+
+func TestValidateLanguageRetry(t *testing.T) {
+	var n int
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n++
+		if n == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"languages":["german","latin"]}`))
+	}, func(c *Client) {
+		if _, err := c.ValidateLanguage("german"); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if ok, err := c.ValidateLanguage("german"); err != nil || !ok {
+			t.Fatalf("expected german to be valid: %v", err)
+		}
+		if n != 2 {
+			t.Fatalf("expected 2 requests; got %d", n)
+		}
+	})
+}
+
+func TestAutoReauth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"valid-password", "secret", http.StatusOK},
+		{"invalid-password", "invalid", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logins int
+			withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == "/login" {
+					logins++
+					var login LoginRequest
+					if err := json.NewDecoder(r.Body).Decode(&login); err != nil ||
+						login.Password != "secret" {
+						w.WriteHeader(http.StatusForbidden)
+						w.Write([]byte(`{"code":403}`))
+						return
+					}
+					w.Write([]byte(`{"auth":"renewed"}`))
+					return
+				}
+				if r.Header.Get("Authorization") != "renewed" {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"code":401}`))
+					return
+				}
+				// echo the posted body
+				io.Copy(w, r.Body)
+			}, func(c *Client) {
+				c.Session.Auth = "expired"
+				c.WithAutoReauth("user@example.com", tc.password)
+				var out Version
+				err := c.Post(c.URL("api-version"), Version{Version: "1.0"}, &out)
+				got := http.StatusOK
+				var errresp ErrorResponse
+				if errors.As(err, &errresp) {
+					got = errresp.StatusCode
+				}
+				if got != tc.want {
+					t.Fatalf("expected status %d; got %d (%v)", tc.want, got, err)
+				}
+				if logins != 1 {
+					t.Fatalf("expected 1 login; got %d", logins)
+				}
+				if err == nil && out.Version != "1.0" {
+					t.Fatalf("expected version 1.0; got %s", out.Version)
+				}
+			})
+		})
+	}
+}
+
+func TestDoAs(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Version{Version: r.Header.Get("Authorization")})
+	}, func(c *Client) {
+		c.Session.Auth = "session"
+		tests := []struct {
+			name string
+			call func(*Version) error
+			want string
+		}{
+			{"Get", func(v *Version) error { return c.Get(c.URL("api-version"), v) }, "session"},
+			{"GetAs", func(v *Version) error { return c.GetAs("other", c.URL("api-version"), v) }, "other"},
+			{"PostAs", func(v *Version) error { return c.PostAs("other", c.URL("api-version"), nil, v) }, "other"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				var v Version
+				if err := tc.call(&v); err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if v.Version != tc.want {
+					t.Fatalf("expected auth %q; got %q", tc.want, v.Version)
+				}
+				if c.Session.Auth != "session" {
+					t.Fatalf("session changed: %q", c.Session.Auth)
+				}
+			})
+		}
+	})
+}
+
+func TestPostCorrection(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/postcorrect/books/3" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			var lex AdditionalLexicon
+			if err := json.NewDecoder(r.Body).Decode(&lex); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id":42}`))
+			return
+		}
+		w.Write([]byte(`{"bookId":3,"projectId":3,"corrections":{
+"3:1:2:0":{"bookId":3,"projectId":3,"pageId":1,"lineId":2,"tokenId":0,
+"normalized":"vnd","ocr":"vnd","cor":"und","confidence":0.9,"taken":true},
+"3:1:2:4":{"bookId":3,"projectId":3,"pageId":1,"lineId":2,"tokenId":4,
+"normalized":"theil","ocr":"tbeil","cor":"theil","confidence":0.3,"taken":false}}}`))
+	}, func(c *Client) {
+		if _, err := c.StartPostCorrection(3, AdditionalLexicon{Tokens: []string{"two words"}}); err == nil {
+			t.Fatalf("expected an error")
+		}
+		id, err := c.StartPostCorrection(3, AdditionalLexicon{Tokens: []string{"vnd"}})
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if id != 42 {
+			t.Fatalf("expected job id 42; got %d", id)
+		}
+		pc, err := c.GetPostCorrection(3)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(pc.Corrections) != 2 {
+			t.Fatalf("expected 2 corrections; got %d", len(pc.Corrections))
+		}
+		want := PostCorrectionToken{BookID: 3, ProjectID: 3, PageID: 1, LineID: 2,
+			Normalized: "vnd", OCR: "vnd", Cor: "und", Confidence: 0.9, Taken: true}
+		if got := pc.Corrections["3:1:2:0"]; got != want {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+		if pc.Corrections["3:1:2:4"].Taken {
+			t.Fatalf("expected token 3:1:2:4 not to be taken")
+		}
+	})
+}
+
+func TestUpdateBook(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/books/3" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var data map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(data) != 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Book{BookID: 3, ProjectID: 3, IsBook: true,
+			Author: data["author"].(string), Title: data["title"].(string),
+			Description: data["description"].(string), Year: 1800})
+	}, func(c *Client) {
+		book, err := c.UpdateBook(3, Book{Author: "author", Title: "title",
+			Description: "description", Year: 1900, Pooled: true,
+			Status: map[string]bool{"profiled": true}})
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if book.Author != "author" || book.Title != "title" || book.Description != "description" {
+			t.Fatalf("invalid book: %v", book)
+		}
+		if book.Year != 1800 || book.Pooled {
+			t.Fatalf("invalid book: %v", book)
+		}
+	})
+}
+
+func TestGetSuggestionsForToken(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/profile/books/3" || r.URL.Query().Get("q") != "vnd &ſ" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"bookId":3,"projectId":3,"suggestions":{"vnd &ſ":[
+{"token":"vnd &ſ","suggestion":"und &s","modern":"und &s","dict":"modern",
+"distance":2,"id":1,"weight":0.8,"top":true,"ocrPatterns":["u:v"],"histPatterns":["s:ſ"]},
+{"token":"vnd &ſ","suggestion":"und","weight":0.2}]}}`))
+	}, func(c *Client) {
+		suggs, err := c.GetSuggestionsForToken(3, "vnd &ſ")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(suggs) != 2 {
+			t.Fatalf("expected 2 suggestions; got %d", len(suggs))
+		}
+		want := Suggestion{Token: "vnd &ſ", Suggestion: "und &s", Modern: "und &s",
+			Dict: "modern", Distance: 2, ID: 1, Weight: 0.8, Top: true,
+			OCRPatterns: []string{"u:v"}, HistPatterns: []string{"s:ſ"}}
+		if !reflect.DeepEqual(suggs[0], want) {
+			t.Fatalf("expected %v; got %v", want, suggs[0])
+		}
+		if _, err := c.GetSuggestionsForToken(4, "vnd"); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestDeleteProject(t *testing.T) {
+	tests := []struct {
+		name string
+		id   int
+		want int // 0 means no error
+	}{
+		{"deleted", 1, 0},
+		{"not-found", 2, 0},
+		{"forbidden", 3, http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodDelete || r.Header.Get("Authorization") != "owner" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/books/1":
+					w.WriteHeader(http.StatusOK)
+				case "/books/3":
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(`{"code":403,"status":"Forbidden","message":"not allowed"}`))
+				default:
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"code":404,"status":"Not Found","message":"not found"}`))
+				}
+			}, func(c *Client) {
+				c.Session.Auth = "owner"
+				err := c.DeleteProject(tc.id)
+				got := 0
+				var errresp ErrorResponse
+				if errors.As(err, &errresp) {
+					got = errresp.StatusCode
+				} else if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if got != tc.want {
+					t.Fatalf("expected status %d; got %d (%v)", tc.want, got, err)
+				}
+			})
+		})
+	}
+}
+
+func TestGetLines(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var pid, pageID, lid int
+		if _, err := fmt.Sscanf(r.URL.Path, "/books/%d/pages/%d/lines/%d", &pid, &pageID, &lid); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if lid == 13 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code":404,"status":"Not Found","message":"not found"}`))
+			return
+		}
+		// later lines are answered faster
+		time.Sleep(time.Duration(20-lid) * time.Millisecond)
+		json.NewEncoder(w).Encode(Line{ProjectID: pid, PageID: pageID, LineID: lid})
+	}, func(c *Client) {
+		ids := []int{1, 5, 3, 10, 2, 7, 4}
+		lines, err := c.GetLines(context.Background(), 1, 2, ids, 3)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(lines) != len(ids) {
+			t.Fatalf("expected %d lines; got %d", len(ids), len(lines))
+		}
+		for i, line := range lines {
+			if line.LineID != ids[i] || line.PageID != 2 || line.ProjectID != 1 {
+				t.Fatalf("invalid line %d: %v", i, line)
+			}
+		}
+		if _, err := c.GetLines(context.Background(), 1, 2, []int{1, 13, 2}, 2); err == nil {
+			t.Fatalf("expected an error")
+		}
+		lines, err = c.GetLines(context.Background(), 1, 2, nil, 2)
+		if err != nil || len(lines) != 0 {
+			t.Fatalf("expected no lines; got %v (%v)", lines, err)
+		}
+	})
+}
+
+func TestGetLinesCancel(t *testing.T) {
+	var n int32
+	started := make(chan struct{}, 100)
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		started <- struct{}{}
+		<-r.Context().Done() // block until the client aborts
+	}, func(c *Client) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+		ids := make([]int, 50)
+		for i := range ids {
+			ids[i] = i + 1
+		}
+		done := make(chan error)
+		go func() {
+			_, err := c.GetLines(ctx, 1, 2, ids, 2)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected %v; got %v", context.Canceled, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GetLines was not canceled")
+		}
+		if got := atomic.LoadInt32(&n); got > 2 {
+			t.Fatalf("expected at most 2 requests; got %d", got)
+		}
+	})
+}
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		payload, want string
+	}{
+		{`{"email":"a@b.c","password":"secret"}`, `{"email":"a@b.c","password":"***"}`},
+		{`{"user":{"Password":"secret","id":12345678901234567890}}`,
+			`{"user":{"Password":"***","id":12345678901234567890}}`},
+		{`[{"newPassword":"secret"},{"cor":"password"}]`, `[{"newPassword":"***"},{"cor":"password"}]`},
+		{`"password"`, `"password"`},
+		{`invalid`, `***`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.payload, func(t *testing.T) {
+			if got := string(RedactPayload([]byte(tc.payload))); got != tc.want {
+				t.Fatalf("expected %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWithPayloadLog(t *testing.T) {
+	defer func(old int) { MaxLoggedPayload = old }(MaxLoggedPayload)
+	MaxLoggedPayload = 60
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}, func(c *Client) {
+		var buf bytes.Buffer
+		if err := c.Put(c.URL("users/1"), LoginRequest{Email: "a@b.c", Password: "secret"}, nil); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		c.WithPayloadLog(ulog.WithWriter(&buf), nil)
+		if err := c.Put(c.URL("users/1"), LoginRequest{Email: "a@b.c", Password: "secret"}, nil); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := c.Put(c.URL("users/1"), strings.Repeat("x", 100), nil); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected 2 log lines; got %q", buf.String())
+		}
+		if strings.Contains(lines[0], "secret") || !strings.Contains(lines[0], "***") {
+			t.Fatalf("password not masked: %s", lines[0])
+		}
+		if strings.Contains(lines[1], strings.Repeat("x", 60)) ||
+			!strings.Contains(lines[1], strings.Repeat("x", 59)+"...") {
+			t.Fatalf("payload not truncated: %s", lines[1])
+		}
+	})
+}
+
+func TestRequestContext(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(context.Context, *Client) error
+	}{
+		{"GET", func(ctx context.Context, c *Client) error {
+			return c.GetContext(ctx, c.URL("books"), nil)
+		}},
+		{"POST", func(ctx context.Context, c *Client) error {
+			return c.PostContext(ctx, c.URL("books"), Book{}, nil)
+		}},
+		{"PUT", func(ctx context.Context, c *Client) error {
+			return c.PutContext(ctx, c.URL("books/1"), Book{}, nil)
+		}},
+		{"DELETE", func(ctx context.Context, c *Client) error {
+			return c.DeleteContext(ctx, c.URL("books/1"), nil)
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			done := make(chan struct{})
+			withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != tc.name {
+					t.Errorf("expected method %s; got %s", tc.name, r.Method)
+				}
+				<-done // block until the client gave up
+			}, func(c *Client) {
+				defer close(done)
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				err := tc.f(ctx, c)
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("expected %v; got %v", context.DeadlineExceeded, err)
+				}
+			})
+		})
+	}
+}
+
+func TestNewClientWithTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done // stall until the client gave up
+	}))
+	defer srv.Close()
+	defer close(done)
+	c := NewClientWithTimeout(srv.URL, false, 50*time.Millisecond)
+	err := c.Get(c.URL("api-version"), nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	var uerr interface{ Timeout() bool }
+	if !errors.As(err, &uerr) || !uerr.Timeout() {
+		t.Fatalf("expected a timeout error; got %v", err)
+	}
+}
+
+func TestSetRetry(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		fail, attempts int
+		timeout        time.Duration
+		wantErr        bool
+		wantRequests   int32
+	}{
+		{"get", http.MethodGet, 2, 3, 0, false, 3},
+		{"put", http.MethodPut, 2, 3, 0, false, 3},
+		{"delete", http.MethodDelete, 1, 3, 0, false, 2},
+		{"post", http.MethodPost, 2, 3, 0, true, 1},
+		{"exhausted", http.MethodGet, 5, 3, 0, true, 3},
+		{"deadline", http.MethodGet, 5, 10, 60 * time.Millisecond, true, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var n int32
+			withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != tc.method {
+					t.Errorf("expected method %s; got %s", tc.method, r.Method)
+				}
+				if r.Method == http.MethodPut {
+					var b Book
+					if err := json.NewDecoder(r.Body).Decode(&b); err != nil || b.Title != "title" {
+						t.Errorf("invalid payload: %v", err)
+					}
+				}
+				if atomic.AddInt32(&n, 1) <= int32(tc.fail) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}, func(c *Client) {
+				c.SetRetry(tc.attempts, 20*time.Millisecond)
+				ctx := context.Background()
+				if tc.timeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+					defer cancel()
+				}
+				var err error
+				switch tc.method {
+				case http.MethodGet:
+					err = c.GetContext(ctx, c.URL("books"), nil)
+				case http.MethodPut:
+					err = c.PutContext(ctx, c.URL("books/1"), Book{Title: "title"}, nil)
+				case http.MethodDelete:
+					err = c.DeleteContext(ctx, c.URL("books/1"), nil)
+				case http.MethodPost:
+					err = c.PostContext(ctx, c.URL("books"), Book{}, nil)
+				}
+				if got := err != nil; got != tc.wantErr {
+					t.Fatalf("expected error=%t; got %v", tc.wantErr, err)
+				}
+				if got := atomic.LoadInt32(&n); got != tc.wantRequests {
+					t.Fatalf("expected %d requests; got %d", tc.wantRequests, got)
+				}
+			})
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	const query = "a b&c"
+	const total = 5
+	var requests []string
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/books/7/search" {
+			t.Errorf("invalid path: %s", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if got := q.Get("q"); got != query {
+			t.Errorf("expected query %q; got %q", query, got)
+		}
+		if got := q.Get("type"); got != string(SearchPattern) {
+			t.Errorf("expected type %q; got %q", SearchPattern, got)
+		}
+		requests = append(requests, r.URL.RawQuery)
+		var skip, max int
+		fmt.Sscanf(q.Get("skip"), "%d", &skip)
+		fmt.Sscanf(q.Get("max"), "%d", &max)
+		res := SearchResults{ProjectID: 7, Total: total, Skip: skip, Max: max, Type: SearchPattern}
+		var m Match
+		for i := skip; i < total && i < skip+max; i++ {
+			m.Lines = append(m.Lines, Line{LineID: i + 1})
+		}
+		m.Total = total
+		res.Matches = map[string]Match{query: m}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}, func(c *Client) {
+		var ids []int
+		err := c.SearchAll(7, query, 2, true, func(res *SearchResults) error {
+			for _, line := range res.Matches[query].Lines {
+				ids = append(ids, line.LineID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(ids, want) {
+			t.Fatalf("expected %v; got %v", want, ids)
+		}
+		if len(requests) != 3 {
+			t.Fatalf("expected 3 requests; got %d: %v", len(requests), requests)
+		}
+	})
+}
+
+func TestListBooks(t *testing.T) {
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/books" {
+			t.Errorf("invalid request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Books{Books: []Book{{ProjectID: 1}, {ProjectID: 2}}})
+	}, func(c *Client) {
+		books, err := c.ListBooks()
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(books.Books) != 2 || books.Books[0].ProjectID != 1 || books.Books[1].ProjectID != 2 {
+			t.Fatalf("invalid books: %+v", books.Books)
+		}
+	})
+}
+
+func TestCorrect(t *testing.T) {
+	tests := []struct {
+		name, path string
+		manual     bool
+		correct    func(*Client, CorrectionRequest) (interface{}, error)
+	}{
+		{"line", "/books/1/pages/2/lines/3", true, func(c *Client, req CorrectionRequest) (interface{}, error) {
+			return c.CorrectLine(1, 2, 3, req)
+		}},
+		{"token", "/books/1/pages/2/lines/3/tokens/4", false, func(c *Client, req CorrectionRequest) (interface{}, error) {
+			return c.CorrectToken(1, 2, 3, 4, req)
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := NewCorrectionRequest("correction", tc.manual)
+			withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPut || r.URL.Path != tc.path {
+					t.Errorf("invalid request: %s %s", r.Method, r.URL.Path)
+				}
+				var got CorrectionRequest
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil || got != want {
+					t.Errorf("expected %+v; got %+v (%v)", want, got, err)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(Token{Cor: got.Correction, IsManuallyCorrected: tc.manual})
+			}, func(c *Client) {
+				res, err := tc.correct(c, want)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				switch x := res.(type) {
+				case *Line:
+					if x.Cor != want.Correction {
+						t.Fatalf("expected %q; got %q", want.Correction, x.Cor)
+					}
+				case *Token:
+					if x.Cor != want.Correction || x.IsManuallyCorrected != tc.manual {
+						t.Fatalf("invalid token: %+v", x)
+					}
+				}
+			})
+		})
+	}
+}
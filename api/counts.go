@@ -0,0 +1,60 @@
+package api
+
+import "sort"
+
+// KeyCount defines a key with its count.
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// TopN returns the n most frequent suggestions ordered by their
+// counts.  Suggestions with the same count are ordered by their keys.
+// If n is negative, all suggestions are returned.
+func (c SuggestionCounts) TopN(n int) []KeyCount {
+	return topN(c.Counts, n)
+}
+
+// Merge adds the counts of o to c.
+func (c *SuggestionCounts) Merge(o SuggestionCounts) {
+	c.Counts = mergeCounts(c.Counts, o.Counts)
+}
+
+// TopN returns the n most frequent patterns ordered by their counts.
+// Patterns with the same count are ordered by their keys.  If n is
+// negative, all patterns are returned.
+func (c PatternCounts) TopN(n int) []KeyCount {
+	return topN(c.Counts, n)
+}
+
+// Merge adds the counts of o to c.
+func (c *PatternCounts) Merge(o PatternCounts) {
+	c.Counts = mergeCounts(c.Counts, o.Counts)
+}
+
+func topN(counts map[string]int, n int) []KeyCount {
+	ret := make([]KeyCount, 0, len(counts))
+	for k, v := range counts {
+		ret = append(ret, KeyCount{Key: k, Count: v})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	if n >= 0 && n < len(ret) {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+func mergeCounts(dst, src map[string]int) map[string]int {
+	if dst == nil {
+		dst = make(map[string]int, len(src))
+	}
+	for k, v := range src {
+		dst[k] += v
+	}
+	return dst
+}
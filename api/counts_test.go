@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCountsTopN(t *testing.T) {
+	counts := map[string]int{"c": 2, "a": 2, "d": 5, "b": 1, "e": 2}
+	tests := []struct {
+		n    int
+		want []KeyCount
+	}{
+		{0, []KeyCount{}},
+		{1, []KeyCount{{"d", 5}}},
+		{3, []KeyCount{{"d", 5}, {"a", 2}, {"c", 2}}},
+		{-1, []KeyCount{{"d", 5}, {"a", 2}, {"c", 2}, {"e", 2}, {"b", 1}}},
+		{10, []KeyCount{{"d", 5}, {"a", 2}, {"c", 2}, {"e", 2}, {"b", 1}}},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprint(tc.n), func(t *testing.T) {
+			// repeat to check the stability of the ordering
+			for i := 0; i < 10; i++ {
+				if got := (SuggestionCounts{Counts: counts}).TopN(tc.n); !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("expected %v; got %v", tc.want, got)
+				}
+				if got := (PatternCounts{Counts: counts}).TopN(tc.n); !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("expected %v; got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCountsMerge(t *testing.T) {
+	var sc SuggestionCounts
+	sc.Merge(SuggestionCounts{Counts: map[string]int{"a": 1, "b": 2}})
+	sc.Merge(SuggestionCounts{Counts: map[string]int{"b": 3, "c": 4}})
+	sc.Merge(SuggestionCounts{})
+	want := map[string]int{"a": 1, "b": 5, "c": 4}
+	if !reflect.DeepEqual(sc.Counts, want) {
+		t.Fatalf("expected %v; got %v", want, sc.Counts)
+	}
+	pc := PatternCounts{Counts: map[string]int{"a": 1}}
+	pc.Merge(PatternCounts{Counts: map[string]int{"a": 1, "b": 1}})
+	want = map[string]int{"a": 2, "b": 1}
+	if !reflect.DeepEqual(pc.Counts, want) {
+		t.Fatalf("expected %v; got %v", want, pc.Counts)
+	}
+}
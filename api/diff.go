@@ -0,0 +1,151 @@
+package api
+
+// DiffType defines the type of diff operations.
+type DiffType string
+
+// The different DiffTypes.
+const (
+	DiffEqual   DiffType = "equal"
+	DiffInsert  DiffType = "insert"
+	DiffDelete  DiffType = "delete"
+	DiffReplace DiffType = "replace"
+)
+
+// DiffOp defines one operation of the difference between an OCR and
+// a corrected string.  OCR holds the affected OCR characters (empty
+// for insertions) and Cor the affected corrected characters (empty
+// for deletions).
+type DiffOp struct {
+	Type DiffType `json:"type"`
+	OCR  string   `json:"ocr"`
+	Cor  string   `json:"cor"`
+}
+
+// Diffs defines a sequence of diff operations.
+type Diffs []DiffOp
+
+// Append appends the given runes with the given type to the diff
+// sequence.  Consecutive operations of the same type are merged.  A
+// rune value of 0 is ignored.  Use a DiffBuilder to build longer
+// sequences rune by rune.
+func (ds Diffs) Append(typ DiffType, ocr, cor rune) Diffs {
+	if len(ds) == 0 || ds[len(ds)-1].Type != typ {
+		ds = append(ds, DiffOp{Type: typ})
+	}
+	last := &ds[len(ds)-1]
+	if ocr != 0 {
+		last.OCR += string(ocr)
+	}
+	if cor != 0 {
+		last.Cor += string(cor)
+	}
+	return ds
+}
+
+// DiffBuilder builds diff sequences rune by rune.  The runes of the
+// current operation are collected in buffers and converted to strings
+// once the operation is complete, so appending a rune does not
+// allocate a new string.  The zero value is ready to use.
+type DiffBuilder struct {
+	ds       Diffs
+	typ      DiffType
+	ocr, cor []rune
+}
+
+// Append appends the given runes with the given type (see
+// Diffs.Append).
+func (b *DiffBuilder) Append(typ DiffType, ocr, cor rune) {
+	if typ != b.typ {
+		b.flush()
+		b.typ = typ
+	}
+	if ocr != 0 {
+		b.ocr = append(b.ocr, ocr)
+	}
+	if cor != 0 {
+		b.cor = append(b.cor, cor)
+	}
+}
+
+// Diffs returns the built diff sequence.
+func (b *DiffBuilder) Diffs() Diffs {
+	b.flush()
+	return b.ds
+}
+
+// flush appends the current operation to the diff sequence.
+func (b *DiffBuilder) flush() {
+	if b.typ == "" {
+		return
+	}
+	b.ds = append(b.ds, DiffOp{Type: b.typ, OCR: string(b.ocr), Cor: string(b.cor)})
+	b.typ, b.ocr, b.cor = "", b.ocr[:0], b.cor[:0]
+}
+
+// Diff returns the difference between the token's OCR and corrected
+// strings.  The difference is computed from an edit-distance
+// alignment of the two strings.
+func (t Token) Diff() Diffs {
+	return Diff(t.OCR, t.Cor)
+}
+
+// Diff computes the difference between the given OCR and corrected
+// strings using an edit-distance alignment.
+func Diff(ocr, cor string) Diffs {
+	o, c := []rune(ocr), []rune(cor)
+	n, m := len(o), len(c)
+	w := m + 1
+	d := make([]int, (n+1)*w)
+	for i := 0; i <= n; i++ {
+		d[i*w] = i
+	}
+	for j := 0; j <= m; j++ {
+		d[j] = j
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			sub := d[(i-1)*w+j-1]
+			if o[i-1] != c[j-1] {
+				sub++
+			}
+			d[i*w+j] = min3(sub, d[(i-1)*w+j]+1, d[i*w+j-1]+1)
+		}
+	}
+	// backtrack the alignment (in reverse order)
+	type step struct {
+		typ      DiffType
+		ocr, cor rune
+	}
+	steps := make([]step, 0, n+m)
+	for i, j := n, m; i > 0 || j > 0; {
+		switch {
+		case i > 0 && j > 0 && o[i-1] == c[j-1] && d[i*w+j] == d[(i-1)*w+j-1]:
+			steps = append(steps, step{DiffEqual, o[i-1], c[j-1]})
+			i, j = i-1, j-1
+		case i > 0 && j > 0 && d[i*w+j] == d[(i-1)*w+j-1]+1:
+			steps = append(steps, step{DiffReplace, o[i-1], c[j-1]})
+			i, j = i-1, j-1
+		case i > 0 && d[i*w+j] == d[(i-1)*w+j]+1:
+			steps = append(steps, step{DiffDelete, o[i-1], 0})
+			i--
+		default:
+			steps = append(steps, step{DiffInsert, 0, c[j-1]})
+			j--
+		}
+	}
+	var b DiffBuilder
+	for i := len(steps) - 1; i >= 0; i-- {
+		b.Append(steps[i].typ, steps[i].ocr, steps[i].cor)
+	}
+	return b.Diffs()
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		ocr, cor string
+		want     Diffs
+	}{
+		{"abc", "abc", Diffs{{DiffEqual, "abc", "abc"}}},
+		{"", "", nil},
+		{"ac", "abc", Diffs{{DiffEqual, "a", "a"}, {DiffInsert, "", "b"}, {DiffEqual, "c", "c"}}},
+		{"abc", "ac", Diffs{{DiffEqual, "a", "a"}, {DiffDelete, "b", ""}, {DiffEqual, "c", "c"}}},
+		{"abc", "axc", Diffs{{DiffEqual, "a", "a"}, {DiffReplace, "b", "x"}, {DiffEqual, "c", "c"}}},
+		{"Vnd", "Und", Diffs{{DiffReplace, "V", "U"}, {DiffEqual, "nd", "nd"}}},
+		{"", "ab", Diffs{{DiffInsert, "", "ab"}}},
+		{"ab", "", Diffs{{DiffDelete, "ab", ""}}},
+		{"ſeyn", "seyn", Diffs{{DiffReplace, "ſ", "s"}, {DiffEqual, "eyn", "eyn"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ocr+"_"+tc.cor, func(t *testing.T) {
+			got := Token{OCR: tc.ocr, Cor: tc.cor}.Diff()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDiffBuilder(t *testing.T) {
+	ops := []struct {
+		typ      DiffType
+		ocr, cor rune
+	}{
+		{DiffEqual, 'a', 'a'}, {DiffEqual, 'b', 'b'}, {DiffInsert, 0, 'x'},
+		{DiffReplace, 'ſ', 's'}, {DiffReplace, 'c', 'd'}, {DiffDelete, 'e', 0},
+	}
+	var b DiffBuilder
+	var want Diffs
+	for _, op := range ops {
+		b.Append(op.typ, op.ocr, op.cor)
+		want = want.Append(op.typ, op.ocr, op.cor)
+	}
+	if got := b.Diffs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+	// the allocations do not depend on the number of runes
+	ocr := strings.Repeat("a", 500)
+	allocs := testing.AllocsPerRun(10, func() {
+		var b DiffBuilder
+		for _, r := range ocr {
+			b.Append(DiffEqual, r, r)
+		}
+		b.Diffs()
+	})
+	if allocs > 50 {
+		t.Fatalf("expected at most 50 allocations; got %v", allocs)
+	}
+}
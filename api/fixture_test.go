@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fixture defines a recorded response of the backend for the request
+// with the given method and path.
+type fixture struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Status int               `json:"status"`
+	Header map[string]string `json:"header"`
+	Body   json.RawMessage   `json:"body"`
+}
+
+// fixtureTransport replays recorded responses keyed by the method and
+// path of the requests.  Requests without a recorded response fail.
+type fixtureTransport map[string]fixture
+
+// loadFixtures loads all json fixtures in the given directory.
+func loadFixtures(t *testing.T, dir string) fixtureTransport {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	tr := make(fixtureTransport, len(paths))
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var f fixture
+		if err := json.Unmarshal(buf, &f); err != nil {
+			t.Fatalf("cannot load fixture %s: %v", path, err)
+		}
+		tr[f.Method+" "+f.Path] = f
+	}
+	return tr
+}
+
+func (tr fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, ok := tr[req.Method+" "+req.URL.Path]
+	if !ok {
+		return nil, fmt.Errorf("no fixture for %s %s", req.Method, req.URL.Path)
+	}
+	header := make(http.Header, len(f.Header))
+	for k, v := range f.Header {
+		header.Set(k, v)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode: f.Status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader(f.Body)),
+		Request:    req,
+	}, nil
+}
+
+func TestFixtureGetBook(t *testing.T) {
+	c := NewClient("http://pocoweb", false).
+		WithTransport(loadFixtures(t, filepath.Join("testdata", "fixtures")))
+	book, err := c.GetBook(3)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := Book{
+		Author: "Grimmelshausen", Title: "Simplicissimus", Language: "german",
+		Status:       map[string]bool{"profiled": true, "extended-lexicon": false, "post-corrected": false},
+		ProfilerURL:  "local",
+		Description:  "Der abenteuerliche Simplicissimus Teutsch",
+		HistPatterns: "t:th,u:v", OCRModel: "fraktur", Year: 1669,
+		BookID: 3, ProjectID: 3, Pages: 2, PageIDs: []int{1, 2}, IsBook: true,
+	}
+	if !reflect.DeepEqual(*book, want) {
+		t.Fatalf("expected %v; got %v", want, *book)
+	}
+	if _, err := c.GetBook(4); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if _, err := c.GetBook(5); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
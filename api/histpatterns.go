@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HistPattern defines a historical pattern that maps a modern
+// spelling to a historical spelling (e.g. `t:th`).
+type HistPattern struct {
+	Modern string `json:"modern"`
+	Hist   string `json:"hist"`
+}
+
+func (p HistPattern) String() string {
+	return p.Modern + ":" + p.Hist
+}
+
+// HistPatternSet defines a set of historical patterns.
+type HistPatternSet []HistPattern
+
+// ParseHistPatterns parses a set of historical patterns.  The
+// patterns are given as a comma-separated list of `modern:hist`
+// pairs (e.g. `t:th,ei:ey`).  Whitespace around the pairs is ignored
+// and an empty string yields an empty set.  At least one side of each
+// pair must not be empty and neither side can contain `:` or `,`.
+func ParseHistPatterns(str string) (HistPatternSet, error) {
+	if strings.TrimSpace(str) == "" {
+		return nil, nil
+	}
+	var set HistPatternSet
+	for _, pair := range strings.Split(str, ",") {
+		pair = strings.TrimSpace(pair)
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+			return nil, fmt.Errorf("invalid historical pattern: %q", pair)
+		}
+		set = append(set, HistPattern{Modern: parts[0], Hist: parts[1]})
+	}
+	return set, nil
+}
+
+// String returns the serialized form of the set that can be parsed
+// using ParseHistPatterns.
+func (set HistPatternSet) String() string {
+	strs := make([]string, len(set))
+	for i, p := range set {
+		strs[i] = p.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// HistPatternSet parses and returns the book's historical patterns.
+func (b Book) HistPatternSet() (HistPatternSet, error) {
+	return ParseHistPatterns(b.HistPatterns)
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHistPatterns(t *testing.T) {
+	tests := []struct {
+		test, str string
+		want      HistPatternSet
+		iserr     bool
+	}{
+		{"", "", nil, false},
+		{"t:th", "t:th", HistPatternSet{{"t", "th"}}, false},
+		{"t:th,ei:ey", "t:th,ei:ey", HistPatternSet{{"t", "th"}, {"ei", "ey"}}, false},
+		{" t:th , ei:ey ", "t:th,ei:ey", HistPatternSet{{"t", "th"}, {"ei", "ey"}}, false},
+		{":h", ":h", HistPatternSet{{"", "h"}}, false},
+		{"t", "", nil, true},
+		{"t:th:x", "", nil, true},
+		{"t:th,", "", nil, true},
+		{":", "", nil, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.test, func(t *testing.T) {
+			got, err := Book{HistPatterns: tc.test}.HistPatternSet()
+			if tc.iserr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+			if str := got.String(); str != tc.str {
+				t.Fatalf("expected %q; got %q", tc.str, str)
+			}
+		})
+	}
+}
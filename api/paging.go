@@ -0,0 +1,63 @@
+package api
+
+// Paging defines the pagination information of paged list responses.
+// Skip is the number of skipped items, Max the maximal number of items
+// per page and Total the total number of items.
+type Paging struct {
+	Total int `json:"total"`
+	Skip  int `json:"skip"`
+	Max   int `json:"max"`
+}
+
+// HasNext returns true if there are more items after the current
+// page.  If Max is not positive, all items are on one page.
+func (p Paging) HasNext() bool {
+	return p.Max > 0 && p.Skip+p.Max < p.Total
+}
+
+// Next returns the paging information of the next page.
+func (p Paging) Next() Paging {
+	return Paging{Total: p.Total, Skip: p.Skip + p.Max, Max: p.Max}
+}
+
+// Page returns the (1-based) number of the current page.  If Max is
+// not positive, 1 is returned.
+func (p Paging) Page() int {
+	if p.Max <= 0 {
+		return 1
+	}
+	return p.Skip/p.Max + 1
+}
+
+// Pages returns the total number of pages.  If Max is not positive,
+// 1 is returned.
+func (p Paging) Pages() int {
+	if p.Max <= 0 || p.Total == 0 {
+		return 1
+	}
+	return (p.Total + p.Max - 1) / p.Max
+}
+
+// PagedBooks defines a paged list of books.
+type PagedBooks struct {
+	Items []Book `json:"items"`
+	Paging
+}
+
+// NewPagedBooks creates a new paged list of books from the books of
+// the current page and the total number of books.
+func NewPagedBooks(books []Book, total, skip, max int) PagedBooks {
+	return PagedBooks{Items: books, Paging: Paging{Total: total, Skip: skip, Max: max}}
+}
+
+// PagedUsers defines a paged list of users.
+type PagedUsers struct {
+	Items []User `json:"items"`
+	Paging
+}
+
+// NewPagedUsers creates a new paged list of users from the users of
+// the current page and the total number of users.
+func NewPagedUsers(users []User, total, skip, max int) PagedUsers {
+	return PagedUsers{Items: users, Paging: Paging{Total: total, Skip: skip, Max: max}}
+}
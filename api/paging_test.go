@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPagedBooksJSON(t *testing.T) {
+	books := NewPagedBooks([]Book{{BookID: 3, Title: "title"}}, 25, 20, 10)
+	buf, err := json.Marshal(books)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	for _, key := range []string{"items", "total", "skip", "max"} {
+		if _, ok := fields[key]; !ok {
+			t.Fatalf("missing field %q in %s", key, buf)
+		}
+	}
+	var got PagedBooks
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if !reflect.DeepEqual(got, books) {
+		t.Fatalf("expected %v; got %v", books, got)
+	}
+}
+
+func TestPaging(t *testing.T) {
+	tests := []struct {
+		p           Paging
+		page, pages int
+		next        bool
+	}{
+		{Paging{Total: 25, Skip: 0, Max: 10}, 1, 3, true},
+		{Paging{Total: 25, Skip: 10, Max: 10}, 2, 3, true},
+		{Paging{Total: 25, Skip: 20, Max: 10}, 3, 3, false},
+		{Paging{Total: 20, Skip: 10, Max: 10}, 2, 2, false},
+		{Paging{Total: 0, Skip: 0, Max: 10}, 1, 1, false},
+		{Paging{Total: 5}, 1, 1, false},
+	}
+	for _, tc := range tests {
+		if got := tc.p.Page(); got != tc.page {
+			t.Fatalf("%v: expected page %d; got %d", tc.p, tc.page, got)
+		}
+		if got := tc.p.Pages(); got != tc.pages {
+			t.Fatalf("%v: expected %d pages; got %d", tc.p, tc.pages, got)
+		}
+		if got := tc.p.HasNext(); got != tc.next {
+			t.Fatalf("%v: expected next=%t; got %t", tc.p, tc.next, got)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+// Dedup collapses the suggestions of each token that share the same
+// suggestion string.  Of these suggestions only the one with the
+// highest weight is kept.  The order of the remaining suggestions is
+// preserved.
+func (s Suggestions) Dedup() {
+	for token, suggs := range s.Suggestions {
+		pos := make(map[string]int, len(suggs))
+		dedup := suggs[:0]
+		for _, sugg := range suggs {
+			i, ok := pos[sugg.Suggestion]
+			if !ok {
+				pos[sugg.Suggestion] = len(dedup)
+				dedup = append(dedup, sugg)
+				continue
+			}
+			if sugg.Weight > dedup[i].Weight {
+				dedup[i] = sugg
+			}
+		}
+		s.Suggestions[token] = dedup
+	}
+}
+
+// NormalizeWeights scales the weights of the suggestions of each
+// token, so that they sum up to 1.  The weights of tokens whose
+// suggestions' weights sum up to 0 are left unchanged.
+func (s Suggestions) NormalizeWeights() {
+	for _, suggs := range s.Suggestions {
+		var sum float64
+		for _, sugg := range suggs {
+			sum += sugg.Weight
+		}
+		if sum == 0 {
+			continue
+		}
+		for i := range suggs {
+			suggs[i].Weight /= sum
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSuggestionsDedup(t *testing.T) {
+	s := Suggestions{Suggestions: map[string][]Suggestion{
+		"vnd": {
+			{Suggestion: "und", Weight: 0.5},
+			{Suggestion: "vnd", Weight: 0.2},
+			{Suggestion: "und", Weight: 0.7, Distance: 1},
+			{Suggestion: "vnd", Weight: 0.1},
+		},
+		"theil": {{Suggestion: "teil", Weight: 0.3}},
+		"none":  nil,
+	}}
+	s.Dedup()
+	want := map[string][]Suggestion{
+		"vnd": {
+			{Suggestion: "und", Weight: 0.7, Distance: 1},
+			{Suggestion: "vnd", Weight: 0.2},
+		},
+		"theil": {{Suggestion: "teil", Weight: 0.3}},
+		"none":  nil,
+	}
+	if !reflect.DeepEqual(s.Suggestions, want) {
+		t.Fatalf("expected %v; got %v", want, s.Suggestions)
+	}
+}
+
+func TestSuggestionsNormalizeWeights(t *testing.T) {
+	s := Suggestions{Suggestions: map[string][]Suggestion{
+		"vnd": {
+			{Suggestion: "und", Weight: 0.5},
+			{Suggestion: "vnd", Weight: 0.2},
+			{Suggestion: "und", Weight: 0.7},
+		},
+		"theil": {{Suggestion: "teil", Weight: 0.3}},
+		"zero":  {{Suggestion: "null", Weight: 0}},
+	}}
+	s.Dedup()
+	s.NormalizeWeights()
+	for _, token := range []string{"vnd", "theil"} {
+		var sum float64
+		for _, sugg := range s.Suggestions[token] {
+			sum += sugg.Weight
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Fatalf("expected weights of %s to sum up to 1; got %f", token, sum)
+		}
+	}
+	if got := s.Suggestions["vnd"][0].Weight; math.Abs(got-0.7/0.9) > 1e-9 {
+		t.Fatalf("expected weight %f; got %f", 0.7/0.9, got)
+	}
+	if got := s.Suggestions["zero"][0].Weight; got != 0 {
+		t.Fatalf("expected weight 0; got %f", got)
+	}
+}
@@ -1,7 +1,14 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/finkf/pcwgo/api"
 )
 
 // BooksTableName defines the name of the books table.
@@ -21,6 +28,8 @@ const booksTable = BooksTableName + "(" +
 	"extendedlexicon BOOLEAN DEFAULT(false) NOT NULL," +
 	"postcorrected BOOLEAN DEFAULT(false) NOT NULL," +
 	"pooled BOOLEAN DEFAULT(false) NOT NULL," +
+	"ocr_model VARCHAR(255) NOT NULL DEFAULT ''," +
+	"fingerprint VARCHAR(64) NOT NULL DEFAULT ''," +
 	"PRIMARY KEY (BookID)" +
 	");"
 
@@ -30,38 +39,211 @@ type Book struct {
 	Status                                   map[string]bool
 	Author, Title, Description, HistPatterns string
 	URI, ProfilerURL, Directory, Lang        string
+	OCRModel                                 string
 	Pooled                                   bool
 }
 
+// HistPatternSet parses and returns the book's historical patterns.
+// See api.ParseHistPatterns for the format of the patterns.
+func (b Book) HistPatternSet() (api.HistPatternSet, error) {
+	return api.ParseHistPatterns(b.HistPatterns)
+}
+
+// APIBook converts the book to an api.Book.  The book is its own
+// project, so IsBook is set and the project id is the book id.  Use
+// Project.APIBook to convert projects.
+func (b Book) APIBook() api.Book {
+	return api.Book{
+		Author:       b.Author,
+		Title:        b.Title,
+		Language:     b.Lang,
+		Status:       b.Status,
+		ProfilerURL:  b.ProfilerURL,
+		Description:  b.Description,
+		HistPatterns: b.HistPatterns,
+		Year:         b.Year,
+		BookID:       b.BookID,
+		ProjectID:    b.BookID,
+		IsBook:       true,
+		OCRModel:     b.OCRModel,
+		Pooled:       b.Pooled,
+	}
+}
+
+// Fingerprint returns a content based id of the book.  It is the
+// hex-encoded sha256 hash of the book's normalized author, title,
+// year and language.  Author, title and language are normalized by
+// converting them to lowercase and by collapsing whitespace.  Books
+// with the same (normalized) metadata have the same fingerprint.
+func (b Book) Fingerprint() string {
+	normalize := func(str string) string {
+		return strings.Join(strings.Fields(strings.ToLower(str)), " ")
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x1f%s\x1f%d\x1f%s",
+		normalize(b.Author), normalize(b.Title), b.Year, normalize(b.Lang))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ResolvePath joins the book's directory with the given relative
+// path (e.g. the image file of a page or line).  Absolute paths and
+// paths that would escape the book's directory are rejected.
+func (b Book) ResolvePath(rel string) (string, error) {
+	if b.Directory == "" {
+		return "", fmt.Errorf("cannot resolve path %s: missing book directory", rel)
+	}
+	if filepath.IsAbs(rel) {
+		return "", fmt.Errorf("cannot resolve path %s: absolute path", rel)
+	}
+	path := filepath.Join(b.Directory, rel)
+	r, err := filepath.Rel(b.Directory, path)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve path %s: %v", rel, err)
+	}
+	if r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("cannot resolve path %s: outside of book directory", rel)
+	}
+	return path, nil
+}
+
 // CreateTableBooks the database table books if it does not already
 // exist.  This function will fail, if the projects table does not
-// exist.
+// exist.  Existing books tables are migrated to contain the ocr_model
+// and the (indexed) fingerprint columns.  Missing fingerprints are
+// computed.
 func CreateTableBooks(db DB) error {
-	_, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+booksTable)
-	return err
+	if _, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+booksTable); err != nil {
+		return err
+	}
+	if err := addColumn(db, BooksTableName, "ocr_model", "VARCHAR(255) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(db, BooksTableName, "fingerprint", "VARCHAR(64) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addIndex(db, BooksTableName, "books_fingerprint", "fingerprint"); err != nil {
+		return err
+	}
+	return updateFingerprints(db)
+}
+
+// updateFingerprints computes the fingerprints of all books without a
+// fingerprint.
+func updateFingerprints(db DB) error {
+	const stmt1 = "SELECT BookID,COALESCE(Author,''),COALESCE(Title,''),COALESCE(Year,0),Lang FROM " +
+		BooksTableName + " WHERE fingerprint=''"
+	const stmt2 = "UPDATE " + BooksTableName + " SET fingerprint=? WHERE BookID=?"
+	rows, err := Query(db, stmt1)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var books []Book
+	for rows.Next() {
+		var b Book
+		if err := rows.Scan(&b.BookID, &b.Author, &b.Title, &b.Year, &b.Lang); err != nil {
+			return err
+		}
+		books = append(books, b)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	for _, b := range books {
+		if _, err := Exec(db, stmt2, b.Fingerprint(), b.BookID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // InsertBook inserts an entry into the books table.
 func InsertBook(db DB, book *Book) error {
 	const stmt = "INSERT INTO " + BooksTableName +
 		"(BookID,Author,Title,Year,Description,URI,ProfilerURL,Directory,Lang," +
-		"profiled,extendedlexicon,postcorrected,pooled)" +
-		"VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?)"
+		"profiled,extendedlexicon,postcorrected,pooled,ocr_model,fingerprint)" +
+		"VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
 	_, err := Exec(db, stmt, book.BookID, book.Author, book.Title,
 		book.Year, book.Description,
 		book.URI, book.ProfilerURL, book.Directory, book.Lang,
 		book.Status["profiled"], book.Status["extended-lexicon"],
-		book.Status["post-corrected"], book.Pooled)
+		book.Status["post-corrected"], book.Pooled, book.OCRModel, book.Fingerprint())
+	return err
+}
+
+// UpdateBookMetadata updates the author, title and description of
+// the book with the given id.  Only these metadata fields are
+// written; the status flags of the book are never altered.  The
+// fingerprint of the book is recomputed from the new metadata.
+func UpdateBookMetadata(db DB, bookID int, author, title, description string) error {
+	const stmt = "UPDATE " + BooksTableName +
+		" SET Author=?,Title=?,Description=?,fingerprint=? WHERE BookID=?"
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		book, found, err := FindBookByID(db, bookID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("cannot update book %d: no such book", bookID)
+		}
+		book.Author, book.Title = author, title
+		_, err = Exec(db, stmt, author, title, description, book.Fingerprint(), bookID)
+		return err
+	})
+	return t.Done()
+}
+
+// SetBookModel sets the name of the OCR model that was used to
+// recognize the book with the given id.
+func SetBookModel(db DB, bookID int, model string) error {
+	const stmt = "UPDATE " + BooksTableName + " SET ocr_model=? WHERE BookID=?"
+	_, err := Exec(db, stmt, model, bookID)
 	return err
 }
 
+// FindBookModel returns the name of the OCR model of the book with
+// the given id.  The model is empty if it is not known.
+func FindBookModel(db DB, bookID int) (string, bool, error) {
+	const stmt = "SELECT ocr_model FROM " + BooksTableName + " WHERE BookID=?"
+	rows, err := Query(db, stmt, bookID)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", false, rows.Err()
+	}
+	var model string
+	if err := rows.Scan(&model); err != nil {
+		return "", false, err
+	}
+	return model, true, nil
+}
+
+const selectBookStmt = "SELECT BookID,Year,Author,Title,Description,URI," +
+	"COALESCE(ProfilerURL, '') as ProfilerURL,Directory,Lang,ocr_model," +
+	"profiled,extendedlexicon,postcorrected,pooled FROM " +
+	BooksTableName + " "
+
 // FindBookByID loads the book from the database that is identified by
 // the given ID.
 func FindBookByID(db DB, id int) (*Book, bool, error) {
-	const stmt = "SELECT BookID,Year,Author,Title,Description,URI," +
-		"COALESCE(ProfilerURL, '') as ProfilerURL,Directory,Lang FROM " +
-		BooksTableName + " WHERE BookID=?"
-	rows, err := Query(db, stmt, id)
+	const stmt = selectBookStmt + "WHERE BookID=?"
+	return selectBook(db, stmt, id)
+}
+
+// FindBookByFingerprint loads the book with the given fingerprint
+// (see Book.Fingerprint) from the database.  If multiple books share
+// the fingerprint, the book with the lowest id is returned.
+func FindBookByFingerprint(db DB, fp string) (*Book, bool, error) {
+	const stmt = selectBookStmt + "WHERE fingerprint=? ORDER BY BookID LIMIT 1"
+	return selectBook(db, stmt, fp)
+}
+
+func selectBook(db DB, stmt string, args ...interface{}) (*Book, bool, error) {
+	rows, err := Query(db, stmt, args...)
 	if err != nil {
 		return nil, false, err
 	}
@@ -80,25 +262,77 @@ func FindBookByID(db DB, id int) (*Book, bool, error) {
 // identified by the given project ID.
 func FindBookByProjectID(db DB, id int) (*Book, bool, error) {
 	const stmt = "SELECT b.BookID,b.Year,b.Author,b.Title,b.Description,b.URI," +
-		"COALESCE(b.ProfilerURL, '') as ProfilerURL,b.Directory,b.Lang FROM " +
+		"COALESCE(b.ProfilerURL, '') as ProfilerURL,b.Directory,b.Lang,b.ocr_model," +
+		"b.profiled,b.extendedlexicon,b.postcorrected,b.pooled FROM " +
 		BooksTableName + " b JOIN " + ProjectsTableName + " p ON p.Origin=b.BookID WHERE p.ID=?"
-	rows, err := Query(db, stmt, id)
+	return selectBook(db, stmt, id)
+}
+
+// BookExists returns true if the book with the given id exists.  It
+// is cheaper than FindBookByID, since the book is not loaded.
+func BookExists(db DB, id int) (bool, error) {
+	const stmt = "SELECT 1 FROM " + BooksTableName + " WHERE BookID=? LIMIT 1"
+	return exists(db, stmt, id)
+}
+
+// DistinctLanguages returns the ordered list of the distinct
+// languages of all books.
+func DistinctLanguages(db DB) ([]string, error) {
+	const stmt = "SELECT DISTINCT Lang FROM " + BooksTableName + " ORDER BY Lang"
+	rows, err := Query(db, stmt)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	defer rows.Close()
-	if !rows.Next() {
-		return nil, false, nil
+	var langs []string
+	for rows.Next() {
+		var lang string
+		if err := rows.Scan(&lang); err != nil {
+			return nil, err
+		}
+		langs = append(langs, lang)
 	}
-	var book Book
-	if err := scanBook(rows, &book); err != nil {
-		return nil, false, err
+	return langs, rows.Err()
+}
+
+// YearHistogram returns the number of books per bucket of years.  The
+// buckets are mapped by their first year; a bucket of 10 counts the
+// books per decade (e.g. 1850 for the years 1850 to 1859).  Books
+// without a year (a year of 0) are not counted.
+func YearHistogram(db DB, bucket int) (map[int]int, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("cannot compute year histogram: invalid bucket size: %d", bucket)
 	}
-	return &book, true, nil
+	const stmt = "SELECT Year-Year%? AS bucket,COUNT(*) FROM " + BooksTableName +
+		" WHERE Year>0 GROUP BY bucket"
+	rows, err := Query(db, stmt, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hist := make(map[int]int)
+	for rows.Next() {
+		var year, n int
+		if err := rows.Scan(&year, &n); err != nil {
+			return nil, err
+		}
+		hist[year] = n
+	}
+	return hist, rows.Err()
 }
 
 func scanBook(rows *sql.Rows, book *Book) error {
-	return rows.Scan(&book.BookID, &book.Year, &book.Author, &book.Title,
+	var pr, e, c bool
+	err := rows.Scan(&book.BookID, &book.Year, &book.Author, &book.Title,
 		&book.Description, &book.URI, &book.ProfilerURL, &book.Directory,
-		&book.Lang)
+		&book.Lang, &book.OCRModel, &pr, &e, &c, &book.Pooled)
+	if err != nil {
+		return err
+	}
+	book.Status = map[string]bool{
+		"profiled":         pr,
+		"extended-lexicon": e,
+		"post-corrected":   c,
+	}
+	return nil
 }
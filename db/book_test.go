@@ -1,8 +1,15 @@
 package db
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"reflect"
 	"testing"
+
+	"github.com/finkf/pcwgo/api"
+	"github.com/finkf/pcwgo/db/sqlite"
 )
 
 func newTestBook(t *testing.T, db DB, id int) *Book {
@@ -31,3 +38,311 @@ func newTestBook(t *testing.T, db DB, id int) *Book {
 	}
 	return book
 }
+
+func TestBookModel(t *testing.T) {
+	sqlite.With("books.sqlite", func(db *sql.DB) {
+		book := newTestBook(t, db, 1)
+		if _, found, err := FindBookModel(db, 2); err != nil || found {
+			t.Fatalf("expected not found; got found=%t, err=%v", found, err)
+		}
+		model, found, err := FindBookModel(db, book.BookID)
+		if err != nil || !found {
+			t.Fatalf("expected found; got found=%t, err=%v", found, err)
+		}
+		if model != "" {
+			t.Fatalf("expected empty model; got %q", model)
+		}
+		const want = "fraktur-ſchön.mlmodel"
+		if err := SetBookModel(db, book.BookID, want); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if model, _, _ = FindBookModel(db, book.BookID); model != want {
+			t.Fatalf("expected %q; got %q", want, model)
+		}
+		got, _, err := FindBookByID(db, book.BookID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got.OCRModel != want {
+			t.Fatalf("expected %q; got %q", want, got.OCRModel)
+		}
+		// migration of existing tables is idempotent
+		if err := CreateTableBooks(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	})
+}
+
+func TestBookFingerprint(t *testing.T) {
+	sqlite.With("books.sqlite", func(db *sql.DB) {
+		if err := CreateTableBooks(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		a := Book{BookID: 1, Author: "Grenz, Emil", Title: "Ueber das  Leben", Year: 1850,
+			Lang: "german", Directory: "a"}
+		b := Book{BookID: 2, Author: " grenz,  emil ", Title: "ueber das Leben", Year: 1850,
+			Lang: "German", Directory: "b"}
+		c := Book{BookID: 3, Author: "Grenz, Emil", Title: "Ueber das Leben", Year: 1851,
+			Lang: "german", Directory: "c"}
+		if a.Fingerprint() != b.Fingerprint() {
+			t.Fatalf("expected same fingerprints; got %s and %s", a.Fingerprint(), b.Fingerprint())
+		}
+		if a.Fingerprint() == c.Fingerprint() {
+			t.Fatalf("expected different fingerprints; got %s", a.Fingerprint())
+		}
+		for _, book := range []*Book{&a, &b, &c} {
+			if err := InsertBook(db, book); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		got, found, err := FindBookByFingerprint(db, b.Fingerprint())
+		if err != nil || !found {
+			t.Fatalf("expected found; got found=%t, err=%v", found, err)
+		}
+		if got.BookID != a.BookID {
+			t.Fatalf("expected book %d; got %d", a.BookID, got.BookID)
+		}
+		if _, found, err = FindBookByFingerprint(db, "unknown"); err != nil || found {
+			t.Fatalf("expected not found; got found=%t, err=%v", found, err)
+		}
+		// missing fingerprints of existing books are computed
+		if _, err := db.Exec("UPDATE books SET fingerprint='' WHERE BookID=3"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := CreateTableBooks(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got, _, _ = FindBookByFingerprint(db, c.Fingerprint()); got == nil || got.BookID != c.BookID {
+			t.Fatalf("expected book %d; got %v", c.BookID, got)
+		}
+	})
+}
+
+func TestBookFacets(t *testing.T) {
+	sqlite.With("books.sqlite", func(db *sql.DB) {
+		if err := CreateTableBooks(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		for i, b := range []Book{
+			{Year: 1849, Lang: "latin"},
+			{Year: 1850, Lang: "german"},
+			{Year: 1859, Lang: "german"},
+			{Year: 1860, Lang: "latin"},
+			{Year: 1901, Lang: "greek"},
+			{Lang: "latin"}, // undated
+		} {
+			b.BookID = i + 1
+			b.Directory = fmt.Sprint(i)
+			if err := InsertBook(db, &b); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		langs, err := DistinctLanguages(db)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if want := []string{"german", "greek", "latin"}; !reflect.DeepEqual(langs, want) {
+			t.Fatalf("expected %v; got %v", want, langs)
+		}
+		tests := []struct {
+			bucket int
+			want   map[int]int
+		}{
+			{10, map[int]int{1840: 1, 1850: 2, 1860: 1, 1900: 1}},
+			{100, map[int]int{1800: 4, 1900: 1}},
+			{1, map[int]int{1849: 1, 1850: 1, 1859: 1, 1860: 1, 1901: 1}},
+		}
+		for _, tc := range tests {
+			t.Run(fmt.Sprint(tc.bucket), func(t *testing.T) {
+				got, err := YearHistogram(db, tc.bucket)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("expected %v; got %v", tc.want, got)
+				}
+			})
+		}
+		if _, err := YearHistogram(db, 0); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestUpdateBookMetadata(t *testing.T) {
+	sqlite.With("books.sqlite", func(db *sql.DB) {
+		book := newTestBook(t, db, 1)
+		const set = "UPDATE " + BooksTableName +
+			" SET profiled=?,extendedlexicon=?,postcorrected=?,pooled=? WHERE BookID=?"
+		if _, err := db.Exec(set, true, false, true, true, book.BookID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := UpdateBookMetadata(db, book.BookID, "author", "title", "description"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, _, err := FindBookByID(db, book.BookID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got.Author != "author" || got.Title != "title" || got.Description != "description" {
+			t.Fatalf("invalid metadata: %s, %s, %s", got.Author, got.Title, got.Description)
+		}
+		if got.Lang != book.Lang || got.Year != book.Year || got.Directory != book.Directory {
+			t.Fatalf("expected %v; got %v", book, got)
+		}
+		const get = "SELECT profiled,extendedlexicon,postcorrected,pooled FROM " +
+			BooksTableName + " WHERE BookID=?"
+		var p, e, c, pooled bool
+		if err := db.QueryRow(get, book.BookID).Scan(&p, &e, &c, &pooled); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !p || e || !c || !pooled {
+			t.Fatalf("status flags altered: %t, %t, %t, %t", p, e, c, pooled)
+		}
+		// the fingerprint follows the new metadata
+		updated, found, err := FindBookByFingerprint(db, got.Fingerprint())
+		if err != nil || !found || updated.BookID != book.BookID {
+			t.Fatalf("cannot find book by its new fingerprint: %v", err)
+		}
+		if _, found, _ := FindBookByFingerprint(db, book.Fingerprint()); found {
+			t.Fatalf("found book by its old fingerprint")
+		}
+	})
+}
+
+func TestBookResolvePath(t *testing.T) {
+	book := Book{Directory: "/srv/books/1"}
+	tests := []struct {
+		rel, want string
+		wantErr   bool
+	}{
+		{"img/page1.png", "/srv/books/1/img/page1.png", false},
+		{"./img/../page1.png", "/srv/books/1/page1.png", false},
+		{"..foo/page1.png", "/srv/books/1/..foo/page1.png", false},
+		{"", "/srv/books/1", false},
+		{"../2/page1.png", "", true},
+		{"img/../../2/page1.png", "", true},
+		{"..", "", true},
+		{"/etc/passwd", "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.rel, func(t *testing.T) {
+			got, err := book.ResolvePath(tc.rel)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error; got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got != filepath.FromSlash(tc.want) {
+				t.Fatalf("expected %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAPIBook(t *testing.T) {
+	book := Book{
+		BookID:       3,
+		Year:         1800,
+		Status:       map[string]bool{"profiled": true},
+		Author:       "author",
+		Title:        "title",
+		Description:  "description",
+		HistPatterns: "t:th",
+		ProfilerURL:  "local",
+		Directory:    "/srv/books/3",
+		Lang:         "german",
+		OCRModel:     "fraktur",
+		Pooled:       true,
+	}
+	tests := []struct {
+		name string
+		got  api.Book
+		want api.Book
+	}{
+		{"book", book.APIBook(), api.Book{
+			Author: "author", Title: "title", Language: "german",
+			Status: map[string]bool{"profiled": true}, ProfilerURL: "local",
+			Description: "description", HistPatterns: "t:th", OCRModel: "fraktur", Year: 1800,
+			BookID: 3, ProjectID: 3, IsBook: true, Pooled: true,
+		}},
+		{"book-project", Project{Book: book, ProjectID: 3, Pages: 10}.APIBook(), api.Book{
+			Author: "author", Title: "title", Language: "german",
+			Status: map[string]bool{"profiled": true}, ProfilerURL: "local",
+			Description: "description", HistPatterns: "t:th", OCRModel: "fraktur", Year: 1800,
+			BookID: 3, ProjectID: 3, Pages: 10, IsBook: true, Pooled: true,
+		}},
+		{"split-project", Project{Book: book, ProjectID: 7, Pages: 2}.APIBook(), api.Book{
+			Author: "author", Title: "title", Language: "german",
+			Status: map[string]bool{"profiled": true}, ProfilerURL: "local",
+			Description: "description", HistPatterns: "t:th", OCRModel: "fraktur", Year: 1800,
+			BookID: 3, ProjectID: 7, Pages: 2, IsBook: false, Pooled: true,
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tc.got, tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, tc.got)
+			}
+			// json round trip
+			buf, err := json.Marshal(tc.got)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			var got api.Book
+			if err := json.Unmarshal(buf, &got); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected %v; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestAPIBookRoundTrip(t *testing.T) {
+	sqlite.With("books.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		user := newTestUser(t, db, 1)
+		book := Book{
+			BookID:    1,
+			Directory: "dir",
+			Lang:      "german",
+			Status:    map[string]bool{"profiled": true, "post-corrected": true},
+			Pooled:    true,
+		}
+		if err := InsertBook(db, &book); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		project := Project{Book: book, Owner: *user, Pages: 1}
+		if err := InsertProject(db, &project); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want := map[string]bool{"profiled": true, "extended-lexicon": false, "post-corrected": true}
+		check := func(name string, b api.Book) {
+			t.Helper()
+			if !b.Pooled {
+				t.Fatalf("%s: expected a pooled book", name)
+			}
+			if !reflect.DeepEqual(b.Status, want) {
+				t.Fatalf("%s: expected status %v; got %v", name, want, b.Status)
+			}
+		}
+		b, found, err := FindBookByID(db, book.BookID)
+		if err != nil || !found {
+			t.Fatalf("cannot find book: %v", err)
+		}
+		check("book", b.APIBook())
+		p, found, err := FindProjectByID(db, project.ProjectID)
+		if err != nil || !found {
+			t.Fatalf("cannot find project: %v", err)
+		}
+		check("project", p.APIBook())
+	})
+}
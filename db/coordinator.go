@@ -0,0 +1,80 @@
+package db
+
+import (
+	"github.com/finkf/pcwgo/api"
+)
+
+// CoordinatorsTableName defines the name of the coordinators table.
+const CoordinatorsTableName = "coordinators"
+
+const coordinatorsTable = CoordinatorsTableName + "(" +
+	"UserID INTEGER NOT NULL REFERENCES " + UsersTableName + "(ID)," +
+	"Institute VARCHAR(255) NOT NULL," +
+	"PRIMARY KEY (UserID,Institute)" +
+	")"
+
+// CreateTableCoordinators creates the coordinators table if it does
+// not already exist.  The table maps users to the institutes they
+// coordinate.
+func CreateTableCoordinators(db DB) error {
+	_, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+coordinatorsTable)
+	return err
+}
+
+// InsertCoordinator makes the user with the given id a coordinator of
+// the given institute.  Inserting an existing coordinator results in
+// an error of kind ErrorKindConflict.
+func InsertCoordinator(db DB, userID int64, institute string) error {
+	const stmt = "INSERT INTO " + CoordinatorsTableName + "(UserID,Institute) VALUES(?,?)"
+	if _, err := Exec(db, stmt, userID, institute); err != nil {
+		return newDBError("insert", CoordinatorsTableName, err)
+	}
+	return nil
+}
+
+// DeleteCoordinator removes the user with the given id from the
+// coordinators of the given institute.
+func DeleteCoordinator(db DB, userID int64, institute string) error {
+	const stmt = "DELETE FROM " + CoordinatorsTableName + " WHERE UserID=? AND Institute=?"
+	_, err := Exec(db, stmt, userID, institute)
+	return err
+}
+
+// IsCoordinator returns true if the user with the given id
+// coordinates the given institute.
+func IsCoordinator(db DB, userID int64, institute string) (bool, error) {
+	const stmt = "SELECT 1 FROM " + CoordinatorsTableName +
+		" WHERE UserID=? AND Institute=? LIMIT 1"
+	return exists(db, stmt, userID, institute)
+}
+
+// FindUserRole returns the role (see api.RoleUser, api.RoleCoordinator
+// and api.RoleAdmin) of the given user.  Admins always have the admin
+// role.  If p is nil, users have the coordinator role if they
+// coordinate their own institute and the user role otherwise.  If p
+// is not nil, the role is determined with respect to the project:
+// users have the coordinator role if they coordinate the institute of
+// the project's owner, the user role if they own the project and no
+// role (the empty string) otherwise.
+func FindUserRole(db DB, user api.User, p *Project) (string, error) {
+	if user.Admin {
+		return api.RoleAdmin, nil
+	}
+	institute := user.Institute
+	if p != nil {
+		institute = p.Owner.Institute
+	}
+	if institute != "" {
+		ok, err := IsCoordinator(db, user.ID, institute)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return api.RoleCoordinator, nil
+		}
+	}
+	if p != nil && p.Owner.ID != user.ID {
+		return "", nil
+	}
+	return api.RoleUser, nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/finkf/pcwgo/api"
+	"github.com/finkf/pcwgo/db/sqlite"
+)
+
+func TestFindUserRole(t *testing.T) {
+	sqlite.With("coordinators.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		users := map[string]*api.User{
+			"owner":   {Name: "owner", Email: "owner", Institute: "a"},
+			"coordA":  {Name: "coordA", Email: "coordA", Institute: "a"},
+			"coordB":  {Name: "coordB", Email: "coordB", Institute: "b"},
+			"memberA": {Name: "memberA", Email: "memberA", Institute: "a"},
+			"admin":   {Name: "admin", Email: "admin", Institute: "b", Admin: true},
+		}
+		for _, u := range users {
+			if err := InsertUser(db, u); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		if err := InsertCoordinator(db, users["coordA"].ID, "a"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := InsertCoordinator(db, users["coordB"].ID, "b"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := InsertCoordinator(db, users["coordB"].ID, "b"); err == nil {
+			t.Fatalf("expected an error")
+		}
+		p := newTestProject(t, db, 1, newTestBook(t, db, 1), users["owner"])
+		tests := []struct {
+			user          string
+			want, project string
+		}{
+			{"owner", api.RoleUser, api.RoleUser},
+			{"coordA", api.RoleCoordinator, api.RoleCoordinator},
+			{"coordB", api.RoleCoordinator, ""},
+			{"memberA", api.RoleUser, ""},
+			{"admin", api.RoleAdmin, api.RoleAdmin},
+		}
+		for _, tc := range tests {
+			t.Run(tc.user, func(t *testing.T) {
+				got, err := FindUserRole(db, *users[tc.user], nil)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if got != tc.want {
+					t.Fatalf("expected role %q; got %q", tc.want, got)
+				}
+				got, err = FindUserRole(db, *users[tc.user], p)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if got != tc.project {
+					t.Fatalf("expected project role %q; got %q", tc.project, got)
+				}
+			})
+		}
+		if err := DeleteCoordinator(db, users["coordA"].ID, "a"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if ok, err := IsCoordinator(db, users["coordA"].ID, "a"); err != nil || ok {
+			t.Fatalf("expected no coordinator; got %t (%v)", ok, err)
+		}
+	})
+}
@@ -4,10 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/UNO-SOFT/ulog"
 )
 
+// SlowQueryThreshold defines the duration after which statements are
+// logged as slow statements (with level warn).  All other statements
+// are logged with level debug.  A threshold of 0 disables the logging
+// of slow statements.
+var SlowQueryThreshold = time.Second
+
 // DB defines a simple interface for database handling.
 type DB interface {
 	Exec(string, ...interface{}) (sql.Result, error)
@@ -18,37 +25,211 @@ type DB interface {
 	Prepare(string) (*sql.Stmt, error)
 }
 
+// CtxDB wraps a DB handle with a context.  Its Exec, Query, Begin and
+// Prepare methods use the context-aware variants of the wrapped handle
+// with the wrapped context.  Use WithContext to create it.
+type CtxDB struct {
+	ctx context.Context
+	db  DB
+}
+
+// WithContext wraps the given DB handle with the given context.  All
+// functions of this package that are called with the returned handle
+// are canceled if the context is canceled.  A typical handler calls
+// db.WithContext(r.Context(), pool) once and passes the returned
+// handle to all functions.
+func WithContext(ctx context.Context, db DB) DB {
+	return CtxDB{ctx: ctx, db: db}
+}
+
+// Exec calls ExecContext with the wrapped context.
+func (c CtxDB) Exec(stmt string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, stmt, args...)
+}
+
+// ExecContext calls ExecContext with the given context.
+func (c CtxDB) ExecContext(ctx context.Context, stmt string, args ...interface{}) (sql.Result, error) {
+	return c.db.ExecContext(ctx, stmt, args...)
+}
+
+// Query calls QueryContext with the wrapped context.
+func (c CtxDB) Query(stmt string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, stmt, args...)
+}
+
+// QueryContext calls QueryContext with the given context.
+func (c CtxDB) QueryContext(ctx context.Context, stmt string, args ...interface{}) (*sql.Rows, error) {
+	return c.db.QueryContext(ctx, stmt, args...)
+}
+
+// Begin begins a transaction with the wrapped context if the wrapped
+// handle supports it.  The transaction is rolled back if the context
+// is canceled.
+func (c CtxDB) Begin() (*sql.Tx, error) {
+	if btx, ok := c.db.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	}); ok {
+		return btx.BeginTx(c.ctx, nil)
+	}
+	return c.db.Begin()
+}
+
+// BeginTx begins a transaction with the given options (e.g. an
+// isolation level, see BeginLevel).  The transaction uses the wrapped
+// context; the given context is ignored.  It is an error if the
+// wrapped handle does not support BeginTx.
+func (c CtxDB) BeginTx(_ context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	btx, ok := c.db.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("cannot begin transaction: transaction options not supported")
+	}
+	return btx.BeginTx(c.ctx, opts)
+}
+
+// Prepare prepares the given statement with the wrapped context if
+// the wrapped handle supports it.
+func (c CtxDB) Prepare(stmt string) (*sql.Stmt, error) {
+	if p, ok := c.db.(interface {
+		PrepareContext(context.Context, string) (*sql.Stmt, error)
+	}); ok {
+		return p.PrepareContext(c.ctx, stmt)
+	}
+	return c.db.Prepare(stmt)
+}
+
 // Exec calls Exec on the given DB handle. The given args are logged.
 func Exec(db DB, stmt string, args ...interface{}) (sql.Result, error) {
-	ulog.Write("exec", "stmt", stmt, "args", args)
+	defer logStmt("exec", stmt, args, time.Now())
 	return db.Exec(stmt, args...)
 }
 
 // ExecContext calls Exec on the given DB handle. The given args are logged.
 func ExecContext(ctx context.Context, db DB, stmt string, args ...interface{}) (sql.Result, error) {
-	ulog.Write("exec", "stmt", stmt, "args", args)
+	defer logStmt("exec", stmt, args, time.Now())
 	return db.ExecContext(ctx, stmt, args...)
 }
 
 // Query calls Query on the given DB handle. The given args are logged.
 func Query(db DB, stmt string, args ...interface{}) (*sql.Rows, error) {
-	ulog.Write("query", "stmt", stmt, "args", args)
+	defer logStmt("query", stmt, args, time.Now())
 	return db.Query(stmt, args...)
 }
 
 // QueryContext calls Query on the given DB handle. The given args are logged.
 func QueryContext(ctx context.Context, db DB, stmt string, args ...interface{}) (*sql.Rows, error) {
-	ulog.Write("query", "stmt", stmt, "args", args)
+	defer logStmt("query", stmt, args, time.Now())
 	return db.QueryContext(ctx, stmt, args...)
 }
 
+// logStmt logs the given statement and its arguments.  Statements
+// that took longer than SlowQueryThreshold are logged with level
+// warn.
+func logStmt(msg, stmt string, args []interface{}, start time.Time) {
+	d := time.Since(start)
+	level := stmtLevel(d)
+	if level == "warn" {
+		msg = "slow " + msg
+	}
+	ulog.Write(msg, "level", level, "stmt", stmt, "args", args,
+		"duration", d.String())
+}
+
+// stmtLevel returns the log level of a statement that took the given
+// duration (see SlowQueryThreshold).
+func stmtLevel(d time.Duration) string {
+	if SlowQueryThreshold > 0 && d >= SlowQueryThreshold {
+		return "warn"
+	}
+	return "debug"
+}
+
 // Begin calls Begin on the given DB handle and logs the beginning of
 // a transaction.
 func Begin(db DB) (*sql.Tx, error) {
-	ulog.Write("begin transaction")
+	ulog.Write("begin transaction", "level", "debug")
 	return db.Begin()
 }
 
+// exists returns true if the given query statement returns at least
+// one row.
+func exists(db DB, stmt string, args ...interface{}) (bool, error) {
+	rows, err := Query(db, stmt, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return true, nil
+	}
+	return false, rows.Err()
+}
+
+// addColumn adds a new column with the given definition to the given
+// table if the column does not already exist.  It is used to migrate
+// existing tables.
+func addColumn(db DB, table, column, def string) error {
+	if hasColumn(db, table, column) {
+		return nil
+	}
+	_, err := Exec(db, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+def)
+	return err
+}
+
+// hasColumn returns true if the given table has the given column.
+func hasColumn(db DB, table, column string) bool {
+	rows, err := Query(db, "SELECT "+column+" FROM "+table+" LIMIT 1")
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// isSQLite returns true if the given DB handle is connected to a
+// sqlite database.  It is used to select dialect specific statements.
+func isSQLite(db DB) bool {
+	rows, err := Query(db, "SELECT sqlite_version()")
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// addIndex creates the index with the given name on the given columns
+// of the given table if the index does not already exist.  It is used
+// to migrate existing tables.
+func addIndex(db DB, table, index, columns string) error {
+	_, err := Exec(db, "CREATE INDEX "+index+" ON "+table+"("+columns+")")
+	if err != nil && !isDuplicateIndex(err) {
+		return err
+	}
+	return nil
+}
+
+// BeginLevel begins a new transaction with the given isolation level
+// on the given DB handle.  The DB handle must support BeginTx (as
+// *sql.DB does).
+func BeginLevel(db DB, level sql.IsolationLevel) (*sql.Tx, error) {
+	return BeginLevelContext(context.Background(), db, level)
+}
+
+// BeginLevelContext begins a new transaction with the given isolation
+// level and context on the given DB handle (see BeginLevel).  The
+// transaction is rolled back if the context is canceled.
+func BeginLevelContext(ctx context.Context, db DB, level sql.IsolationLevel) (*sql.Tx, error) {
+	ulog.Write("begin transaction", "level", "debug", "isolation", level.String())
+	btx, ok := db.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("cannot begin transaction: isolation levels not supported")
+	}
+	return btx.BeginTx(ctx, &sql.TxOptions{Isolation: level})
+}
+
 // Transaction wraps a sql.Tx to abbort database transactions.
 type Transaction struct {
 	tx  *sql.Tx
@@ -63,6 +244,18 @@ func NewTransaction(tx *sql.Tx, err error) *Transaction {
 	return &Transaction{tx: tx} // tx != nil, err = nil
 }
 
+// NewTransactionLevel creates a new transaction with the given
+// isolation level.
+func NewTransactionLevel(db DB, level sql.IsolationLevel) *Transaction {
+	return NewTransaction(BeginLevel(db, level))
+}
+
+// NewTransactionLevelContext creates a new transaction with the given
+// isolation level and context.
+func NewTransactionLevelContext(ctx context.Context, db DB, level sql.IsolationLevel) *Transaction {
+	return NewTransaction(BeginLevelContext(ctx, db, level))
+}
+
 // Exec executes the given statement.
 func (t *Transaction) Exec(stmt string, args ...interface{}) (sql.Result, error) {
 	if t.err != nil {
@@ -109,11 +302,22 @@ func (t *Transaction) Begin() (*sql.Tx, error) {
 	return t.tx, t.err
 }
 
-// Do runs a function within the transaction.
+// Do runs a function within the transaction.  If the function
+// panics, the transaction is rolled back and the panic is propagated.
+// The underlying Tx is always finalized, so no connection is leaked.
 func (t *Transaction) Do(f func(DB) error) {
 	if t.err != nil {
 		return
 	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.err = fmt.Errorf("panic in transaction: %v", r)
+			ulog.Write("rollback transaction", "level", "warn", "panic", fmt.Sprint(r))
+			t.tx.Rollback()
+			t.tx = nil // Done must not finalize the Tx again
+			panic(r)
+		}
+	}()
 	t.err = f(t)
 }
 
@@ -122,7 +326,7 @@ func (t *Transaction) Do(f func(DB) error) {
 // rolled back.
 func (t *Transaction) Done() error {
 	if t.err == nil { // no error: commit
-		ulog.Write("commit transaction")
+		ulog.Write("commit transaction", "level", "debug")
 		if err := t.tx.Commit(); err != nil {
 			return fmt.Errorf("cannot commit transaction: %v", err)
 		}
@@ -132,7 +336,7 @@ func (t *Transaction) Done() error {
 		return fmt.Errorf("cannot rollback: %v", t.err)
 	}
 	// error: rollback
-	ulog.Write("rollback transaction")
+	ulog.Write("rollback transaction", "level", "debug")
 	if err := t.tx.Rollback(); err != nil {
 		return fmt.Errorf("cannot rollback after error: %v: %v", t.err, err)
 	}
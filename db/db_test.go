@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/finkf/pcwgo/db/sqlite"
+)
+
+func TestSlowQueryThreshold(t *testing.T) {
+	tests := []struct {
+		threshold, duration time.Duration
+		want                string
+	}{
+		{time.Nanosecond, time.Millisecond, "warn"},
+		{time.Millisecond, time.Millisecond, "warn"},
+		{time.Hour, time.Millisecond, "debug"},
+		{0, time.Hour, "debug"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.threshold.String(), func(t *testing.T) {
+			defer func(d time.Duration) { SlowQueryThreshold = d }(SlowQueryThreshold)
+			SlowQueryThreshold = tc.threshold
+			if got := stmtLevel(tc.duration); got != tc.want {
+				t.Fatalf("expected level %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+// levelRecorder records the isolation level and the context of new
+// transactions.
+type levelRecorder struct {
+	*sql.DB
+	level sql.IsolationLevel
+	ctx   context.Context
+}
+
+func (r *levelRecorder) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	r.level, r.ctx = opts.Isolation, ctx
+	return r.DB.BeginTx(ctx, nil)
+}
+
+func TestNewTransactionLevel(t *testing.T) {
+	sqlite.With("db.sqlite", func(db *sql.DB) {
+		r := &levelRecorder{DB: db}
+		tx := NewTransactionLevel(r, sql.LevelRepeatableRead)
+		tx.Do(func(db DB) error {
+			_, err := Exec(db, "CREATE TABLE test(ID INTEGER)")
+			return err
+		})
+		if err := tx.Done(); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if r.level != sql.LevelRepeatableRead {
+			t.Fatalf("expected level %s; got %s", sql.LevelRepeatableRead, r.level)
+		}
+	})
+}
+
+func TestNewTransactionLevelContext(t *testing.T) {
+	sqlite.With("db.sqlite", func(db *sql.DB) {
+		r := &levelRecorder{DB: db}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		tx := NewTransactionLevelContext(ctx, r, sql.LevelSerializable)
+		tx.Do(func(db DB) error {
+			_, err := Exec(db, "CREATE TABLE test(ID INTEGER)")
+			return err
+		})
+		if err := tx.Done(); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if r.level != sql.LevelSerializable || r.ctx != ctx {
+			t.Fatalf("expected level %s with the given context; got %s", sql.LevelSerializable, r.level)
+		}
+		// canceled contexts cannot begin transactions
+		cancel()
+		if _, err := BeginLevelContext(ctx, r, sql.LevelSerializable); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestTransactionDoPanic(t *testing.T) {
+	sqlite.With("db.sqlite", func(db *sql.DB) {
+		db.SetMaxOpenConns(1)
+		if _, err := db.Exec("CREATE TABLE test(ID INTEGER)"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		tx := NewTransaction(Begin(db))
+		func() {
+			defer func() {
+				if r := recover(); r != "boom" {
+					t.Fatalf("expected panic boom; got %v", r)
+				}
+			}()
+			tx.Do(func(db DB) error {
+				if _, err := Exec(db, "INSERT INTO test(ID) VALUES(1)"); err != nil {
+					return err
+				}
+				panic("boom")
+			})
+		}()
+		if err := tx.Done(); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if n := db.Stats().InUse; n != 0 {
+			t.Fatalf("expected no connections in use; got %d", n)
+		}
+		// the only connection must be free again
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM test").Scan(&n); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if n != 0 {
+			t.Fatalf("expected rollback; got %d rows", n)
+		}
+	})
+}
+
+func TestWithContext(t *testing.T) {
+	sqlite.With("db.sqlite", func(dtb *sql.DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cdb := WithContext(ctx, dtb)
+		// an endless query
+		const stmt = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT x FROM c"
+		rows, err := Query(cdb, stmt)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		defer rows.Close()
+		for i := 0; i < 10 && rows.Next(); i++ {
+		}
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for rows.Next() {
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("query was not aborted")
+		}
+		if err := rows.Err(); err != context.Canceled {
+			t.Fatalf("expected %v; got %v", context.Canceled, err)
+		}
+		// context-free functions fail with the canceled context
+		if err := CreateTableBooks(cdb); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if err := NewTransaction(Begin(cdb)).Done(); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestWithContextBeginTx(t *testing.T) {
+	sqlite.With("db.sqlite", func(db *sql.DB) {
+		type ctxKey struct{}
+		ctx := context.WithValue(context.Background(), ctxKey{}, "wrapped")
+		r := &levelRecorder{DB: db}
+		tx := NewTransactionLevel(WithContext(ctx, r), sql.LevelRepeatableRead)
+		tx.Do(func(db DB) error {
+			_, err := Exec(db, "CREATE TABLE test(ID INTEGER)")
+			return err
+		})
+		if err := tx.Done(); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if r.level != sql.LevelRepeatableRead {
+			t.Fatalf("expected level %s; got %s", sql.LevelRepeatableRead, r.level)
+		}
+		if r.ctx == nil || r.ctx.Value(ctxKey{}) != "wrapped" {
+			t.Fatalf("expected the wrapped context")
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind classifies database errors.
+type ErrorKind int
+
+// Error kinds
+const (
+	ErrorKindOther     ErrorKind = iota // unclassified errors
+	ErrorKindNotFound                   // the requested row does not exist
+	ErrorKindConflict                   // constraint violations (e.g. duplicate keys)
+	ErrorKindTransient                  // connection errors, deadlocks and timeouts
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorKindNotFound:
+		return "not found"
+	case ErrorKindConflict:
+		return "conflict"
+	case ErrorKindTransient:
+		return "transient"
+	default:
+		return "other"
+	}
+}
+
+// ErrConflict is returned (wrapped in a DBError of kind
+// ErrorKindConflict) if a row was modified concurrently (see
+// UpdateLine).
+var ErrConflict = errors.New("concurrent modification")
+
+// DBError wraps errors of database operations with the operation, the
+// table and the classified kind of the error.  Use errors.Is or
+// errors.As to access the underlying driver error.
+type DBError struct {
+	Op, Table string
+	Kind      ErrorKind
+	Err       error
+}
+
+func (e *DBError) Error() string {
+	return fmt.Sprintf("cannot %s %s: %s: %v", e.Op, e.Table, e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// newDBError wraps the given error into a DBError.  If err is nil, nil
+// is returned.
+func newDBError(op, table string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &DBError{Op: op, Table: table, Kind: classifyError(err), Err: err}
+}
+
+// ErrorKindOf returns the kind of the given error.  If the error wraps
+// a DBError, its kind is returned.  Otherwise the error is classified.
+func ErrorKindOf(err error) ErrorKind {
+	var dberr *DBError
+	if errors.As(err, &dberr) {
+		return dberr.Kind
+	}
+	return classifyError(err)
+}
+
+func classifyError(err error) ErrorKind {
+	switch {
+	case err == nil:
+		return ErrorKindOther
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrorKindNotFound
+	case errors.Is(err, ErrConflict):
+		return ErrorKindConflict
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, context.DeadlineExceeded),
+		isInvalidConn(err):
+		return ErrorKindTransient
+	}
+	if number, ok := mysqlErrorNumber(err); ok {
+		switch number {
+		case 1022, // ER_DUP_KEY
+			1062, // ER_DUP_ENTRY
+			1451, // ER_ROW_IS_REFERENCED_2
+			1452: // ER_NO_REFERENCED_ROW_2
+			return ErrorKindConflict
+		case 1040, // ER_CON_COUNT_ERROR
+			1205, // ER_LOCK_WAIT_TIMEOUT
+			1213: // ER_LOCK_DEADLOCK
+			return ErrorKindTransient
+		}
+		return ErrorKindOther
+	}
+	// sqlite errors do not have a (dependency free) error type
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "constraint failed"):
+		return ErrorKindConflict
+	case strings.Contains(msg, "database is locked"):
+		return ErrorKindTransient
+	}
+	return ErrorKindOther
+}
+
+// isDuplicateIndex returns true if the given error was caused by the
+// creation of an index that already exists.
+func isDuplicateIndex(err error) bool {
+	if number, ok := mysqlErrorNumber(err); ok {
+		return number == 1061 // ER_DUP_KEYNAME
+	}
+	return strings.Contains(err.Error(), "already exists")
+}
+
+// mysqlErrorNumber returns the error number of the first MySQL server
+// error in the chain of the given error.  The number is extracted from
+// the error message ("Error <number>: <message>"), so the package does
+// not need to depend on the MySQL driver.
+func mysqlErrorNumber(err error) (int, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		var number int
+		if _, serr := fmt.Sscanf(err.Error(), "Error %d:", &number); serr == nil {
+			return number, true
+		}
+	}
+	return 0, false
+}
+
+// isInvalidConn returns true if the chain of the given error contains
+// the invalid connection error of the MySQL driver.
+func isInvalidConn(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if err.Error() == "invalid connection" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/finkf/pcwgo/api"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestErrorKindOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorKind
+	}{
+		{sql.ErrNoRows, ErrorKindNotFound},
+		{fmt.Errorf("find: %w", sql.ErrNoRows), ErrorKindNotFound},
+		{&mysql.MySQLError{Number: 1062}, ErrorKindConflict},
+		{&mysql.MySQLError{Number: 1452}, ErrorKindConflict},
+		{&mysql.MySQLError{Number: 1213}, ErrorKindTransient},
+		{&mysql.MySQLError{Number: 1146}, ErrorKindOther},
+		{fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062}), ErrorKindConflict},
+		{driver.ErrBadConn, ErrorKindTransient},
+		{mysql.ErrInvalidConn, ErrorKindTransient},
+		{errors.New("UNIQUE constraint failed: users.Email"), ErrorKindConflict},
+		{errors.New("database is locked"), ErrorKindTransient},
+		{errors.New("other"), ErrorKindOther},
+		{&DBError{Kind: ErrorKindConflict, Err: errors.New("other")}, ErrorKindConflict},
+	}
+	for _, tc := range tests {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			if got := ErrorKindOf(tc.err); got != tc.want {
+				t.Fatalf("expected %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestInsertUserConflict(t *testing.T) {
+	withTableUsers(t, func(db *sql.DB) {
+		newTestUser(t, db, 1)
+		err := InsertUser(db, &api.User{Email: "user_email_1"})
+		var dberr *DBError
+		if !errors.As(err, &dberr) {
+			t.Fatalf("expected a DBError; got %v", err)
+		}
+		if dberr.Kind != ErrorKindConflict || dberr.Table != UsersTableName {
+			t.Fatalf("invalid error: %v", dberr)
+		}
+		if errors.Unwrap(err) == nil {
+			t.Fatalf("cannot unwrap error: %v", err)
+		}
+	})
+}
@@ -1,21 +1,37 @@
 package db
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/finkf/pcwgo/api"
 )
 
+// JobStatus defines the status of jobs.
+type JobStatus int
+
+// Job states
+const (
+	JobStatusFailed JobStatus = iota
+	JobStatusRunning
+	JobStatusDone
+	JobStatusEmpty
+	JobStatusProfiled
+	JobStatusPostCorrected
+	JobStatusExtendedLexicon
+	JobStatusProfiledWithEL
+)
+
 // Status IDs
 const (
-	StatusIDFailed = iota
-	StatusIDRunning
-	StatusIDDone
-	StatusIDEmpty
-	StatusIDProfiled
-	StatusIDPostCorrected
-	StatusIDExtendedLexicon
-	StatusIDProfiledWithEL
+	StatusIDFailed          = int(JobStatusFailed)
+	StatusIDRunning         = int(JobStatusRunning)
+	StatusIDDone            = int(JobStatusDone)
+	StatusIDEmpty           = int(JobStatusEmpty)
+	StatusIDProfiled        = int(JobStatusProfiled)
+	StatusIDPostCorrected   = int(JobStatusPostCorrected)
+	StatusIDExtendedLexicon = int(JobStatusExtendedLexicon)
+	StatusIDProfiledWithEL  = int(JobStatusProfiledWithEL)
 )
 
 // Status names
@@ -30,6 +46,35 @@ const (
 	StatusProfiledWithEL  = "profiled-with-el"
 )
 
+var jobStatusNames = [...]string{
+	JobStatusFailed:          StatusFailed,
+	JobStatusRunning:         StatusRunning,
+	JobStatusDone:            StatusDone,
+	JobStatusEmpty:           StatusEmpty,
+	JobStatusProfiled:        StatusProfiled,
+	JobStatusPostCorrected:   StatusPostCorrected,
+	JobStatusExtendedLexicon: StatusExtendedLexicon,
+	JobStatusProfiledWithEL:  StatusProfiledWithEL,
+}
+
+// String returns the name of the job status.
+func (s JobStatus) String() string {
+	if s < 0 || int(s) >= len(jobStatusNames) {
+		return fmt.Sprintf("JobStatus(%d)", int(s))
+	}
+	return jobStatusNames[s]
+}
+
+// JobStatusFromName returns the job status for the given name.
+func JobStatusFromName(name string) (JobStatus, error) {
+	for i, n := range jobStatusNames {
+		if n == name {
+			return JobStatus(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid job status: %q", name)
+}
+
 // JobsTableName defines the name of the jobs table.
 const JobsTableName = "jobs"
 
@@ -37,7 +82,9 @@ const jobsTable = JobsTableName + "(" +
 	"id INTEGER NOT NULL PRIMARY KEY UNIQUE REFERENCES " + BooksTableName + "(BooksID)," +
 	"statusid INTEGER NOT NULL REFERENCES " + StatusTableName + "(id)," +
 	"text VARCHAR(50) NOT NULL," +
-	"timestamp INT(11) NOT NULL" +
+	"timestamp INT(11) NOT NULL," +
+	"startedat INT(11) NOT NULL DEFAULT 0," +
+	"finishedat INT(11) NOT NULL DEFAULT 0" +
 	");"
 
 // StatusTableName defines the name of the jobs status table.
@@ -48,8 +95,26 @@ const statusTable = StatusTableName + "(" +
 	"text VARCHAR(15) NOT NULL" +
 	");"
 
-// CreateTableJobs creates the jobs and jobs status database tables if
-// they do not already exist.
+// JobBatchesTableName defines the name of the job batches table.
+const JobBatchesTableName = "jobbatches"
+
+const jobBatchesTable = JobBatchesTableName + "(" +
+	"id INTEGER NOT NULL PRIMARY KEY /*!40101 AUTO_INCREMENT */," +
+	"timestamp INT(11) NOT NULL" +
+	");"
+
+// JobBatchMembersTableName defines the name of the table that maps
+// job batches to their jobs.
+const JobBatchMembersTableName = "jobbatchmembers"
+
+const jobBatchMembersTable = JobBatchMembersTableName + "(" +
+	"batchid INTEGER NOT NULL REFERENCES " + JobBatchesTableName + "(id)," +
+	"jobid INTEGER NOT NULL REFERENCES " + JobsTableName + "(id)," +
+	"PRIMARY KEY (batchid,jobid)" +
+	");"
+
+// CreateTableJobs creates the jobs, jobs status and job batches
+// database tables if they do not already exist.
 func CreateTableJobs(db DB) error {
 	_, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+statusTable)
 	if err != nil {
@@ -68,19 +133,50 @@ func CreateTableJobs(db DB) error {
 		StatusIDExtendedLexicon, StatusExtendedLexicon,
 		StatusIDProfiledWithEL, StatusProfiledWithEL,
 	)
-	_, err = Exec(db, "CREATE TABLE IF NOT EXISTS "+jobsTable)
+	if _, err = Exec(db, "CREATE TABLE IF NOT EXISTS "+jobsTable); err != nil {
+		return err
+	}
+	// migrate old jobs tables
+	if err := addColumn(db, JobsTableName, "startedat", "INT(11) NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn(db, JobsTableName, "finishedat", "INT(11) NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err = Exec(db, "CREATE TABLE IF NOT EXISTS "+jobBatchesTable); err != nil {
+		return err
+	}
+	_, err = Exec(db, "CREATE TABLE IF NOT EXISTS "+jobBatchMembersTable)
 	return err
 }
 
 // NewJob inserts a new running job into the jobs table and returns
 // the new job ID.
 func NewJob(db DB, bookID int, text string) (int, error) {
-	const stmnt = "INSERT INTO " + JobsTableName + "(id,statusid,timestamp,text) VALUES (?,?,?,?)"
-	// ts := time.Now().Unix()
-	_, err := Exec(db, stmnt, bookID, StatusIDRunning, time.Now().Unix(), text)
+	const stmnt = "INSERT INTO " + JobsTableName + "(id,statusid,timestamp,startedat,text) VALUES (?,?,?,?,?)"
+	ts := time.Now().Unix()
+	_, err := Exec(db, stmnt, bookID, StatusIDRunning, ts, ts, text)
 	return bookID, err // book and job IDs are the same
 }
 
+// RestartJob sets the status of an existing job to running and resets
+// its start and finish times.
+func RestartJob(db DB, jobID int, text string) error {
+	const stmnt = "UPDATE " + JobsTableName + " SET StatusID=?,Timestamp=?,StartedAt=?,FinishedAt=0,Text=? WHERE id=?"
+	ts := time.Now().Unix()
+	_, err := Exec(db, stmnt, StatusIDRunning, ts, ts, text, jobID)
+	return err
+}
+
+// FinishJob sets the final status (done or failed) of a job and
+// records its finish time.
+func FinishJob(db DB, jobID, statusID int) error {
+	const stmnt = "UPDATE " + JobsTableName + " SET StatusID=?,Timestamp=?,FinishedAt=? WHERE id=?"
+	ts := time.Now().Unix()
+	_, err := Exec(db, stmnt, statusID, ts, ts, jobID)
+	return err
+}
+
 // SetJobStatus sets a new status for a job.
 func SetJobStatus(db DB, jobID, statusID int) error {
 	const stmnt = "UPDATE " + JobsTableName + " SET StatusID=?,Timestamp=? WHERE id=?"
@@ -96,11 +192,11 @@ func SetJobStatusWithText(db DB, jobID, statusID int, text string) error {
 	return err
 }
 
-// FindJobByID returns the given job
+// FindJobByID returns the given job.  The status name of the job is
+// derived from its status id.
 func FindJobByID(db DB, jobID int) (*api.JobStatus, bool, error) {
-	const stmnt = "SELECT j.id,j.Timestamp,j.StatusID,j.text,s.Text " +
-		"FROM " + JobsTableName + " AS j JOIN " + StatusTableName + " s " +
-		"ON j.statusid = s.id WHERE j.id=?"
+	const stmnt = "SELECT id,Timestamp,StartedAt,FinishedAt,StatusID,text " +
+		"FROM " + JobsTableName + " WHERE id=?"
 	rows, err := Query(db, stmnt, jobID)
 	if err != nil {
 		return nil, false, err
@@ -110,9 +206,10 @@ func FindJobByID(db DB, jobID int) (*api.JobStatus, bool, error) {
 		return nil, false, nil
 	}
 	var j api.JobStatus
-	if err := rows.Scan(&j.JobID, &j.Timestamp, &j.StatusID, &j.JobName, &j.StatusName); err != nil {
+	if err := rows.Scan(&j.JobID, &j.Timestamp, &j.StartedAt, &j.FinishedAt, &j.StatusID, &j.JobName); err != nil {
 		return nil, false, err
 	}
+	j.StatusName = JobStatus(j.StatusID).String()
 	j.BookID = j.JobID // job and book IDs are the same
 	return &j, true, nil
 }
@@ -123,3 +220,66 @@ func DeleteJobByID(db DB, jobID int) error {
 	_, err := Exec(db, stmnt, jobID)
 	return err
 }
+
+// NewJobBatch groups the jobs with the given ids into a new batch and
+// returns the new batch id.  Duplicate job ids are ignored.
+func NewJobBatch(db DB, jobIDs []int) (int, error) {
+	const stmt1 = "INSERT INTO " + JobBatchesTableName + "(timestamp) VALUES (?)"
+	const stmt2 = "INSERT INTO " + JobBatchMembersTableName + "(batchid,jobid) VALUES"
+	var batchID int
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		res, err := Exec(db, stmt1, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		batchID = int(id)
+		return err
+	})
+	t.Do(func(db DB) error {
+		seen := make(map[int]bool, len(jobIDs))
+		var rows [][]interface{}
+		for _, id := range jobIDs {
+			if !seen[id] {
+				seen[id] = true
+				rows = append(rows, []interface{}{batchID, id})
+			}
+		}
+		return insertRows(db, stmt2, rows)
+	})
+	if err := t.Done(); err != nil {
+		return 0, err
+	}
+	return batchID, nil
+}
+
+// FindJobBatchStatus returns the number of the batch's jobs mapped by
+// their status ids.  Jobs and books share their ids, so the current
+// status of the job of each member's book is counted.
+func FindJobBatchStatus(db DB, batchID int) (map[int]int, bool, error) {
+	const stmt1 = "SELECT 1 FROM " + JobBatchesTableName + " WHERE id=?"
+	const stmt2 = "SELECT j.statusid,COUNT(*) FROM " + JobBatchMembersTableName +
+		" m JOIN " + JobsTableName + " j ON m.jobid=j.id WHERE m.batchid=? GROUP BY j.statusid"
+	ok, err := exists(db, stmt1, batchID)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	rows, err := Query(db, stmt2, batchID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	counts := make(map[int]int)
+	for rows.Next() {
+		var status, n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, false, err
+		}
+		counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return counts, true, nil
+}
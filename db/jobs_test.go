@@ -87,3 +87,51 @@ func TestDeleteJobByID(t *testing.T) {
 		}
 	})
 }
+
+func TestFinishJobDuration(t *testing.T) {
+	withJobsTable(t, func(db DB) {
+		id, err := NewJob(db, 1, "")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// pretend that the job was started 10 seconds ago
+		const stmnt = "UPDATE " + JobsTableName + " SET StartedAt=StartedAt-10 WHERE id=?"
+		if _, err := Exec(db, stmnt, id); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := FinishJob(db, id, StatusIDDone); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		job, ok, err := FindJobByID(db, id)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !ok {
+			t.Fatalf("cannot find job id: %d", id)
+		}
+		if job.StatusID != StatusIDDone || job.FinishedAt == 0 {
+			t.Fatalf("invalid job: %v", job)
+		}
+		if job.Duration() <= 0 {
+			t.Fatalf("invalid duration: %s", job.Duration())
+		}
+	})
+}
+
+func TestJobStatusNames(t *testing.T) {
+	for s := JobStatusFailed; s <= JobStatusProfiledWithEL; s++ {
+		got, err := JobStatusFromName(s.String())
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got != s {
+			t.Fatalf("expected %d; got %d", s, got)
+		}
+	}
+	if JobStatusPostCorrected.String() != StatusPostCorrected {
+		t.Fatalf("invalid name: %s", JobStatusPostCorrected)
+	}
+	if _, err := JobStatusFromName("invalid"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -2,10 +2,18 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"strings"
 	"unicode"
+
+	"github.com/finkf/pcwgo/api"
 )
 
+// maxStmtArgs defines the maximal number of arguments used for
+// multi-row insert statements.  It is kept below sqlite's default
+// limit of 999 host parameters.
+const maxStmtArgs = 990
+
 // TextLinesTableName defines the name of the textlines table.
 const TextLinesTableName = "textlines"
 const tableTextLines = TextLinesTableName + " (" +
@@ -17,6 +25,10 @@ const tableTextLines = TextLinesTableName + " (" +
 	"LTop INT," +
 	"LRight INT," +
 	"LBottom INT," +
+	"checksum VARCHAR(64) NOT NULL DEFAULT ''," +
+	"fullycorrected BOOLEAN NOT NULL DEFAULT(false)," +
+	"partiallycorrected BOOLEAN NOT NULL DEFAULT(false)," +
+	"version INT NOT NULL DEFAULT 0," +
 	"PRIMARY KEY (BookID, PageID, LineID)" +
 	");"
 
@@ -138,6 +150,25 @@ func (cs Chars) IsManuallyCorrected() bool {
 	return true
 }
 
+// CorrectedCount returns the number of corrected characters in the
+// slice.  Deletions count as corrected characters.
+func (cs Chars) CorrectedCount() int {
+	var n int
+	for _, c := range cs {
+		if c.IsCorrected() {
+			n++
+		}
+	}
+	return n
+}
+
+// correctionFlags returns if the slice is fully or partially
+// corrected.  An empty slice is neither fully nor partially corrected.
+func (cs Chars) correctionFlags() (full, partial bool) {
+	n := cs.CorrectedCount()
+	return n > 0 && n == len(cs), n > 0 && n < len(cs)
+}
+
 // Cor returns the corrected string.
 func (cs Chars) Cor() string {
 	var b strings.Builder
@@ -168,6 +199,25 @@ func (cs Chars) OCR() string {
 	return b.String()
 }
 
+// Diff returns the difference between the OCR and the corrected
+// characters.  The alignment is given by the characters themselves.
+func (cs Chars) Diff() api.Diffs {
+	var b api.DiffBuilder
+	for _, c := range cs {
+		switch {
+		case c.IsDeletion():
+			b.Append(api.DiffDelete, c.OCR, 0)
+		case c.IsInsertion():
+			b.Append(api.DiffInsert, 0, c.Cor)
+		case c.IsSubstitution():
+			b.Append(api.DiffReplace, c.OCR, c.Cor)
+		default:
+			b.Append(api.DiffEqual, c.OCR, c.OCR)
+		}
+	}
+	return b.Diffs()
+}
+
 func issep(char Char) bool {
 	return unicode.IsSpace(char.GetCorrected())
 }
@@ -254,15 +304,76 @@ func (cs Chars) Trim(f func(Char) bool) Chars {
 // Line defines the line of a page in a book.
 type Line struct {
 	ImagePath                string
+	Checksum                 string // checksum of the line's image
 	Chars                    Chars
 	LineID                   int
 	PageID                   int
 	BookID                   int
 	Left, Right, Top, Bottom int
+	Version                  int // incremented with each update (see UpdateLine)
+}
+
+// CorrectionStats returns the number of corrected characters and the
+// total number of characters of the line.
+func (l Line) CorrectionStats() (corrected, total int) {
+	return l.Chars.CorrectedCount(), len(l.Chars)
+}
+
+// LinesCorrectionStats returns the accumulated number of corrected
+// characters and the total number of characters of the given lines
+// (e.g. all lines of a page).
+func LinesCorrectionStats(lines []Line) (corrected, total int) {
+	for _, l := range lines {
+		c, t := l.CorrectionStats()
+		corrected += c
+		total += t
+	}
+	return corrected, total
+}
+
+// APILine converts the line to an api.Line of the given project.  The
+// line's tokens are not set.
+func (l Line) APILine(projectID int) api.Line {
+	cuts := make([]int, len(l.Chars))
+	confs := make([]float64, len(l.Chars))
+	for i, c := range l.Chars {
+		cuts[i] = c.Cut
+		confs[i] = c.Conf
+	}
+	corrected, total := l.CorrectionStats()
+	return api.Line{
+		ImgFile:                  l.ImagePath,
+		Cor:                      l.Chars.Cor(),
+		OCR:                      l.Chars.OCR(),
+		LineID:                   l.LineID,
+		PageID:                   l.PageID,
+		ProjectID:                projectID,
+		BookID:                   l.BookID,
+		Cuts:                     cuts,
+		Confidences:              confs,
+		AverageConfidence:        l.Chars.AverageConfidence(),
+		IsAutomaticallyCorrected: len(l.Chars) > 0 && l.Chars.IsAutomaticallyCorrected(),
+		IsManuallyCorrected:      len(l.Chars) > 0 && l.Chars.IsManuallyCorrected(),
+		Box:                      newBox(l.Left, l.Right, l.Top, l.Bottom),
+		CorrectedChars:           corrected,
+		TotalChars:               total,
+		Version:                  l.Version,
+	}
+}
+
+func newBox(left, right, top, bottom int) api.Box {
+	return api.Box{
+		Left:   left,
+		Right:  right,
+		Top:    top,
+		Bottom: bottom,
+		Width:  right - left,
+		Height: bottom - top,
+	}
 }
 
 func (l *Line) scan(rows *sql.Rows) error {
-	return rows.Scan(&l.ImagePath, &l.Left, &l.Right, &l.Top, &l.Bottom)
+	return rows.Scan(&l.ImagePath, &l.Left, &l.Right, &l.Top, &l.Bottom, &l.Checksum, &l.Version)
 }
 
 // CreateTableLines creates the two tables needed for the storing of
@@ -273,22 +384,41 @@ func CreateTableLines(db DB) error {
 	if err != nil {
 		return err
 	}
-	_, err = Exec(db, "CREATE TABLE IF NOT EXISTS "+tableContents)
-	return err
+	if _, err = Exec(db, "CREATE TABLE IF NOT EXISTS "+tableContents); err != nil {
+		return err
+	}
+	// migrate old textlines tables
+	if err := addColumn(db, TextLinesTableName, "checksum", "VARCHAR(64) NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if !hasColumn(db, TextLinesTableName, "fullycorrected") {
+		if err := addColumn(db, TextLinesTableName, "fullycorrected", "BOOLEAN NOT NULL DEFAULT(false)"); err != nil {
+			return err
+		}
+		if err := addColumn(db, TextLinesTableName, "partiallycorrected", "BOOLEAN NOT NULL DEFAULT(false)"); err != nil {
+			return err
+		}
+		if err := backfillLineFlags(db); err != nil {
+			return err
+		}
+	}
+	return addColumn(db, TextLinesTableName, "version", "INT NOT NULL DEFAULT 0")
 }
 
 // InsertLine inserts the given line into the database.
 func InsertLine(db DB, line *Line) error {
 	const stmt1 = "INSERT INTO " + TextLinesTableName +
-		"(BookID,PageID,LineID,ImagePath,LLeft,LRight,LTop,LBottom) " +
-		"VALUES(?,?,?,?,?,?,?,?)"
+		"(BookID,PageID,LineID,ImagePath,LLeft,LRight,LTop,LBottom,checksum," +
+		"fullycorrected,partiallycorrected) VALUES(?,?,?,?,?,?,?,?,?,?,?)"
 	const stmt2 = "INSERT INTO " + ContentsTableName +
 		"(BookID,PageID,LineID,OCR,Cor,Cut,Conf,Seq,Cid,Manually) " +
 		"VALUES(?,?,?,?,?,?,?,?,?,?)"
+	full, partial := line.Chars.correctionFlags()
 	t := NewTransaction(Begin(db))
 	t.Do(func(db DB) error {
 		_, err := Exec(db, stmt1, line.BookID, line.PageID, line.LineID,
-			line.ImagePath, line.Left, line.Right, line.Top, line.Bottom)
+			line.ImagePath, line.Left, line.Right, line.Top, line.Bottom, line.Checksum,
+			full, partial)
 		return err
 	})
 	for i, char := range line.Chars {
@@ -301,32 +431,368 @@ func InsertLine(db DB, line *Line) error {
 	return t.Done()
 }
 
-// UpdateLine updates the contents for the given line.
+// InsertLines inserts all given lines in one transaction into the
+// database.  The textlines and contents rows are inserted using
+// multi-row insert statements.
+func InsertLines(db DB, lines []*Line) error {
+	const stmt1 = "INSERT INTO " + TextLinesTableName +
+		"(BookID,PageID,LineID,ImagePath,LLeft,LRight,LTop,LBottom,checksum," +
+		"fullycorrected,partiallycorrected) VALUES"
+	const stmt2 = "INSERT INTO " + ContentsTableName +
+		"(BookID,PageID,LineID,OCR,Cor,Cut,Conf,Seq,Cid,Manually) VALUES"
+	var textlines, contents [][]interface{}
+	for _, line := range lines {
+		full, partial := line.Chars.correctionFlags()
+		textlines = append(textlines, []interface{}{
+			line.BookID, line.PageID, line.LineID,
+			line.ImagePath, line.Left, line.Right, line.Top, line.Bottom, line.Checksum,
+			full, partial,
+		})
+		for i, char := range line.Chars {
+			contents = append(contents, []interface{}{
+				line.BookID, line.PageID, line.LineID,
+				char.OCR, char.Cor, char.Cut, char.Conf, i, char.ID, char.Manually,
+			})
+		}
+	}
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error { return insertRows(db, stmt1, textlines) })
+	t.Do(func(db DB) error { return insertRows(db, stmt2, contents) })
+	return t.Done()
+}
+
+// insertRows inserts the given rows using multi-row insert
+// statements.  The given statement must end with `VALUES`.  All rows
+// must have the same number of columns.
+func insertRows(db DB, stmt string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	n := maxStmtArgs / len(rows[0])
+	for len(rows) > 0 {
+		if n > len(rows) {
+			n = len(rows)
+		}
+		var b strings.Builder
+		b.WriteString(stmt)
+		var args []interface{}
+		for i, row := range rows[:n] {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString("(?" + strings.Repeat(",?", len(row)-1) + ")")
+			args = append(args, row...)
+		}
+		if _, err := Exec(db, b.String(), args...); err != nil {
+			return err
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// UpdateLine updates the contents for the given line.  The
+// characters of the line are replaced with the line's current
+// characters.
+//
+// The line's version must match the stored version of the line (see
+// FindLineByID).  Otherwise the line was updated concurrently, nothing
+// is updated and a DBError of kind ErrorKindConflict that wraps
+// ErrConflict is returned.  On success the stored version and the
+// version of the given line are incremented.
 func UpdateLine(db DB, line *Line) error {
-	const stmt1 = "UPDATE " + TextLinesTableName + " SET " +
-		"ImagePath=?,LLeft=?,LRight=?,LTop=?,LBottom=? " +
-		"WHERE BookID=? AND PageID=? AND LineID=?"
-	const stmt2 = "UPDATE " + ContentsTableName + " SET " +
-		"OCR=?,Cor=?,Cut=?,Conf=?,Seq=? " +
-		"WHERE BookID=? AND PageID=? AND LineID=?"
+	return UpdateLines(db, []*Line{line})
+}
+
+// UpdateLines updates the contents of all given lines in one
+// transaction.  If any of the updates fails (e.g. if one of the lines
+// does not exist or was updated concurrently), the whole transaction
+// is rolled back and none of the lines are updated.
+func UpdateLines(db DB, lines []*Line) error {
 	t := NewTransaction(Begin(db))
-	t.Do(func(db DB) error {
-		_, err := Exec(db, stmt1,
-			line.ImagePath, line.Left, line.Right, line.Top, line.Bottom,
+	for _, line := range lines {
+		line := line
+		t.Do(func(db DB) error { return updateLine(db, line) })
+	}
+	if err := t.Done(); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		line.Version++
+	}
+	return nil
+}
+
+func updateLine(db DB, line *Line) error {
+	const stmt1 = "UPDATE " + TextLinesTableName + " SET " +
+		"ImagePath=?,LLeft=?,LRight=?,LTop=?,LBottom=?,checksum=?,version=version+1 " +
+		"WHERE BookID=? AND PageID=? AND LineID=? AND version=?"
+	const stmt2 = "DELETE FROM " + ContentsTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=?"
+	const stmt3 = "INSERT INTO " + ContentsTableName +
+		"(BookID,PageID,LineID,OCR,Cor,Cut,Conf,Seq,Cid,Manually) VALUES"
+	ok, err := lineExists(db, line.BookID, line.PageID, line.LineID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("cannot update line %d:%d:%d: no such line",
 			line.BookID, line.PageID, line.LineID)
+	}
+	res, err := Exec(db, stmt1,
+		line.ImagePath, line.Left, line.Right, line.Top, line.Bottom, line.Checksum,
+		line.BookID, line.PageID, line.LineID, line.Version)
+	if err != nil {
 		return err
-	})
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 { // the line was updated concurrently
+		return &DBError{Op: "update", Table: TextLinesTableName, Kind: ErrorKindConflict, Err: ErrConflict}
+	}
+	if _, err := Exec(db, stmt2, line.BookID, line.PageID, line.LineID); err != nil {
+		return err
+	}
+	contents := make([][]interface{}, len(line.Chars))
 	for i, char := range line.Chars {
-		t.Do(func(db DB) error {
-			_, err := Exec(db, stmt2,
-				char.OCR, char.Cor, char.Cut, char.Conf, i+1,
-				line.BookID, line.PageID, line.LineID)
+		contents[i] = []interface{}{
+			line.BookID, line.PageID, line.LineID,
+			char.OCR, char.Cor, char.Cut, char.Conf, i, char.ID, char.Manually,
+		}
+	}
+	if err := insertRows(db, stmt3, contents); err != nil {
+		return err
+	}
+	return RecomputeLineFlags(db, line.BookID, line.PageID, line.LineID)
+}
+
+// RecomputeLineFlags updates the fullycorrected and
+// partiallycorrected flags of the given line from the line's
+// contents.  A line is fully corrected if all of its characters are
+// corrected and partially corrected if some but not all of its
+// characters are corrected.  UpdateLine recomputes the flags
+// automatically.
+func RecomputeLineFlags(db DB, bookID, pageID, lineID int) error {
+	const stmt1 = "SELECT COUNT(*),COALESCE(SUM(CASE WHEN Cor<>0 THEN 1 ELSE 0 END),0) FROM " +
+		ContentsTableName + " WHERE BookID=? AND PageID=? AND LineID=?"
+	const stmt2 = "UPDATE " + TextLinesTableName +
+		" SET fullycorrected=?,partiallycorrected=? WHERE BookID=? AND PageID=? AND LineID=?"
+	rows, err := Query(db, stmt1, bookID, pageID, lineID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var n, cor int
+	if rows.Next() {
+		if err := rows.Scan(&n, &cor); err != nil {
 			return err
-		})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	rows.Close()
+	_, err = Exec(db, stmt2, n > 0 && cor == n, cor > 0 && cor < n, bookID, pageID, lineID)
+	return err
+}
+
+// backfillLineFlags computes the fullycorrected and
+// partiallycorrected flags of all existing lines from their contents
+// (see RecomputeLineFlags).  It is used to migrate old textlines
+// tables.
+func backfillLineFlags(db DB) error {
+	const where = " FROM " + ContentsTableName + " c WHERE c.BookID=" + TextLinesTableName +
+		".BookID AND c.PageID=" + TextLinesTableName + ".PageID AND c.LineID=" +
+		TextLinesTableName + ".LineID)"
+	const cor = "SUM(CASE WHEN c.Cor<>0 THEN 1 ELSE 0 END)"
+	const stmt = "UPDATE " + TextLinesTableName + " SET " +
+		"fullycorrected=(SELECT CASE WHEN COUNT(*)>0 AND " + cor + "=COUNT(*) THEN 1 ELSE 0 END" + where + "," +
+		"partiallycorrected=(SELECT CASE WHEN " + cor + ">0 AND " + cor + "<COUNT(*) THEN 1 ELSE 0 END" + where
+	_, err := Exec(db, stmt)
+	return err
+}
+
+func lineExists(db DB, bookID, pageID, lineID int) (bool, error) {
+	const stmt = "SELECT 1 FROM " + TextLinesTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=?"
+	return exists(db, stmt, bookID, pageID, lineID)
+}
+
+// DeleteLineByID deletes the line with the given book, page and line
+// id.  The line and its contents are deleted in one transaction.  It
+// is an error if the line does not exist.
+func DeleteLineByID(db DB, bookID, pageID, lineID int) error {
+	const stmt1 = "DELETE FROM " + ContentsTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=?"
+	const stmt2 = "DELETE FROM " + TextLinesTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=?"
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		ok, err := lineExists(db, bookID, pageID, lineID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("cannot delete line %d:%d:%d: no such line",
+				bookID, pageID, lineID)
+		}
+		if _, err := Exec(db, stmt1, bookID, pageID, lineID); err != nil {
+			return err
+		}
+		_, err = Exec(db, stmt2, bookID, pageID, lineID)
+		return err
+	})
 	return t.Done()
 }
 
+// SetLineImageChecksum sets the checksum of the image of the given
+// line.
+func SetLineImageChecksum(db DB, bookID, pageID, lineID int, checksum string) error {
+	const stmt = "UPDATE " + TextLinesTableName +
+		" SET checksum=? WHERE BookID=? AND PageID=? AND LineID=?"
+	_, err := Exec(db, stmt, checksum, bookID, pageID, lineID)
+	return err
+}
+
+// SeqAnomaly describes an anomaly of the sequence numbers of a
+// line's characters: a sequence number that is missing (Count is 0)
+// or duplicated (Count is larger than 1).
+type SeqAnomaly struct {
+	Seq, Count int
+}
+
+func (a SeqAnomaly) String() string {
+	if a.Count == 0 {
+		return fmt.Sprintf("missing seq %d", a.Seq)
+	}
+	return fmt.Sprintf("seq %d used %d times", a.Seq, a.Count)
+}
+
+// VerifyLineSeq checks that the sequence numbers of the characters of
+// the given line are numbered 0..n-1.  It returns all anomalies of
+// the sequence numbers.
+func VerifyLineSeq(db DB, bookID, pageID, lineID int) ([]SeqAnomaly, error) {
+	const stmt = "SELECT Seq FROM " + ContentsTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=? ORDER BY Seq"
+	rows, err := Query(db, stmt, bookID, pageID, lineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var anomalies []SeqAnomaly
+	next, count := 0, 0 // next expected seq; count of the current seq
+	for rows.Next() {
+		var seq int
+		if err := rows.Scan(&seq); err != nil {
+			return nil, err
+		}
+		if seq < 0 { // invalid sequence number
+			anomalies = append(anomalies, SeqAnomaly{Seq: seq, Count: 1})
+			continue
+		}
+		if count > 0 && seq == next-1 { // duplicate
+			count++
+			continue
+		}
+		if count > 1 {
+			anomalies = append(anomalies, SeqAnomaly{Seq: next - 1, Count: count})
+		}
+		for ; next < seq; next++ {
+			anomalies = append(anomalies, SeqAnomaly{Seq: next})
+		}
+		next, count = seq+1, 1
+	}
+	if count > 1 {
+		anomalies = append(anomalies, SeqAnomaly{Seq: next - 1, Count: count})
+	}
+	return anomalies, rows.Err()
+}
+
+// RepairLineSeq renumbers the sequence numbers of the characters of
+// the given line to 0..n-1 in one transaction.  The characters keep
+// their current order (by sequence number and cut).
+func RepairLineSeq(db DB, bookID, pageID, lineID int) error {
+	const stmt1 = "SELECT OCR,Cor,Cut,Conf,Seq,Cid,Manually FROM " + ContentsTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=? ORDER BY Seq,Cut"
+	const stmt2 = "DELETE FROM " + ContentsTableName +
+		" WHERE BookID=? AND PageID=? AND LineID=?"
+	const stmt3 = "INSERT INTO " + ContentsTableName +
+		"(BookID,PageID,LineID,OCR,Cor,Cut,Conf,Seq,Cid,Manually) VALUES"
+	var chars Chars
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		rows, err := Query(db, stmt1, bookID, pageID, lineID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c Char
+			if err := c.scan(rows); err != nil {
+				return err
+			}
+			chars = append(chars, c)
+		}
+		return rows.Err()
+	})
+	t.Do(func(db DB) error {
+		_, err := Exec(db, stmt2, bookID, pageID, lineID)
+		return err
+	})
+	t.Do(func(db DB) error {
+		contents := make([][]interface{}, len(chars))
+		for i, char := range chars {
+			contents[i] = []interface{}{
+				bookID, pageID, lineID,
+				char.OCR, char.Cor, char.Cut, char.Conf, i, char.ID, char.Manually,
+			}
+		}
+		return insertRows(db, stmt3, contents)
+	})
+	return t.Done()
+}
+
+// RepairBookSeq verifies the sequence numbers of all lines of the
+// given book and repairs the lines with anomalies (see VerifyLineSeq
+// and RepairLineSeq).  It returns the number of repaired lines.
+func RepairBookSeq(db DB, bookID int) (int, error) {
+	const stmt = "SELECT PageID,LineID FROM " + TextLinesTableName + " WHERE BookID=?"
+	rows, err := Query(db, stmt, bookID)
+	if err != nil {
+		return 0, err
+	}
+	var ids [][2]int
+	for rows.Next() {
+		var id [2]int
+		if err := rows.Scan(&id[0], &id[1]); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var n int
+	for _, id := range ids {
+		anomalies, err := VerifyLineSeq(db, bookID, id[0], id[1])
+		if err != nil {
+			return n, err
+		}
+		if len(anomalies) == 0 {
+			continue
+		}
+		if err := RepairLineSeq(db, bookID, id[0], id[1]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
 // FindPageLines returns all line IDs for the page identified by the
 // given book and page IDs.
 func FindPageLines(db DB, bookID, pageID int) ([]int, error) {
@@ -350,7 +816,7 @@ func FindPageLines(db DB, bookID, pageID int) ([]int, error) {
 // FindLineByID returns the line identified by the given book, page
 // and line ID.
 func FindLineByID(db DB, bookID, pageID, lineID int) (*Line, bool, error) {
-	const stmt1 = "SELECT ImagePath,LLeft,LRight,LTop,LBottom FROM " +
+	const stmt1 = "SELECT ImagePath,LLeft,LRight,LTop,LBottom,checksum,version FROM " +
 		TextLinesTableName + " WHERE BookID=? AND PageID=? AND LineID=?"
 	const stmt2 = "SELECT OCR,Cor,Cut,Conf,Seq,Cid,Manually " +
 		"FROM " + ContentsTableName +
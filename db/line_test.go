@@ -2,10 +2,12 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
 
+	"github.com/finkf/pcwgo/api"
 	"github.com/finkf/pcwgo/db/sqlite"
 )
 
@@ -75,3 +77,438 @@ func TestFindLineByID(t *testing.T) {
 		}
 	})
 }
+
+func newTestPageLines(id, n int) []*Line {
+	lines := make([]*Line, n)
+	for i := range lines {
+		lines[i] = &Line{
+			ImagePath: fmt.Sprintf("line_image_path_%d", i),
+			Chars:     newChars(i + 100),
+			LineID:    i + 1,
+			PageID:    id,
+			BookID:    id,
+		}
+	}
+	return lines
+}
+
+func TestInsertLines(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		lines := newTestPageLines(1, 40)
+		if err := InsertLines(db, lines); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		for _, want := range lines {
+			got, found, err := FindLineByID(db, want.BookID, want.PageID, want.LineID)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !found {
+				t.Fatalf("cannot find line: %d", want.LineID)
+			}
+			if !reflect.DeepEqual(*got, *want) {
+				t.Fatalf("expected line=%v; got %v", *want, *got)
+			}
+		}
+	})
+}
+
+func BenchmarkInsertLines(b *testing.B) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			b.Fatalf("got error: %v", err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := InsertLines(db, newTestPageLines(i+1, 40)); err != nil {
+				b.Fatalf("got error: %v", err)
+			}
+		}
+	})
+}
+
+func TestCharsDiff(t *testing.T) {
+	cs := Chars{
+		{OCR: 'a'},
+		{OCR: 'b', Cor: 'b'},
+		{OCR: 0, Cor: 'x'},
+		{OCR: 'c', Cor: -1},
+		{OCR: 'd', Cor: 'e'},
+	}
+	want := api.Diffs{
+		{Type: api.DiffEqual, OCR: "ab", Cor: "ab"},
+		{Type: api.DiffInsert, OCR: "", Cor: "x"},
+		{Type: api.DiffDelete, OCR: "c", Cor: ""},
+		{Type: api.DiffReplace, OCR: "d", Cor: "e"},
+	}
+	if got := cs.Diff(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+}
+
+func TestCorrectionStats(t *testing.T) {
+	lines := []Line{
+		{Chars: Chars{{OCR: 'a'}, {OCR: 'b', Cor: 'b'}, {OCR: 'c', Cor: -1}}},
+		{Chars: Chars{{OCR: 0, Cor: 'x'}, {OCR: 'd'}}},
+		{},
+	}
+	tests := []struct {
+		line             Line
+		corrected, total int
+	}{
+		{lines[0], 2, 3},
+		{lines[1], 1, 2},
+		{lines[2], 0, 0},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("line_%d", i), func(t *testing.T) {
+			corrected, total := tc.line.CorrectionStats()
+			if corrected != tc.corrected || total != tc.total {
+				t.Fatalf("expected %d/%d; got %d/%d",
+					tc.corrected, tc.total, corrected, total)
+			}
+		})
+	}
+	if corrected, total := LinesCorrectionStats(lines); corrected != 3 || total != 5 {
+		t.Fatalf("expected 3/5; got %d/%d", corrected, total)
+	}
+}
+
+func TestAPIPageCorrectionStats(t *testing.T) {
+	lines := []Line{
+		{LineID: 1, Chars: Chars{{OCR: 'a'}, {OCR: 'b', Cor: 'b'}, {OCR: 'c', Cor: -1}}},
+		{LineID: 2, Chars: Chars{{OCR: 0, Cor: 'x'}, {OCR: 'd'}}},
+	}
+	page := Page{BookID: 1, PageID: 2}.APIPage(3, lines)
+	if page.CorrectedChars != 3 || page.TotalChars != 5 {
+		t.Fatalf("expected 3/5; got %d/%d", page.CorrectedChars, page.TotalChars)
+	}
+	if page.Lines[0].CorrectedChars != 2 || page.Lines[0].TotalChars != 3 {
+		t.Fatalf("expected 2/3; got %d/%d", page.Lines[0].CorrectedChars, page.Lines[0].TotalChars)
+	}
+	if corrected, total := page.CorrectionStats(); corrected != 3 || total != 5 {
+		t.Fatalf("expected 3/5; got %d/%d", corrected, total)
+	}
+	page.Lines = nil
+	if corrected, total := page.CorrectionStats(); corrected != 3 || total != 5 {
+		t.Fatalf("expected 3/5 without lines; got %d/%d", corrected, total)
+	}
+}
+
+func TestUpdateLines(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		line1 := newTestLine(t, db, 1)
+		line2 := newTestLine(t, db, 2)
+		update := func(line *Line) *Line {
+			updated := *line
+			updated.Chars = append(Chars{}, line.Chars...)
+			updated.Chars[0].Cor = 'X'
+			updated.Chars[0].Manually = true
+			updated.Chars = append(updated.Chars, Char{OCR: 0, Cor: 'Y', Seq: len(updated.Chars)})
+			return &updated
+		}
+		// batch with a missing line must fail and roll back
+		missing := update(line2)
+		missing.LineID = 42
+		if err := UpdateLines(db, []*Line{update(line1), missing}); err == nil {
+			t.Fatalf("expected an error")
+		}
+		got, _, err := FindLineByID(db, line1.BookID, line1.PageID, line1.LineID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !reflect.DeepEqual(*got, *line1) {
+			t.Fatalf("expected line=%v; got %v", *line1, *got)
+		}
+		// valid batch
+		want1, want2 := update(line1), update(line2)
+		if err := UpdateLines(db, []*Line{want1, want2}); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		for _, want := range []*Line{want1, want2} {
+			got, _, err := FindLineByID(db, want.BookID, want.PageID, want.LineID)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !reflect.DeepEqual(*got, *want) {
+				t.Fatalf("expected line=%v; got %v", *want, *got)
+			}
+		}
+	})
+}
+
+func TestRecomputeLineFlags(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		line := newTestLine(t, db, 1)
+		flags := func() (full, partial bool) {
+			t.Helper()
+			const stmt = "SELECT fullycorrected,partiallycorrected FROM " + TextLinesTableName +
+				" WHERE BookID=? AND PageID=? AND LineID=?"
+			err := db.QueryRow(stmt, line.BookID, line.PageID, line.LineID).Scan(&full, &partial)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			return full, partial
+		}
+		tests := []struct {
+			name          string
+			uncorrect     int // number of chars to uncorrect
+			full, partial bool
+		}{
+			{"full", 0, true, false},
+			{"partial", 1, false, true},
+			{"none", len(line.Chars), false, false},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				update := *line
+				update.Chars = append(Chars{}, line.Chars...)
+				for i := 0; i < tc.uncorrect; i++ {
+					update.Chars[i].Cor = 0
+				}
+				if err := UpdateLine(db, &update); err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				line.Version = update.Version
+				if full, partial := flags(); full != tc.full || partial != tc.partial {
+					t.Fatalf("expected full=%t, partial=%t; got full=%t, partial=%t",
+						tc.full, tc.partial, full, partial)
+				}
+			})
+		}
+		// recompute after a manual change of the contents
+		const stmt = "UPDATE " + ContentsTableName + " SET Cor=65 WHERE Seq=0"
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := RecomputeLineFlags(db, line.BookID, line.PageID, line.LineID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if full, partial := flags(); full || !partial {
+			t.Fatalf("expected partial; got full=%t, partial=%t", full, partial)
+		}
+	})
+}
+
+func TestMigrateLineFlags(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		// legacy textlines table without correction flags
+		const legacy = TextLinesTableName + " (" +
+			"BookID INT,PageID INT,LineID INT NOT NULL,ImagePath VARCHAR(255)," +
+			"LLeft INT,LTop INT,LRight INT,LBottom INT," +
+			"PRIMARY KEY (BookID, PageID, LineID))"
+		if _, err := db.Exec("CREATE TABLE " + legacy); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if _, err := db.Exec("CREATE TABLE " + tableContents); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// line 1: fully, line 2: partially, line 3: not corrected, line 4: empty
+		for id := 1; id <= 4; id++ {
+			const stmt = "INSERT INTO " + TextLinesTableName + " (BookID,PageID,LineID) VALUES (1,1,?)"
+			if _, err := db.Exec(stmt, id); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		for _, c := range [][3]int{{1, 0, 'a'}, {1, 1, 'b'}, {2, 0, 'a'}, {2, 1, 0}, {3, 0, 0}} {
+			const stmt = "INSERT INTO " + ContentsTableName +
+				" (BookID,PageID,LineID,Seq,OCR,Cor,Cut,Conf,Cid) VALUES (1,1,?,?,97,?,0,0,0)"
+			if _, err := db.Exec(stmt, c[0], c[1], c[2]); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		if err := CreateTableLines(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want := map[int][2]bool{1: {true, false}, 2: {false, true}, 3: {false, false}, 4: {false, false}}
+		for id, flags := range want {
+			const stmt = "SELECT fullycorrected,partiallycorrected FROM " + TextLinesTableName +
+				" WHERE BookID=1 AND PageID=1 AND LineID=?"
+			var full, partial bool
+			if err := db.QueryRow(stmt, id).Scan(&full, &partial); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if full != flags[0] || partial != flags[1] {
+				t.Fatalf("line %d: expected full=%t, partial=%t; got full=%t, partial=%t",
+					id, flags[0], flags[1], full, partial)
+			}
+		}
+	})
+}
+
+func TestUpdateLineVersion(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		line := newTestLine(t, db, 1)
+		// two reviewers load the same line
+		a, _, err := FindLineByID(db, line.BookID, line.PageID, line.LineID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		b, _, err := FindLineByID(db, line.BookID, line.PageID, line.LineID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		a.Chars[0].Cor = 'a'
+		if err := UpdateLine(db, a); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if a.Version != 1 {
+			t.Fatalf("expected version 1; got %d", a.Version)
+		}
+		b.Chars[0].Cor = 'b'
+		err = UpdateLine(db, b)
+		if !errors.Is(err, ErrConflict) || ErrorKindOf(err) != ErrorKindConflict {
+			t.Fatalf("expected a conflict; got %v", err)
+		}
+		if b.Version != 0 {
+			t.Fatalf("expected version 0; got %d", b.Version)
+		}
+		got, _, err := FindLineByID(db, line.BookID, line.PageID, line.LineID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got.Version != 1 || got.Chars[0].Cor != 'a' {
+			t.Fatalf("invalid line: version=%d, cor=%c", got.Version, got.Chars[0].Cor)
+		}
+		// the reviewer reloads the line and updates again
+		got.Chars[0].Cor = 'b'
+		if err := UpdateLine(db, got); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got.Version != 2 {
+			t.Fatalf("expected version 2; got %d", got.Version)
+		}
+	})
+}
+
+func TestAPILineVersion(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		line := newTestLine(t, db, 1)
+		// load the line as a client would see it
+		load := func() api.Line {
+			t.Helper()
+			l, found, err := FindLineByID(db, line.BookID, line.PageID, line.LineID)
+			if err != nil || !found {
+				t.Fatalf("cannot find line: %v", err)
+			}
+			return l.APILine(1)
+		}
+		// update the line with the version the client sends back
+		update := func(version int, cor rune) error {
+			t.Helper()
+			l, _, err := FindLineByID(db, line.BookID, line.PageID, line.LineID)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			l.Version = version
+			l.Chars[0].Cor = cor
+			return UpdateLine(db, l)
+		}
+		first := load()
+		if err := update(first.Version, 'a'); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		second := load()
+		if second.Version != first.Version+1 {
+			t.Fatalf("expected version %d; got %d", first.Version+1, second.Version)
+		}
+		if err := update(second.Version, 'b'); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := update(first.Version, 'c'); !errors.Is(err, ErrConflict) {
+			t.Fatalf("expected a conflict; got %v", err)
+		}
+	})
+}
+
+func TestDeleteLineByID(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		line1 := newTestLine(t, db, 1)
+		line2 := *line1
+		line2.LineID = 2
+		line2.Chars = newChars(2)
+		if err := InsertLine(db, &line2); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := DeleteLineByID(db, line1.BookID, line1.PageID, line1.LineID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if _, found, err := FindLineByID(db, line1.BookID, line1.PageID, line1.LineID); err != nil || found {
+			t.Fatalf("expected not found; got found=%t, err=%v", found, err)
+		}
+		var n int
+		const stmt = "SELECT COUNT(*) FROM " + ContentsTableName + " WHERE LineID=?"
+		if err := db.QueryRow(stmt, line1.LineID).Scan(&n); err != nil || n != 0 {
+			t.Fatalf("expected no contents; got %d, err=%v", n, err)
+		}
+		got, found, err := FindLineByID(db, line2.BookID, line2.PageID, line2.LineID)
+		if err != nil || !found {
+			t.Fatalf("expected found; got found=%t, err=%v", found, err)
+		}
+		if !reflect.DeepEqual(*got, line2) {
+			t.Fatalf("expected line=%v; got %v", line2, *got)
+		}
+		if err := DeleteLineByID(db, line1.BookID, line1.PageID, line1.LineID); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestRepairLineSeq(t *testing.T) {
+	sqlite.With("lines.sqlite", func(db *sql.DB) {
+		// Old contents tables without a primary key can contain
+		// duplicated sequence numbers.
+		const stmt = "CREATE TABLE " + ContentsTableName + " (" +
+			"BookID INT,PageID INT,LineID INT,Seq INT NOT NULL," +
+			"OCR INT NOT NULL,Cor INT NOT NULL,Cut INT NOT NULL,Conf double NOT NULL," +
+			"Cid int NOT NULL,Manually boolean NOT NULL DEFAULT(false))"
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		lines := newTestPageLines(1, 2)
+		if err := InsertLines(db, lines); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// "ocr_100" with the sequence numbers 0,1,1,3,5,5,5
+		for _, seq := range []struct{ new, cut int }{{1, 102}, {5, 104}, {5, 106}} {
+			const stmt = "UPDATE " + ContentsTableName +
+				" SET Seq=? WHERE BookID=1 AND PageID=1 AND LineID=1 AND Cut=?"
+			if _, err := db.Exec(stmt, seq.new, seq.cut); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		anomalies, err := VerifyLineSeq(db, 1, 1, 1)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want := []SeqAnomaly{{1, 2}, {2, 0}, {4, 0}, {5, 3}}
+		if !reflect.DeepEqual(anomalies, want) {
+			t.Fatalf("expected anomalies %v; got %v", want, anomalies)
+		}
+		n, err := RepairBookSeq(db, 1)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if n != 1 {
+			t.Fatalf("expected 1 repaired line; got %d", n)
+		}
+		for _, want := range lines {
+			if anomalies, _ := VerifyLineSeq(db, 1, 1, want.LineID); len(anomalies) != 0 {
+				t.Fatalf("line %d: unexpected anomalies: %v", want.LineID, anomalies)
+			}
+			got, _, err := FindLineByID(db, 1, 1, want.LineID)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Chars, want.Chars) {
+				t.Fatalf("expected chars %v; got %v", want.Chars, got.Chars)
+			}
+		}
+	})
+}
@@ -1,5 +1,12 @@
 package db
 
+import (
+	"sort"
+	"strings"
+
+	"github.com/finkf/pcwgo/api"
+)
+
 // PagesTableName defines the name of the pages table.
 const PagesTableName = "pages"
 
@@ -11,6 +18,7 @@ const pagesTable = PagesTableName + "(" +
 	"PTop INT," +
 	"PRight INT," +
 	"PBottom INT," +
+	"checksum VARCHAR(64) NOT NULL DEFAULT ''," +
 	"PRIMARY KEY (BookID, PageID)" +
 	");"
 
@@ -18,23 +26,123 @@ const pagesTable = PagesTableName + "(" +
 type Page struct {
 	BookID, PageID           int
 	ImagePath, OCRPath       string
+	Checksum                 string // checksum of the page's image
 	Left, Right, Top, Bottom int
 }
 
+// APIPage converts the page and the given lines of the page to an
+// api.Page of the given project.  The correction stats of the page
+// are accumulated from the given lines (see LinesCorrectionStats).
+func (p Page) APIPage(projectID int, lines []Line) api.Page {
+	page := api.Page{
+		PageID:    p.PageID,
+		ProjectID: projectID,
+		BookID:    p.BookID,
+		OCRFile:   p.OCRPath,
+		ImgFile:   p.ImagePath,
+		Box:       newBox(p.Left, p.Right, p.Top, p.Bottom),
+		Lines:     make([]api.Line, len(lines)),
+	}
+	for i, l := range lines {
+		page.Lines[i] = l.APILine(projectID)
+	}
+	page.CorrectedChars, page.TotalChars = LinesCorrectionStats(lines)
+	return page
+}
+
 // CreateTablePages creates the databases table pages if it does not
 // already exist.  This function will fail if the table books does not
 // exist.
 func CreateTablePages(db DB) error {
-	_, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+pagesTable)
-	return err
+	if _, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+pagesTable); err != nil {
+		return err
+	}
+	// migrate old pages tables
+	return addColumn(db, PagesTableName, "checksum", "VARCHAR(64) NOT NULL DEFAULT ''")
 }
 
 // InsertPage insert a page into the database.
 func InsertPage(db DB, page *Page) error {
 	const stmt = "INSERT INTO " + PagesTableName +
-		"(BookID,PageID,ImagePath,PLeft,PRight,PTop,PBottom)" +
-		"VALUES(?,?,?,?,?,?,?)"
+		"(BookID,PageID,ImagePath,PLeft,PRight,PTop,PBottom,checksum)" +
+		"VALUES(?,?,?,?,?,?,?,?)"
 	_, err := Exec(db, stmt, page.BookID, page.PageID, page.ImagePath,
-		page.Left, page.Right, page.Top, page.Bottom)
+		page.Left, page.Right, page.Top, page.Bottom, page.Checksum)
 	return err
 }
+
+// SetImageChecksum sets the checksum of the image of the given page.
+func SetImageChecksum(db DB, bookID, pageID int, checksum string) error {
+	const stmt = "UPDATE " + PagesTableName + " SET checksum=? WHERE BookID=? AND PageID=?"
+	_, err := Exec(db, stmt, checksum, bookID, pageID)
+	return err
+}
+
+const selectPageStmt = "SELECT BookID,PageID,COALESCE(ImagePath,''),PLeft,PRight,PTop,PBottom,checksum FROM " +
+	PagesTableName + " "
+
+// FindPageByID searches for the page with the given id of the given
+// book.
+func FindPageByID(db DB, bookID, pageID int) (*Page, bool, error) {
+	const stmt = selectPageStmt + "WHERE BookID=? AND PageID=?"
+	return selectPage(db, stmt, bookID, pageID)
+}
+
+// FindPageByChecksum searches for a page of the given book whose
+// image has the given checksum.
+func FindPageByChecksum(db DB, bookID int, checksum string) (*Page, bool, error) {
+	const stmt = selectPageStmt + "WHERE BookID=? AND checksum=?"
+	return selectPage(db, stmt, bookID, checksum)
+}
+
+func selectPage(db DB, stmt string, args ...interface{}) (*Page, bool, error) {
+	rows, err := Query(db, stmt, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, false, nil
+	}
+	var p Page
+	if err := rows.Scan(&p.BookID, &p.PageID, &p.ImagePath,
+		&p.Left, &p.Right, &p.Top, &p.Bottom, &p.Checksum); err != nil {
+		return nil, false, err
+	}
+	return &p, true, nil
+}
+
+// PageText returns the corrected text of the given page.  The lines
+// of the page are ordered by their line IDs and separated by
+// newlines.  Lines without any content result in empty lines.
+func PageText(db DB, bookID, pageID int) (string, error) {
+	const stmt = "SELECT LineID,OCR,Cor,Cut,Conf,Seq,Cid,Manually FROM " +
+		ContentsTableName + " WHERE BookID=? AND PageID=? ORDER BY LineID,Seq"
+	ids, err := FindPageLines(db, bookID, pageID)
+	if err != nil {
+		return "", err
+	}
+	rows, err := Query(db, stmt, bookID, pageID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	chars := make(map[int]Chars, len(ids))
+	for rows.Next() {
+		var id int
+		var c Char
+		if err := rows.Scan(&id, &c.OCR, &c.Cor, &c.Cut, &c.Conf, &c.Seq, &c.ID, &c.Manually); err != nil {
+			return "", err
+		}
+		chars[id] = append(chars[id], c)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	sort.Ints(ids)
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		lines[i] = chars[id].Cor()
+	}
+	return strings.Join(lines, "\n"), nil
+}
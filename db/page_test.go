@@ -1,8 +1,11 @@
 package db
 
 import (
+	"database/sql"
 	"fmt"
 	"testing"
+
+	"github.com/finkf/pcwgo/db/sqlite"
 )
 
 func newTestPage(t *testing.T, db DB, id int) *Page {
@@ -25,3 +28,65 @@ func newTestPage(t *testing.T, db DB, id int) *Page {
 	}
 	return page
 }
+
+func TestFindPageByChecksum(t *testing.T) {
+	sqlite.With("pages.sqlite", func(db *sql.DB) {
+		page := newTestPage(t, db, 1)
+		if err := SetImageChecksum(db, page.BookID, page.PageID, "abc"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, found, err := FindPageByChecksum(db, page.BookID, "abc")
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !found {
+			t.Fatalf("cannot find page by checksum")
+		}
+		if got.PageID != page.PageID || got.Checksum != "abc" {
+			t.Fatalf("invalid page: %v", got)
+		}
+		if _, found, _ := FindPageByChecksum(db, page.BookID, "xyz"); found {
+			t.Fatalf("found page with invalid checksum")
+		}
+	})
+}
+
+func TestFindPageByID(t *testing.T) {
+	sqlite.With("pages.sqlite", func(db *sql.DB) {
+		page := newTestPage(t, db, 1)
+		got, found, err := FindPageByID(db, page.BookID, page.PageID)
+		if err != nil || !found {
+			t.Fatalf("expected found; got found=%t, err=%v", found, err)
+		}
+		if *got != *page {
+			t.Fatalf("expected %v; got %v", page, got)
+		}
+		if _, found, _ := FindPageByID(db, page.BookID, page.PageID+1); found {
+			t.Fatalf("found invalid page")
+		}
+	})
+}
+
+func TestPageText(t *testing.T) {
+	sqlite.With("pages.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		page := newTestPage(t, db, 1)
+		lines := newTestPageLines(1, 3)
+		lines[1].Chars = nil // empty line
+		// insert in reverse order
+		lines[0], lines[2] = lines[2], lines[0]
+		if err := InsertLines(db, lines); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, err := PageText(db, page.BookID, page.PageID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		const want = "cor_100\n\ncor_102"
+		if got != want {
+			t.Fatalf("expected %q; got %q", want, got)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/finkf/pcwgo/api"
 )
@@ -46,12 +47,27 @@ func CreateTableProjects(db DB) error {
 	return err
 }
 
+// APIBook converts the project to an api.Book.  A project is a book
+// (IsBook is set) if it is the book's own project, i.e. if its project
+// id is the id of the book.  Projects that were split from a book
+// reference the pages of their origin book and are not books.
+func (p Project) APIBook() api.Book {
+	b := p.Book.APIBook()
+	b.ProjectID = p.ProjectID
+	b.Pages = p.Pages
+	b.IsBook = p.ProjectID == p.BookID
+	return b
+}
+
 // CreateAllTables creates all tables in the right order. The order
 // is: users -> projects -> books -> pages -> lines.
 func CreateAllTables(db DB) error {
 	if err := CreateTableUsers(db); err != nil {
 		return fmt.Errorf("cannot create table %s: %v", UsersTableName, err)
 	}
+	if err := CreateTableCoordinators(db); err != nil {
+		return fmt.Errorf("cannot create table %s: %v", CoordinatorsTableName, err)
+	}
 	if err := CreateTableProjects(db); err != nil {
 		return fmt.Errorf("cannot create table %s: %v", ProjectsTableName, err)
 	}
@@ -88,17 +104,172 @@ func InsertProject(db DB, p *Project) error {
 	return nil
 }
 
+// UpdateProject updates the owner and the number of pages of the
+// given project.  The new owner must exist.
+func UpdateProject(db DB, p *Project) error {
+	if err := checkOwner(db, p.Owner.ID); err != nil {
+		return fmt.Errorf("cannot update project %d: %v", p.ProjectID, err)
+	}
+	const stmt = "UPDATE " + ProjectsTableName + " SET Owner=?,Pages=? WHERE ID=?"
+	_, err := Exec(db, stmt, p.Owner.ID, p.Pages, p.ProjectID)
+	return err
+}
+
+// SetProjectOwner transfers the project with the given id to the
+// given owner.  The new owner must exist.
+func SetProjectOwner(db DB, projectID int, owner int64) error {
+	if err := checkOwner(db, owner); err != nil {
+		return fmt.Errorf("cannot set owner of project %d: %v", projectID, err)
+	}
+	const stmt = "UPDATE " + ProjectsTableName + " SET Owner=? WHERE ID=?"
+	_, err := Exec(db, stmt, owner, projectID)
+	return err
+}
+
+// SetProjectOrigin sets the origin of the project with the given id
+// to the book with the given id (e.g. after the book was re-OCRed into
+// a new book).  The new book must exist.  The project's pages are not
+// changed; use SetProjectOriginWithPages to re-map them to the pages
+// of the new book.
+func SetProjectOrigin(db DB, projectID, newBookID int) error {
+	return setProjectOrigin(db, projectID, newBookID, false)
+}
+
+// SetProjectOriginWithPages sets the origin of the project like
+// SetProjectOrigin and re-maps the project's pages to the pages of the
+// new book by their sequence: the pages of both books are ordered by
+// their page ids and the n-th page of the old book is mapped to the
+// n-th page of the new book.  It is an error if a page of the project
+// has no counterpart in the new book.  The origin and the pages are
+// updated in one transaction.
+func SetProjectOriginWithPages(db DB, projectID, newBookID int) error {
+	return setProjectOrigin(db, projectID, newBookID, true)
+}
+
+func setProjectOrigin(db DB, projectID, newBookID int, remap bool) error {
+	const stmt = "UPDATE " + ProjectsTableName + " SET Origin=? WHERE ID=?"
+	ok, err := BookExists(db, newBookID)
+	if err != nil {
+		return fmt.Errorf("cannot set origin of project %d: %v", projectID, err)
+	}
+	if !ok {
+		return fmt.Errorf("cannot set origin of project %d: no such book id: %d",
+			projectID, newBookID)
+	}
+	t := NewTransaction(Begin(db))
+	if remap {
+		t.Do(func(db DB) error { return remapProjectPages(db, projectID, newBookID) })
+	}
+	t.Do(func(db DB) error {
+		_, err := Exec(db, stmt, newBookID, projectID)
+		return err
+	})
+	return t.Done()
+}
+
+// remapProjectPages maps the pages of the given project to the pages
+// of the given new book (see SetProjectOriginWithPages).
+func remapProjectPages(db DB, projectID, newBookID int) error {
+	const stmt1 = "SELECT Origin FROM " + ProjectsTableName + " WHERE ID=?"
+	const stmt2 = "SELECT PageID FROM " + PagesTableName + " WHERE BookID=? ORDER BY PageID"
+	const stmt3 = "DELETE FROM " + ProjectPagesTableName + " WHERE ProjectID=?"
+	const stmt4 = "INSERT INTO " + ProjectPagesTableName + "(ProjectID,PageID) VALUES"
+	origin, err := findIDs(db, stmt1, projectID)
+	if err != nil {
+		return err
+	}
+	if len(origin) == 0 {
+		return fmt.Errorf("cannot map pages of project %d: no such project", projectID)
+	}
+	oldPages, err := findIDs(db, stmt2, origin[0])
+	if err != nil {
+		return err
+	}
+	newPages, err := findIDs(db, stmt2, newBookID)
+	if err != nil {
+		return err
+	}
+	seq := make(map[int]int, len(oldPages))
+	for i, id := range oldPages {
+		seq[id] = i
+	}
+	pages, err := FindProjectPages(db, projectID)
+	if err != nil {
+		return err
+	}
+	rows := make([][]interface{}, len(pages))
+	for i, id := range pages {
+		n, ok := seq[id]
+		if !ok || n >= len(newPages) {
+			return fmt.Errorf("cannot map page %d of project %d to book %d",
+				id, projectID, newBookID)
+		}
+		rows[i] = []interface{}{projectID, newPages[n]}
+	}
+	if _, err := Exec(db, stmt3, projectID); err != nil {
+		return err
+	}
+	return insertRows(db, stmt4, rows)
+}
+
+// findIDs returns the ids that are returned by the given query.
+func findIDs(db DB, stmt string, args ...interface{}) ([]int, error) {
+	rows, err := Query(db, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return getIDs(rows)
+}
+
+func checkOwner(db DB, owner int64) error {
+	_, found, err := FindUserByID(db, owner)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("invalid owner: no such user id: %d", owner)
+	}
+	return nil
+}
+
+// selectProjectStmt selects the projects with their books and owners.
+// The owners are LEFT JOINed, so that projects whose owner does not
+// exist anymore are still found (with a zero owner).  All owner
+// columns are NULL-safe.  Projects without a book are never found.
+const selectProjectStmt = "SELECT p.ID,p.Pages," +
+	"b.BookID,b.Year,b.Author,b.Title,b.Description,b.URI," +
+	"COALESCE(b.ProfilerURL,''),b.Directory,b.Lang,b.ocr_model," +
+	"b.profiled,b.extendedlexicon,b.postcorrected,b.pooled," +
+	"COALESCE(u.ID,0),COALESCE(u.Name,''),COALESCE(u.Email,'')," +
+	"COALESCE(u.Institute,''),COALESCE(u.Admin,false) " +
+	"FROM " + ProjectsTableName + " p LEFT JOIN " + UsersTableName +
+	" u ON p.Owner=u.ID JOIN " + BooksTableName + " b ON p.Origin=b.BookID "
+
 // FindProjectByID searches for a project with the given id.
 func FindProjectByID(db DB, id int) (*Project, bool, error) {
-	const stmt = "SELECT p.ID,p.Pages," +
-		"b.BookID,b.Year,b.Author,b.Title,b.Description,b.URI," +
-		"COALESCE(b.ProfilerURL,''),b.Directory,b.Lang," +
-		"b.profiled,b.extendedlexicon,b.postcorrected," +
-		"u.ID,u.Name,u.Email,u.Institute,u.Admin " +
-		"FROM " + ProjectsTableName + " p JOIN " + UsersTableName +
-		" u ON p.Owner=u.ID JOIN " + BooksTableName + " b ON p.Origin=b.BookID " +
-		"WHERE p.ID=?"
-	rows, err := Query(db, stmt, id)
+	const stmt = selectProjectStmt + "WHERE p.ID=?"
+	return selectProject(db, stmt, id)
+}
+
+// ProjectExists returns true if the project with the given id exists.
+// It is cheaper than FindProjectByID, since the project is not loaded.
+func ProjectExists(db DB, id int) (bool, error) {
+	const stmt = "SELECT 1 FROM " + ProjectsTableName + " WHERE ID=? LIMIT 1"
+	return exists(db, stmt, id)
+}
+
+// FindProjectByBookID searches for the project of the book with the
+// given book id.  The project of a book is the project whose id is the
+// book id and whose origin is the book itself.  Projects created by
+// splitting a book are never returned.
+func FindProjectByBookID(db DB, bookID int) (*Project, bool, error) {
+	const stmt = selectProjectStmt + "WHERE p.ID=p.Origin AND p.Origin=?"
+	return selectProject(db, stmt, bookID)
+}
+
+func selectProject(db DB, stmt string, args ...interface{}) (*Project, bool, error) {
+	rows, err := Query(db, stmt, args...)
 	if err != nil {
 		return nil, false, err
 	}
@@ -116,15 +287,7 @@ func FindProjectByID(db DB, id int) (*Project, bool, error) {
 // FindProjectByOwner searches for all projects owned by the given
 // user ID.
 func FindProjectByOwner(db DB, owner int64) ([]Project, error) {
-	const stmt = "SELECT p.ID,p.Pages," +
-		"b.BookID,b.Year,b.Author,b.Title,b.Description,b.URI," +
-		"COALESCE(b.ProfilerURL,''),b.Directory,b.Lang," +
-		"b.profiled,b.extendedlexicon,b.postcorrected," +
-		"u.ID,u.Name,u.Email,u.Institute,u.Admin " +
-		"FROM " + ProjectsTableName + " p JOIN " + UsersTableName +
-		" u ON p.Owner=u.ID JOIN " + BooksTableName +
-		" b ON p.Origin=b.BookID " +
-		"WHERE p.Owner=?"
+	const stmt = selectProjectStmt + "WHERE p.Owner=?"
 	rows, err := Query(db, stmt, owner)
 	if err != nil {
 		return nil, err
@@ -140,11 +303,42 @@ func FindProjectByOwner(db DB, owner int64) ([]Project, error) {
 	return ps, nil
 }
 
+// FindProjectsByIDs loads the projects with the given ids using one
+// query.  The found projects are mapped by their ids; missing projects
+// are not contained in the result.
+func FindProjectsByIDs(db DB, ids []int) (map[int]*Project, error) {
+	ps := make(map[int]*Project, len(ids))
+	if len(ids) == 0 {
+		return ps, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	stmt := selectProjectStmt + "WHERE p.ID IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
+	rows, err := Query(db, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Project
+		if err := scanProject(rows, &p); err != nil {
+			return nil, err
+		}
+		ps[p.ProjectID] = &p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
 func scanProject(rows *sql.Rows, p *Project) error {
 	var pr, e, c bool
 	err := rows.Scan(&p.ProjectID, &p.Pages,
 		&p.BookID, &p.Year, &p.Author, &p.Title, &p.Description, &p.URI,
-		&p.ProfilerURL, &p.Directory, &p.Lang, &pr, &e, &c,
+		&p.ProfilerURL, &p.Directory, &p.Lang, &p.OCRModel, &pr, &e, &c, &p.Pooled,
 		&p.Owner.ID, &p.Owner.Name, &p.Owner.Email,
 		&p.Owner.Institute, &p.Owner.Admin)
 	if err != nil {
@@ -186,6 +380,43 @@ func FindProjectPages(db DB, projectID int) ([]int, error) {
 	return getIDs(rows)
 }
 
+// PageStats holds the number of fully, partially and uncorrected lines
+// of a page.
+type PageStats struct {
+	Corrected, Partial, Uncorrected int
+}
+
+// PageCorrectionStats returns the correction stats of the pages of the
+// given project mapped by their page ids.  The stats are computed from
+// the fullycorrected and partiallycorrected flags of the lines (see
+// RecomputeLineFlags).  Lines without any characters count as
+// uncorrected.  Pages without lines are not contained in the result.
+func PageCorrectionStats(db DB, projectID int) (map[int]PageStats, error) {
+	const stmt = "SELECT t.PageID," +
+		"SUM(CASE WHEN t.fullycorrected THEN 1 ELSE 0 END)," +
+		"SUM(CASE WHEN t.partiallycorrected THEN 1 ELSE 0 END)," +
+		"SUM(CASE WHEN t.fullycorrected OR t.partiallycorrected THEN 0 ELSE 1 END) " +
+		"FROM " + ProjectPagesTableName + " pp " +
+		"JOIN " + ProjectsTableName + " p ON p.ID=pp.ProjectID " +
+		"JOIN " + TextLinesTableName + " t ON t.BookID=p.Origin AND t.PageID=pp.PageID " +
+		"WHERE pp.ProjectID=? GROUP BY t.PageID"
+	rows, err := Query(db, stmt, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make(map[int]PageStats)
+	for rows.Next() {
+		var id int
+		var s PageStats
+		if err := rows.Scan(&id, &s.Corrected, &s.Partial, &s.Uncorrected); err != nil {
+			return nil, err
+		}
+		stats[id] = s
+	}
+	return stats, rows.Err()
+}
+
 func getIDs(rows *sql.Rows) ([]int, error) {
 	var ids []int
 	for rows.Next() {
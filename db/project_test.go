@@ -85,6 +85,79 @@ func TestFindProjectByID(t *testing.T) {
 	})
 }
 
+func TestFindProjectByBookID(t *testing.T) {
+	withProjectDB(t, func(db *sql.DB) {
+		got, found, err := FindProjectByBookID(db, p1.BookID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !found || got.ProjectID != p1.ProjectID {
+			t.Fatalf("expected project %d; got %v (found=%t)", p1.ProjectID, got, found)
+		}
+		// without the book's own project, split projects must not be found
+		const stmt = "DELETE FROM " + ProjectsTableName + " WHERE ID=?"
+		if _, err := db.Exec(stmt, p1.ProjectID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, found, err = FindProjectByBookID(db, p1.BookID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if found {
+			t.Fatalf("expected no project; got %v", got)
+		}
+	})
+}
+
+func TestFindProjectNullOwner(t *testing.T) {
+	sqlite.With("projects.sqlite", func(db *sql.DB) {
+		// legacy users table with a nullable institute column
+		const stmt = "CREATE TABLE " + UsersTableName + "(" +
+			"ID INTEGER NOT NULL PRIMARY KEY,Name VARCHAR(255) NOT NULL," +
+			"Institute VARCHAR(255),Email VARCHAR(255) NOT NULL UNIQUE," +
+			"Hash VARCHAR(128),Salt VARCHAR(64),Admin BOOLEAN DEFAULT(false) NOT NULL)"
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := CreateTableUsers(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := CreateTableProjects(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if _, err := db.Exec("INSERT INTO " + UsersTableName +
+			"(ID,Name,Email,Institute) VALUES(1,'name','email',NULL)"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		user := api.User{ID: 1, Name: "name", Email: "email"}
+		book := newTestBook(t, db, 1)
+		p1 := newTestProject(t, db, 1, book, &user)
+		p2 := newTestProject(t, db, 2, book, &user)
+		if _, err := db.Exec("UPDATE "+ProjectsTableName+" SET Owner=42 WHERE ID=?",
+			p2.ProjectID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		tests := []struct {
+			id   int
+			want api.User
+		}{
+			{p1.ProjectID, user},
+			{p2.ProjectID, api.User{}}, // missing owner
+		}
+		for _, tc := range tests {
+			t.Run(strconv.Itoa(tc.id), func(t *testing.T) {
+				got, found, err := FindProjectByID(db, tc.id)
+				if err != nil || !found {
+					t.Fatalf("expected found; got found=%t, err=%v", found, err)
+				}
+				if got.Owner != tc.want {
+					t.Fatalf("expected owner %v; got %v", tc.want, got.Owner)
+				}
+			})
+		}
+	})
+}
+
 func TestFindProjectByUser(t *testing.T) {
 	withProjectDB(t, func(db *sql.DB) {
 		tests := []struct {
@@ -108,3 +181,209 @@ func TestFindProjectByUser(t *testing.T) {
 		}
 	})
 }
+
+func TestFindProjectsByIDs(t *testing.T) {
+	withProjectDB(t, func(db *sql.DB) {
+		tests := []struct {
+			name string
+			ids  []int
+			want []*Project
+		}{
+			{"none", nil, nil},
+			{"all", []int{p1.ProjectID, p2.ProjectID, p3.ProjectID}, []*Project{p1, p2, p3}},
+			{"mixed", []int{p3.ProjectID, 999, p1.ProjectID, p1.ProjectID}, []*Project{p1, p3}},
+			{"missing", []int{998, 999}, nil},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				got, err := FindProjectsByIDs(db, tc.ids)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if len(got) != len(tc.want) {
+					t.Fatalf("expected %d projects; got %d", len(tc.want), len(got))
+				}
+				for _, want := range tc.want {
+					p, ok := got[want.ProjectID]
+					if !ok {
+						t.Fatalf("cannot find project %d", want.ProjectID)
+					}
+					if p.String() != want.String() {
+						t.Fatalf("expected %s; got %s", want, p)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestSetProjectOwner(t *testing.T) {
+	withProjectDB(t, func(db *sql.DB) {
+		if err := SetProjectOwner(db, p1.ProjectID, u3.ID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, found, err := FindProjectByID(db, p1.ProjectID)
+		if err != nil || !found {
+			t.Fatalf("cannot find project: %t (%v)", found, err)
+		}
+		if got.Owner != *u3 {
+			t.Fatalf("expected owner %s; got %s", u3, got.Owner)
+		}
+		if err := SetProjectOwner(db, p1.ProjectID, u3.ID+100); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestUpdateProject(t *testing.T) {
+	withProjectDB(t, func(db *sql.DB) {
+		p := *p3
+		p.Owner = *u1
+		p.Pages = 42
+		if err := UpdateProject(db, &p); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, found, err := FindProjectByID(db, p.ProjectID)
+		if err != nil || !found {
+			t.Fatalf("cannot find project: %t (%v)", found, err)
+		}
+		if got.String() != p.String() {
+			t.Fatalf("expected project %s; got %s", p, got)
+		}
+		p.Owner.ID = u3.ID + 100
+		if err := UpdateProject(db, &p); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestProjectAndBookExists(t *testing.T) {
+	withProjectDB(t, func(db *sql.DB) {
+		tests := []struct {
+			name   string
+			exists func(DB, int) (bool, error)
+			id     int
+			want   bool
+		}{
+			{"project", ProjectExists, p1.ProjectID, true},
+			{"project", ProjectExists, p3.ProjectID, true},
+			{"project", ProjectExists, p3.ProjectID + 1, false},
+			{"book", BookExists, p1.BookID, true},
+			{"book", BookExists, p1.BookID + 100, false},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name+"-"+strconv.Itoa(tc.id), func(t *testing.T) {
+				got, err := tc.exists(db, tc.id)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if got != tc.want {
+					t.Fatalf("expected %t; got %t", tc.want, got)
+				}
+			})
+		}
+	})
+}
+
+func TestPageCorrectionStats(t *testing.T) {
+	sqlite.With("projects.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		page := newTestPage(t, db, 1)
+		book, _, err := FindBookByID(db, page.BookID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		project := newTestProject(t, db, 1, book, nil)
+		const stmt = "INSERT INTO " + ProjectPagesTableName + " (ProjectID,PageID) VALUES (?,?)"
+		for _, id := range []int{1, 2} {
+			if _, err := db.Exec(stmt, project.ProjectID, id); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		lines := newTestPageLines(1, 4) // all chars corrected
+		lines[1].Chars[0].Cor = 0       // partially corrected
+		for i := range lines[2].Chars { // uncorrected
+			lines[2].Chars[i].Cor = 0
+		}
+		lines[3].Chars = nil // empty line
+		page2 := newTestPageLines(1, 1)
+		page2[0].PageID = 2
+		if err := InsertLines(db, append(lines, page2...)); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got, err := PageCorrectionStats(db, project.ProjectID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want := map[int]PageStats{
+			1: {Corrected: 1, Partial: 1, Uncorrected: 2},
+			2: {Corrected: 1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+	})
+}
+
+func TestSetProjectOrigin(t *testing.T) {
+	sqlite.With("projects.sqlite", func(db *sql.DB) {
+		if err := CreateAllTables(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// book 1 with pages 1-3, book 2 with pages 11-13, book 3 with page 21
+		for _, ids := range [][]int{{1, 1, 2, 3}, {2, 11, 12, 13}, {3, 21}} {
+			newTestBook(t, db, ids[0])
+			for _, id := range ids[1:] {
+				if err := InsertPage(db, &Page{BookID: ids[0], PageID: id}); err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+			}
+		}
+		book, _, err := FindBookByID(db, 1)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		project := newTestProject(t, db, 1, book, nil)
+		const stmt = "INSERT INTO " + ProjectPagesTableName + " (ProjectID,PageID) VALUES (?,?)"
+		for _, id := range []int{2, 3} {
+			if _, err := db.Exec(stmt, project.ProjectID, id); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		checkOrigin := func(bookID int, pages []int) {
+			t.Helper()
+			got, found, err := FindBookByProjectID(db, project.ProjectID)
+			if err != nil || !found {
+				t.Fatalf("cannot find book: %t (%v)", found, err)
+			}
+			if got.BookID != bookID {
+				t.Fatalf("expected book %d; got %d", bookID, got.BookID)
+			}
+			ids, err := FindProjectPages(db, project.ProjectID)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !reflect.DeepEqual(ids, pages) {
+				t.Fatalf("expected pages %v; got %v", pages, ids)
+			}
+		}
+		// errors: no such book; page 3 has no counterpart in book 3
+		if err := SetProjectOrigin(db, project.ProjectID, 42); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if err := SetProjectOriginWithPages(db, project.ProjectID, 3); err == nil {
+			t.Fatalf("expected an error")
+		}
+		checkOrigin(1, []int{2, 3})
+		if err := SetProjectOriginWithPages(db, project.ProjectID, 2); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		checkOrigin(2, []int{12, 13})
+		if err := SetProjectOrigin(db, project.ProjectID, 3); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		checkOrigin(3, []int{12, 13})
+	})
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// ResetTokenLength defines the length of password reset tokens.
+const ResetTokenLength = 32
+
+// ResetTokensTableName defines the name of the reset tokens table.
+const ResetTokensTableName = "reset_tokens"
+
+var resetTokensTable = "" +
+	ResetTokensTableName + " (" +
+	"Hash CHAR(" + strconv.Itoa(sha256.Size*2) + ") NOT NULL PRIMARY KEY," +
+	"UserID INTEGER NOT NULL REFERENCES " + UsersTableName + "(ID)," +
+	"Expires INTEGER NOT NULL" +
+	")"
+
+// CreateTableResetTokens creates the reset tokens table if it does
+// not already exist.
+func CreateTableResetTokens(db DB) error {
+	_, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+resetTokensTable)
+	return err
+}
+
+// NewResetToken creates a new password reset token for the user with
+// the given id that expires after the given duration.  The token is
+// generated with TokenSource.  Only a hash of the token is stored, so
+// the returned token cannot be recovered from the database.
+func NewResetToken(db DB, userID int64, ttl time.Duration) (string, error) {
+	const stmt = "INSERT INTO " + ResetTokensTableName + "(Hash,UserID,Expires) VALUES(?,?,?)"
+	token, err := TokenSource(ResetTokenLength)
+	if err != nil {
+		return "", err
+	}
+	if _, err := Exec(db, stmt, hashResetToken(token), userID, time.Now().Add(ttl).Unix()); err != nil {
+		return "", newDBError("insert", ResetTokensTableName, err)
+	}
+	return token, nil
+}
+
+// ConsumeResetToken validates the given password reset token and
+// returns the id of its user.  A token can only be consumed once.  If
+// the token does not exist, was already consumed or has expired,
+// false is returned.
+func ConsumeResetToken(db DB, token string) (int64, bool, error) {
+	const stmt1 = "SELECT UserID,Expires FROM " + ResetTokensTableName + " WHERE Hash=?"
+	const stmt2 = "DELETE FROM " + ResetTokensTableName + " WHERE Hash=?"
+	hash := hashResetToken(token)
+	var userID, expires int64
+	var found bool
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		rows, err := Query(db, stmt1, hash)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return rows.Err()
+		}
+		found = true
+		return rows.Scan(&userID, &expires)
+	})
+	t.Do(func(db DB) error {
+		if !found {
+			return nil
+		}
+		// the token is deleted even if it has expired
+		res, err := Exec(db, stmt2, hash)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		found = n == 1 // not consumed concurrently
+		return nil
+	})
+	if err := t.Done(); err != nil {
+		return 0, false, err
+	}
+	if !found || expires < time.Now().Unix() {
+		return 0, false, nil
+	}
+	return userID, true, nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/finkf/pcwgo/api"
+)
+
+func withResetTokens(t *testing.T, f func(*sql.DB, api.User)) {
+	user := api.User{Name: "test", Email: "test@example.com"}
+	withTestUser(t, &user, func(db *sql.DB) {
+		if err := CreateTableResetTokens(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		f(db, user)
+	})
+}
+
+func TestResetToken(t *testing.T) {
+	withResetTokens(t, func(db *sql.DB, user api.User) {
+		token, err := NewResetToken(db, user.ID, time.Hour)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(token) != ResetTokenLength {
+			t.Fatalf("expected token of length %d; got %q", ResetTokenLength, token)
+		}
+		other, err := NewResetToken(db, user.ID, time.Hour)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if other == token {
+			t.Fatalf("expected different tokens; got %q", token)
+		}
+		if _, found, err := ConsumeResetToken(db, "invalid"); err != nil || found {
+			t.Fatalf("expected not found; got found=%t, err=%v", found, err)
+		}
+		id, found, err := ConsumeResetToken(db, token)
+		if err != nil || !found {
+			t.Fatalf("expected found; got found=%t, err=%v", found, err)
+		}
+		if id != user.ID {
+			t.Fatalf("expected user id %d; got %d", user.ID, id)
+		}
+		// tokens can only be used once
+		if _, found, err := ConsumeResetToken(db, token); err != nil || found {
+			t.Fatalf("expected not found; got found=%t, err=%v", found, err)
+		}
+		if _, found, err := ConsumeResetToken(db, other); err != nil || !found {
+			t.Fatalf("expected found; got found=%t, err=%v", found, err)
+		}
+	})
+}
+
+func TestResetTokenExpired(t *testing.T) {
+	withResetTokens(t, func(db *sql.DB, user api.User) {
+		token, err := NewResetToken(db, user.ID, -time.Second)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if _, found, err := ConsumeResetToken(db, token); err != nil || found {
+			t.Fatalf("expected expired token; got found=%t, err=%v", found, err)
+		}
+		// expired tokens are deleted
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + ResetTokensTableName).Scan(&n); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if n != 0 {
+			t.Fatalf("expected no tokens; got %d", n)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"math/big"
 	"strconv"
 	"time"
@@ -26,6 +27,11 @@ var sessionsTable = "" +
 	"Expires INTEGER NOT NULL" +
 	")"
 
+// TokenSource is used to generate new auth tokens of length n.  It
+// defaults to a cryptographically secure random generator.  Tests can
+// override it with a deterministic generator.
+var TokenSource func(n int) (string, error) = genAuth
+
 // CreateTableSessions creates the sessions table.
 func CreateTableSessions(db DB) error {
 	stmt := "CREATE TABLE IF NOT EXISTS " + sessionsTable + ";"
@@ -36,7 +42,7 @@ func CreateTableSessions(db DB) error {
 // InsertSession creates a new unique session for the given user in
 // the database and returns the new session.
 func InsertSession(db DB, u api.User) (*api.Session, error) {
-	auth, err := genAuth()
+	auth, err := TokenSource(IDLength)
 	if err != nil {
 		return nil, err
 	}
@@ -66,11 +72,51 @@ func DeleteSessionByUserID(db DB, id int64) error {
 	return err
 }
 
+// DeleteSessionByAuth deletes the session with the given auth token.
+func DeleteSessionByAuth(db DB, auth string) error {
+	const stmt = "DELETE FROM " + SessionsTableName + " WHERE Auth=?"
+	_, err := Exec(db, stmt, auth)
+	return err
+}
+
+// DeleteExpiredSessions deletes all expired sessions and returns the
+// number of deleted sessions.
+func DeleteExpiredSessions(db DB) (int64, error) {
+	const stmt = "DELETE FROM " + SessionsTableName + " WHERE Expires<?"
+	res, err := Exec(db, stmt, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// FindSessionsByUser returns all non-expired sessions of the given
+// user ID.
+func FindSessionsByUser(db DB, userID int64) ([]api.Session, error) {
+	const stmt = selectSessionStmt + " WHERE s.UserID=? AND s.Expires>=?"
+	rows, err := Query(db, stmt, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []api.Session
+	for rows.Next() {
+		var s api.Session
+		if err := scanSession(rows, &s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+const selectSessionStmt = "" +
+	"SELECT s.Auth,s.Expires,u.ID,u.Name,u.Email,u.Institute,u.Admin " +
+	"FROM " + SessionsTableName + " s JOIN " +
+	UsersTableName + " u ON s.UserID=u.ID"
+
 func selectSession(db DB, id string) (*api.Session, bool, error) {
-	const stmt = "" +
-		"SELECT s.Auth,s.Expires,u.ID,u.Name,u.Email,u.Institute,u.Admin " +
-		"FROM " + SessionsTableName + " s JOIN " +
-		UsersTableName + " u ON s.UserID=u.ID WHERE s.Auth=?"
+	const stmt = selectSessionStmt + " WHERE s.Auth=?"
 	rows, err := Query(db, stmt, id)
 	if err != nil {
 		return nil, false, err
@@ -80,22 +126,26 @@ func selectSession(db DB, id string) (*api.Session, bool, error) {
 		return nil, false, nil
 	}
 	var s api.Session
-	if err = rows.Scan(&s.Auth, &s.Expires, &s.User.ID, &s.User.Name,
-		&s.User.Email, &s.User.Institute, &s.User.Admin); err != nil {
+	if err = scanSession(rows, &s); err != nil {
 		return nil, false, err
 	}
 	return &s, true, nil
 }
 
+func scanSession(rows *sql.Rows, s *api.Session) error {
+	return rows.Scan(&s.Auth, &s.Expires, &s.User.ID, &s.User.Name,
+		&s.User.Email, &s.User.Institute, &s.User.Admin)
+}
+
 const sessionIDchars = "" +
 	"abcdefghijklmnopqrstuvwxyz" +
 	"ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
 	"012345678"
 
-func genAuth() (string, error) {
-	id := make([]byte, IDLength)
+func genAuth(n int) (string, error) {
+	id := make([]byte, n)
 	max := big.NewInt(int64(len(sessionIDchars)))
-	for i := 0; i < IDLength; i++ {
+	for i := 0; i < n; i++ {
 		n, err := rand.Int(rand.Reader, max)
 		if err != nil {
 			return "", err
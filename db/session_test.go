@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"strings"
 	"testing"
 
 	"github.com/finkf/pcwgo/api"
@@ -56,3 +57,71 @@ func TestInsertSession(t *testing.T) {
 		}
 	})
 }
+
+func TestInsertSessionTokenSource(t *testing.T) {
+	withTableSessions(func(db *sql.DB) {
+		defer func(f func(int) (string, error)) { TokenSource = f }(TokenSource)
+		TokenSource = func(n int) (string, error) {
+			return strings.Repeat("x", n), nil
+		}
+		user := api.User{Name: "test", Email: "test@example.com"}
+		if err := InsertUser(db, &user); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		s, err := InsertSession(db, user)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		want := strings.Repeat("x", IDLength)
+		if s.Auth != want {
+			t.Fatalf("expected auth %s; got %s", want, s.Auth)
+		}
+		if _, found, err := FindSessionByID(db, want); err != nil || !found {
+			t.Fatalf("cannot find session %s: %t (%v)", want, found, err)
+		}
+	})
+}
+
+func TestFindSessionsByUser(t *testing.T) {
+	withTableSessions(func(db *sql.DB) {
+		user := api.User{Name: "test", Email: "test@example.com"}
+		if err := InsertUser(db, &user); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var auths []string
+		for i := 0; i < 3; i++ {
+			s, err := InsertSession(db, user)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			auths = append(auths, s.Auth)
+		}
+		// expired sessions must not be returned
+		const stmt = "INSERT INTO " + SessionsTableName + "(Auth,UserID,Expires)values(?,?,?)"
+		if _, err := Exec(db, stmt, "expired", user.ID, 1); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		sessions, err := FindSessionsByUser(db, user.ID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(sessions) != 3 {
+			t.Fatalf("expected 3 sessions; got %d", len(sessions))
+		}
+		if err := DeleteSessionByAuth(db, auths[1]); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		sessions, err = FindSessionsByUser(db, user.ID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(sessions) != 2 {
+			t.Fatalf("expected 2 sessions; got %d", len(sessions))
+		}
+		for _, s := range sessions {
+			if s.Auth == auths[1] {
+				t.Fatalf("session %s was not revoked", s.Auth)
+			}
+		}
+	})
+}
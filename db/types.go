@@ -16,7 +16,7 @@ const (
 )
 
 var typesTable = TypesTableName + "(" +
-	TypesTableID + " int not null unique primary key auto_increment," +
+	TypesTableID + " INTEGER NOT NULL PRIMARY KEY /*!40101 AUTO_INCREMENT */," +
 	TypesTableType + " varchar(" + strconv.Itoa(MaxType) + ") not null unique" +
 	");"
 
@@ -26,16 +26,31 @@ func CreateTableTypes(db DB) error {
 	return err
 }
 
+// truncateRunes truncates the given string to at most max runes.  The
+// string is cut at rune boundaries, so the result is valid UTF-8 if
+// the given string is valid UTF-8.
+func truncateRunes(str string, max int) string {
+	n := 0
+	for i := range str {
+		if n == max {
+			return str[:i]
+		}
+		n++
+	}
+	return str
+}
+
 // NewType inserts a new (string-) type into the types tables and
 // returns its id.  If the type does already exist in the table, the
 // id of the existing string is returned and nothing is inserted into
-// the table.  All types are converted to lowercase.
+// the table.  All types are converted to lowercase and truncated to
+// MaxType runes.
 //
 // An additional map can be supplied to speed up the creation of
 // types.  A nil map can be supplied.
 func NewType(db DB, str string, ids map[string]int) (int, error) {
 	// convert type to lower case
-	str = strings.ToLower(str)
+	str = truncateRunes(strings.ToLower(str), MaxType)
 	// check if id is in the map already
 	if id, ok := ids[str]; ok {
 		return id, nil
@@ -73,6 +88,62 @@ func NewType(db DB, str string, ids map[string]int) (int, error) {
 	return int(id), err
 }
 
+// UpsertType returns the id of the given (string-) type.  If the type
+// does not yet exist, it is inserted into the types table.  All types
+// are converted to lowercase and truncated to MaxType runes.
+//
+// Other than NewType, UpsertType is safe to be used concurrently.
+// The type is inserted with a single upsert statement:  MySQL uses
+// INSERT ... ON DUPLICATE KEY UPDATE to report the id of an existing
+// type, sqlite uses INSERT OR IGNORE followed by a lookup of the id.
+func UpsertType(db DB, str string) (int, error) {
+	str = truncateRunes(strings.ToLower(str), MaxType)
+	if isSQLite(db) {
+		const stmt = "INSERT OR IGNORE INTO " + TypesTableName +
+			" (" + TypesTableType + ") VALUES (?)"
+		if _, err := Exec(db, stmt, str); err != nil {
+			return 0, fmt.Errorf("cannot upsert type %s: %v", str, err)
+		}
+		id, found, err := findTypeID(db, str)
+		if err != nil {
+			return 0, fmt.Errorf("cannot upsert type %s: %v", str, err)
+		}
+		if !found {
+			return 0, fmt.Errorf("cannot upsert type %s: no such type", str)
+		}
+		return id, nil
+	}
+	const stmt = "INSERT INTO " + TypesTableName + " (" + TypesTableType + ") VALUES (?)" +
+		" ON DUPLICATE KEY UPDATE " + TypesTableID + "=LAST_INSERT_ID(" + TypesTableID + ")"
+	res, err := Exec(db, stmt, str)
+	if err != nil {
+		return 0, fmt.Errorf("cannot upsert type %s: %v", str, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("cannot upsert type %s: %v", str, err)
+	}
+	return int(id), nil
+}
+
+func findTypeID(db DB, str string) (int, bool, error) {
+	const stmt = "SELECT " + TypesTableID + " FROM " + TypesTableName +
+		" WHERE " + TypesTableType + "=?"
+	rows, err := Query(db, stmt, str)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, false, rows.Err()
+	}
+	var id int
+	if err := rows.Scan(&id); err != nil {
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
 // Names of the suggestions table columns.
 const (
 	SuggestionsTableName             = "suggestions"
@@ -134,8 +205,10 @@ func NewTypeInserter(db *sql.DB) (*TypeInserter, error) {
 }
 
 // ID returns the id of a given type.  If the type does not yet exist,
-// it is inserted into the database.
+// it is inserted into the database.  Types are truncated to MaxType
+// runes.
 func (t *TypeInserter) ID(typ string) (int, error) {
+	typ = truncateRunes(typ, MaxType)
 	// Cached?
 	if id, ok := t.ids[typ]; ok {
 		return id, nil
@@ -183,3 +256,78 @@ func (t *TypeInserter) Close() (err error) {
 	}()
 	return nil
 }
+
+// TypesByIDs returns the type strings for the given type IDs.  IDs
+// that cannot be found are not contained in the returned map.  All
+// types are looked up using one query.
+func TypesByIDs(db DB, ids []int) (map[int]string, error) {
+	types := make(map[int]string, len(ids))
+	if len(ids) == 0 {
+		return types, nil
+	}
+	stmt := "SELECT " + TypesTableID + "," + TypesTableType + " FROM " + TypesTableName +
+		" WHERE " + TypesTableID + " IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := Query(db, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var typ string
+		if err := rows.Scan(&id, &typ); err != nil {
+			return nil, err
+		}
+		types[id] = typ
+	}
+	return types, nil
+}
+
+// TypeResolver resolves and caches type IDs.  It is meant to be used
+// for the lifetime of one request.  It is not safe for concurrent
+// use.
+type TypeResolver struct {
+	db    DB
+	types map[int]string
+}
+
+// NewTypeResolver creates a new TypeResolver with an empty cache.
+func NewTypeResolver(db DB) *TypeResolver {
+	return &TypeResolver{db: db, types: make(map[int]string)}
+}
+
+// Resolve looks up all given type IDs that are not yet cached using
+// one query.  Use Type to access the resolved types.
+func (r *TypeResolver) Resolve(ids ...int) error {
+	var missing []int
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if _, ok := r.types[id]; ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	types, err := TypesByIDs(r.db, missing)
+	if err != nil {
+		return fmt.Errorf("cannot resolve types: %v", err)
+	}
+	for id, typ := range types {
+		r.types[id] = typ
+	}
+	return nil
+}
+
+// Type returns the cached type string for the given ID.  It returns
+// false if the type was not resolved.
+func (r *TypeResolver) Type(id int) (string, bool) {
+	typ, ok := r.types[id]
+	return typ, ok
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/finkf/pcwgo/db/sqlite"
+)
+
+// queryCounter counts the number of queries.
+type queryCounter struct {
+	*sql.DB
+	n int
+}
+
+func (q *queryCounter) Query(stmt string, args ...interface{}) (*sql.Rows, error) {
+	q.n++
+	return q.DB.Query(stmt, args...)
+}
+
+func TestTypeResolver(t *testing.T) {
+	sqlite.With("types.sqlite", func(db *sql.DB) {
+		if err := CreateTableTypes(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var ids []int
+		for _, typ := range []string{"a", "b", "c"} {
+			id, err := NewType(db, typ, nil)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		// suggestions sharing type ids
+		refs := append(append(ids, ids...), ids[0], ids[1])
+		counter := &queryCounter{DB: db}
+		r := NewTypeResolver(counter)
+		if err := r.Resolve(refs...); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := r.Resolve(refs...); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if counter.n != 1 {
+			t.Fatalf("expected 1 query; got %d", counter.n)
+		}
+		for i, want := range []string{"a", "b", "c"} {
+			if got, ok := r.Type(ids[i]); !ok || got != want {
+				t.Fatalf("expected type %q; got %q", want, got)
+			}
+		}
+		if _, ok := r.Type(ids[2] + 1); ok {
+			t.Fatalf("found unresolved type")
+		}
+	})
+}
+
+// execBarrier blocks the first n calls to Exec until all n calls have
+// been issued.
+type execBarrier struct {
+	*sql.DB
+	mu sync.Mutex
+	n  int
+	wg sync.WaitGroup
+}
+
+func newExecBarrier(db *sql.DB, n int) *execBarrier {
+	b := &execBarrier{DB: db, n: n}
+	b.wg.Add(n)
+	return b
+}
+
+func (b *execBarrier) Exec(stmt string, args ...interface{}) (sql.Result, error) {
+	b.mu.Lock()
+	b.n--
+	wait := b.n >= 0
+	b.mu.Unlock()
+	if wait {
+		b.wg.Done()
+		b.wg.Wait()
+	}
+	return b.DB.Exec(stmt, args...)
+}
+
+func TestUpsertTypeConcurrent(t *testing.T) {
+	sqlite.With("types.sqlite", func(db *sql.DB) {
+		// sqlite does not support concurrent writers.
+		db.SetMaxOpenConns(1)
+		if err := CreateTableTypes(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// All goroutines miss the type and insert it concurrently.
+		const n = 10
+		barrier := newExecBarrier(db, n)
+		ids := make([]int, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ids[i], errs[i] = UpsertType(barrier, "Type")
+			}(i)
+		}
+		wg.Wait()
+		for i := range ids {
+			if errs[i] != nil {
+				t.Fatalf("got error: %v", errs[i])
+			}
+			if ids[i] != ids[0] {
+				t.Fatalf("expected id %d; got %d", ids[0], ids[i])
+			}
+		}
+		id, err := NewType(db, "type", nil)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if id != ids[0] {
+			t.Fatalf("expected id %d; got %d", ids[0], id)
+		}
+	})
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		str  string
+		max  int
+		want string
+	}{
+		{"", 3, ""},
+		{"abc", 3, "abc"},
+		{"abcd", 3, "abc"},
+		{"ſchön", 4, "ſchö"},
+		{"ſchön", 1, "ſ"},
+		{"ſchön", 0, ""},
+		{strings.Repeat("a", 49) + "ſchön", MaxType, strings.Repeat("a", 49) + "ſ"},
+		{strings.Repeat("ö", MaxType), MaxType, strings.Repeat("ö", MaxType)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.str, func(t *testing.T) {
+			got := truncateRunes(tc.str, tc.max)
+			if got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+			if !utf8.ValidString(got) {
+				t.Fatalf("invalid utf8: %q", got)
+			}
+		})
+	}
+}
+
+func TestNewTypeTruncate(t *testing.T) {
+	sqlite.With("types.sqlite", func(db *sql.DB) {
+		if err := CreateTableTypes(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		typ := strings.Repeat("ä", MaxType-1) + "ſchön"
+		want := strings.Repeat("ä", MaxType-1) + "ſ"
+		id, err := NewType(db, typ, nil)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		uid, err := UpsertType(db, typ)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if uid != id {
+			t.Fatalf("expected id %d; got %d", id, uid)
+		}
+		types, err := TypesByIDs(db, []int{id})
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if types[id] != want {
+			t.Fatalf("expected %q; got %q", want, types[id])
+		}
+	})
+}
@@ -4,9 +4,12 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/finkf/pcwgo/api"
 	"golang.org/x/crypto/scrypt"
@@ -30,27 +33,34 @@ var usersTable = "" +
 	"Email VARCHAR(255) NOT NULL UNIQUE," +
 	"Hash VARCHAR(" + strconv.Itoa(HashLength*2) + ")," +
 	"Salt VARCHAR(" + strconv.Itoa(SaltLength*2) + ")," +
-	"Admin BOOLEAN DEFAULT(false) NOT NULL" +
+	"Admin BOOLEAN DEFAULT(false) NOT NULL," +
+	"Deleted BOOLEAN DEFAULT(false) NOT NULL" +
 	")"
 
 // CreateTableUsers creates the users table if it does not already
-// exist.
+// exist.  Existing users tables are migrated to contain the Deleted
+// column.
 func CreateTableUsers(db DB) error {
-	_, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+usersTable)
-	return err
+	if _, err := Exec(db, "CREATE TABLE IF NOT EXISTS "+usersTable); err != nil {
+		return err
+	}
+	return addColumn(db, UsersTableName, "Deleted", "BOOLEAN DEFAULT(false) NOT NULL")
 }
 
 // InsertUser inserts a new user into the database.  The user's id is
-// adjusted accordingly.
+// always assigned by the database and adjusted accordingly.  Any id
+// that was set before the insertion is ignored.  Errors are returned
+// as *DBError; inserting a user with an existing email results in an
+// error of kind ErrorKindConflict.
 func InsertUser(db DB, user *api.User) error {
 	const stmt = "INSERT INTO " + UsersTableName + "(Name,Email,Institute,Admin) values(?,?,?,?)"
 	res, err := Exec(db, stmt, user.Name, user.Email, user.Institute, user.Admin)
 	if err != nil {
-		return err
+		return newDBError("insert", UsersTableName, err)
 	}
 	id, err := res.LastInsertId()
 	if err != nil {
-		return err
+		return newDBError("insert", UsersTableName, err)
 	}
 	user.ID = id
 	return nil
@@ -67,9 +77,16 @@ func SetUserPassword(db DB, user api.User, password string) error {
 	return err
 }
 
-// AuthenticateUser authenticates a user.
+// ErrPasswordNotSet is returned by AuthenticateUser if the user has
+// no password set.
+var ErrPasswordNotSet = errors.New("password not set")
+
+// AuthenticateUser authenticates a user.  If the user has not set a
+// password yet, ErrPasswordNotSet is returned.  Soft-deleted users
+// cannot be authenticated.
 func AuthenticateUser(db DB, user api.User, password string) error {
-	const stmt = "SELECT Hash,Salt FROM " + UsersTableName + " WHERE ID=?"
+	const stmt = "SELECT COALESCE(Hash,''),COALESCE(Salt,'') FROM " + UsersTableName +
+		" WHERE ID=? AND NOT Deleted"
 	rows, err := Query(db, stmt, user.ID)
 	if err != nil {
 		return err
@@ -82,6 +99,9 @@ func AuthenticateUser(db DB, user api.User, password string) error {
 	if err = rows.Scan(&hash, &salt); err != nil {
 		return fmt.Errorf("internal error: cannot scan row")
 	}
+	if hash == "" || salt == "" {
+		return ErrPasswordNotSet
+	}
 	saltb, err := hex.DecodeString(salt)
 	if err != nil {
 		return err
@@ -103,29 +123,135 @@ func UpdateUser(db DB, user api.User) error {
 	return err
 }
 
-// DeleteUserByID deletes a user by ID.
-func DeleteUserByID(db DB, id int64) error {
-	const stmt = "DELETE FROM " + UsersTableName + " WHERE ID=?"
-	_, err := Exec(db, stmt, id)
+// userFields maps the updatable user fields (see UpdateUserFields) to
+// their columns.
+var userFields = map[string]string{
+	"name":      "Name",
+	"email":     "Email",
+	"institute": "Institute",
+}
+
+// UpdateUserFields updates only the given fields of the user with the
+// given id.  The fields are given by their json names (`name`, `email`
+// and `institute`) and must be strings.  Unknown fields result in an
+// error and nothing is updated.  An empty map updates nothing.
+func UpdateUserFields(db DB, id int64, fields map[string]interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if _, ok := userFields[key]; !ok {
+			return fmt.Errorf("cannot update user id %d: invalid field %q", id, key)
+		}
+		if _, ok := fields[key].(string); !ok {
+			return fmt.Errorf("cannot update user id %d: invalid value for field %q", id, key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // stable statements
+	set := make([]string, len(keys))
+	args := make([]interface{}, 0, len(keys)+1)
+	for i, key := range keys {
+		set[i] = userFields[key] + "=?"
+		args = append(args, fields[key])
+	}
+	stmt := "UPDATE " + UsersTableName + " SET " + strings.Join(set, ",") + " WHERE ID=?"
+	_, err := Exec(db, stmt, append(args, id)...)
 	return err
 }
 
-// FindUserByID searches for a user by ID.
+// DeleteUserByID deletes a user by ID.  All sessions of the user are
+// deleted as well.  Users that still own projects cannot be deleted.
+// The sessions and projects tables must exist.
+func DeleteUserByID(db DB, id int64) error {
+	const stmt1 = "SELECT 1 FROM " + ProjectsTableName + " WHERE Owner=? LIMIT 1"
+	const stmt2 = "DELETE FROM " + UsersTableName + " WHERE ID=?"
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		rows, err := Query(db, stmt1, id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if rows.Next() {
+			return fmt.Errorf("cannot delete user id %d: user owns projects", id)
+		}
+		return nil
+	})
+	t.Do(func(db DB) error { return DeleteSessionByUserID(db, id) })
+	t.Do(func(db DB) error {
+		_, err := Exec(db, stmt2, id)
+		return err
+	})
+	return t.Done()
+}
+
+// SoftDeleteUser marks the user with the given id as deleted and
+// deletes all sessions of the user.  In contrast to DeleteUserByID
+// the user's row is kept, so the user's corrections and projects
+// still reference a valid user.  Soft-deleted users cannot log in and
+// are not listed by FindUserByEmail, FindAllUsers and SearchUsers.
+// The sessions table must exist.
+func SoftDeleteUser(db DB, id int64) error {
+	const stmt = "UPDATE " + UsersTableName + " SET Deleted=? WHERE ID=?"
+	t := NewTransaction(Begin(db))
+	t.Do(func(db DB) error {
+		res, err := Exec(db, stmt, true, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("cannot delete user id %d: no such user", id)
+		}
+		return nil
+	})
+	t.Do(func(db DB) error { return DeleteSessionByUserID(db, id) })
+	return t.Done()
+}
+
+// FindUserByID searches for a user by ID.  Soft-deleted users are
+// found as well.
 func FindUserByID(db DB, id int64) (api.User, bool, error) {
 	const stmt = "SELECT ID,Name,Email,Institute,Admin FROM " + UsersTableName + " WHERE ID=?"
 	return selectUser(db, stmt, id)
 }
 
-// FindUserByEmail searches for a user by its email.
+// FindUserByEmail searches for a user by its email.  Soft-deleted
+// users are ignored.
 func FindUserByEmail(db DB, email string) (api.User, bool, error) {
+	const stmt = "SELECT ID,Name,Email,Institute,Admin FROM " + UsersTableName +
+		" WHERE Email=? AND NOT Deleted"
+	return selectUser(db, stmt, email)
+}
+
+// FindUserByEmailIncludeDeleted searches for a user by its email
+// including soft-deleted users.
+func FindUserByEmailIncludeDeleted(db DB, email string) (api.User, bool, error) {
 	const stmt = "SELECT ID,Name,Email,Institute,Admin FROM " + UsersTableName + " WHERE Email=?"
 	return selectUser(db, stmt, email)
 }
 
-// FindAllUsers returns all users in the database.
+// FindAllUsers returns all users in the database that are not
+// soft-deleted.
 func FindAllUsers(db DB) ([]api.User, error) {
+	const stmt = "SELECT ID,Name,Email,Institute,Admin FROM " + UsersTableName + " WHERE NOT Deleted"
+	return selectUsers(db, stmt)
+}
+
+// FindAllUsersIncludeDeleted returns all users in the database
+// including soft-deleted users.
+func FindAllUsersIncludeDeleted(db DB) ([]api.User, error) {
 	const stmt = "SELECT ID,Name,Email,Institute,Admin FROM " + UsersTableName
-	rows, err := Query(db, stmt)
+	return selectUsers(db, stmt)
+}
+
+func selectUsers(db DB, stmt string, args ...interface{}) ([]api.User, error) {
+	rows, err := Query(db, stmt, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -141,6 +267,22 @@ func FindAllUsers(db DB) ([]api.User, error) {
 	return users, nil
 }
 
+// SearchUsers returns all users whose email or name starts with the
+// given prefix ordered by their email.  At most limit users are
+// returned.  The special characters `%` and `_` in the prefix are
+// matched literally.  Soft-deleted users are ignored.
+func SearchUsers(db DB, prefix string, limit int) ([]api.User, error) {
+	const stmt = "SELECT ID,Name,Email,Institute,Admin FROM " + UsersTableName +
+		" WHERE (Email LIKE ? ESCAPE '!' OR Name LIKE ? ESCAPE '!') AND NOT Deleted" +
+		" ORDER BY Email LIMIT ?"
+	like := likeEscaper.Replace(prefix) + "%"
+	return selectUsers(db, stmt, like, like, limit)
+}
+
+// likeEscaper escapes the special characters of LIKE patterns using
+// `!` as escape character.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
 func selectUser(db DB, q string, args ...interface{}) (api.User, bool, error) {
 	rows, err := Query(db, q, args...)
 	if err != nil {
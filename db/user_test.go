@@ -2,7 +2,9 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/finkf/pcwgo/api"
@@ -31,6 +33,12 @@ func withTableUsers(t *testing.T, f func(*sql.DB)) {
 		if err := CreateTableUsers(db); err != nil {
 			t.Fatalf("got error: %v", err)
 		}
+		if err := CreateTableSessions(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := CreateTableProjects(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
 		f(db)
 	})
 }
@@ -61,6 +69,25 @@ func TestInsertUser(t *testing.T) {
 	})
 }
 
+func TestInsertUserIgnoresClientID(t *testing.T) {
+	withTableUsers(t, func(db *sql.DB) {
+		const payload = `{"user":{"name":"test","email":"test@example.com","id":999},"password":"x"}`
+		var req api.CreateUserRequest
+		if err := json.Unmarshal([]byte(payload), &req); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := InsertUser(db, &req.User); err != nil {
+			t.Fatalf("cannot create user: %v", err)
+		}
+		if req.User.ID == 999 || req.User.ID == 0 {
+			t.Fatalf("invalid user id: %d", req.User.ID)
+		}
+		if _, found, err := FindUserByID(db, 999); err != nil || found {
+			t.Fatalf("found user with client id: %t (%v)", found, err)
+		}
+	})
+}
+
 func TestUserPassword(t *testing.T) {
 	want := api.User{Name: "test", Email: "test@example.com"}
 	withTestUser(t, &want, func(db *sql.DB) {
@@ -76,6 +103,22 @@ func TestUserPassword(t *testing.T) {
 	})
 }
 
+func TestUserPasswordNotSet(t *testing.T) {
+	want := api.User{Name: "test", Email: "test@example.com"}
+	withTestUser(t, &want, func(db *sql.DB) {
+		if err := AuthenticateUser(db, want, "test-passwd"); err != ErrPasswordNotSet {
+			t.Fatalf("expected error %v; got %v", ErrPasswordNotSet, err)
+		}
+		if err := SetUserPassword(db, want, "test-passwd"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		err := AuthenticateUser(db, want, "wrong-passwd")
+		if err == nil || err == ErrPasswordNotSet {
+			t.Fatalf("expected generic authentification error; got %v", err)
+		}
+	})
+}
+
 func TestUpdateUser(t *testing.T) {
 	want := api.User{Name: "test", Email: "test@example.com"}
 	withTestUser(t, &want, func(db *sql.DB) {
@@ -96,6 +139,48 @@ func TestUpdateUser(t *testing.T) {
 	})
 }
 
+func TestUpdateUserFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  map[string]interface{}
+		want    api.User
+		wantErr bool
+	}{
+		{"institute", map[string]interface{}{"institute": "new"},
+			api.User{Name: "test", Email: "test@example.com", Institute: "new"}, false},
+		{"name-email", map[string]interface{}{"name": "new", "email": "new@example.com"},
+			api.User{Name: "new", Email: "new@example.com", Institute: "test"}, false},
+		{"empty", nil,
+			api.User{Name: "test", Email: "test@example.com", Institute: "test"}, false},
+		{"unknown", map[string]interface{}{"name": "new", "admin": true}, api.User{}, true},
+		{"invalid-value", map[string]interface{}{"name": 1}, api.User{}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := api.User{Name: "test", Email: "test@example.com", Institute: "test"}
+			withTestUser(t, &u, func(db *sql.DB) {
+				err := UpdateUserFields(db, u.ID, tc.fields)
+				if tc.wantErr {
+					if err == nil {
+						t.Fatalf("expected an error")
+					}
+					tc.want = api.User{Name: "test", Email: "test@example.com", Institute: "test"}
+				} else if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				tc.want.ID = u.ID
+				got, _, err := FindUserByID(db, u.ID)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				if got != tc.want {
+					t.Fatalf("expected user: %s; got %s", tc.want, got)
+				}
+			})
+		})
+	}
+}
+
 func TestDeleteUser(t *testing.T) {
 	want := api.User{Name: "test", Email: "test@example.com"}
 	withTestUser(t, &want, func(db *sql.DB) {
@@ -111,3 +196,126 @@ func TestDeleteUser(t *testing.T) {
 		}
 	})
 }
+
+func TestDeleteUserSessions(t *testing.T) {
+	want := api.User{Name: "test", Email: "test@example.com"}
+	withTestUser(t, &want, func(db *sql.DB) {
+		s, err := InsertSession(db, want)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := DeleteUserByID(db, want.ID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if _, found, err := FindSessionByID(db, s.Auth); err != nil || found {
+			t.Fatalf("session of deleted user still exists: %t (%v)", found, err)
+		}
+	})
+}
+
+func TestDeleteUserWithProjects(t *testing.T) {
+	want := api.User{Name: "test", Email: "test@example.com"}
+	withTestUser(t, &want, func(db *sql.DB) {
+		if err := CreateTableBooks(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		newTestProject(t, db, 1, newTestBook(t, db, 1), &want)
+		if err := DeleteUserByID(db, want.ID); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if _, found, err := FindUserByID(db, want.ID); err != nil || !found {
+			t.Fatalf("user was deleted: %t (%v)", found, err)
+		}
+	})
+}
+
+func TestSoftDeleteUser(t *testing.T) {
+	want := api.User{Name: "test", Email: "test@example.com"}
+	withTestUser(t, &want, func(db *sql.DB) {
+		if err := SetUserPassword(db, want, "password"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		s, err := InsertSession(db, want)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := SoftDeleteUser(db, want.ID); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := SoftDeleteUser(db, 999); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if err := AuthenticateUser(db, want, "password"); err == nil {
+			t.Fatalf("soft-deleted user can authenticate")
+		}
+		if _, found, err := FindSessionByID(db, s.Auth); err != nil || found {
+			t.Fatalf("session of deleted user still exists: %t (%v)", found, err)
+		}
+		if _, found, err := FindUserByEmail(db, want.Email); err != nil || found {
+			t.Fatalf("expected not found; got found=%t, err=%v", found, err)
+		}
+		if users, err := FindAllUsers(db); err != nil || len(users) != 0 {
+			t.Fatalf("expected no users; got %v (%v)", users, err)
+		}
+		// the row remains
+		if got, found, err := FindUserByID(db, want.ID); err != nil || !found || got != want {
+			t.Fatalf("expected %v; got %v, found=%t (%v)", want, got, found, err)
+		}
+		if got, found, err := FindUserByEmailIncludeDeleted(db, want.Email); err != nil || !found || got != want {
+			t.Fatalf("expected %v; got %v, found=%t (%v)", want, got, found, err)
+		}
+		users, err := FindAllUsersIncludeDeleted(db)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if !reflect.DeepEqual(users, []api.User{want}) {
+			t.Fatalf("expected %v; got %v", []api.User{want}, users)
+		}
+		// migration of existing tables is idempotent
+		if err := CreateTableUsers(db); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+	})
+}
+
+func TestSearchUsers(t *testing.T) {
+	withTableUsers(t, func(db *sql.DB) {
+		for _, u := range []api.User{
+			{Name: "Anna", Email: "anna@example.com"},
+			{Name: "Bert", Email: "bert@example.com"},
+			{Name: "Andreas", Email: "zz@example.com"},
+			{Name: "100% sure", Email: "sure@example.com"},
+			{Name: "100 percent", Email: "percent@example.com"},
+		} {
+			if err := InsertUser(db, &u); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		tests := []struct {
+			prefix string
+			limit  int
+			want   []string
+		}{
+			{"an", 10, []string{"anna@example.com", "zz@example.com"}},
+			{"an", 1, []string{"anna@example.com"}},
+			{"100%", 10, []string{"sure@example.com"}},
+			{"_", 10, nil},
+			{"x", 10, nil},
+		}
+		for _, tc := range tests {
+			t.Run(tc.prefix, func(t *testing.T) {
+				users, err := SearchUsers(db, tc.prefix, tc.limit)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				var got []string
+				for _, u := range users {
+					got = append(got, u.Email)
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Fatalf("expected %v; got %v", tc.want, got)
+				}
+			})
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"runtime/debug"
 	"sync"
 
 	"github.com/UNO-SOFT/ulog"
@@ -14,6 +15,12 @@ import (
 
 var (
 	js *j
+	// OnComplete is called exactly once for each job that is done or
+	// failed with the job's id, its final status id (db.StatusIDDone
+	// or db.StatusIDFailed) and the error of the job's runner.  It is
+	// called in its own goroutine, so a slow callback does not stall
+	// the jobs queue.  OnComplete must be set before Init is called.
+	OnComplete func(id, status int, err error)
 )
 
 type j struct {
@@ -22,14 +29,48 @@ type j struct {
 	queue       chan s                     // jobs queue
 	cancelFuncs map[int]context.CancelFunc // active jobs cancel functions
 	once        sync.Once                  // used to handle multiple calls to close
+	mu          sync.Mutex                 // guards queued and running
+	queued      int                        // number of jobs waiting to be enqueued
+	running     int                        // number of running jobs
+}
+
+// QueueMetrics holds the metrics of the jobs queue.
+type QueueMetrics struct {
+	Queued  int `json:"queued"`  // submitted jobs that wait for the queue
+	Running int `json:"running"` // running jobs
+	Workers int `json:"workers"` // maximal number of running jobs; 0 means unlimited
+}
+
+// Metrics returns the current metrics of the jobs queue.  Jobs are
+// not limited by a worker pool, so Workers is always 0.  Use
+// service.HandleMetrics to serve the metrics.
+func Metrics() QueueMetrics {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return QueueMetrics{Queued: js.queued, Running: js.running}
+}
+
+// addQueued adds n to the number of queued jobs.
+func (j *j) addQueued(n int) {
+	j.mu.Lock()
+	j.queued += n
+	j.mu.Unlock()
+}
+
+// addRunning adds n to the number of running jobs.
+func (j *j) addRunning(n int) {
+	j.mu.Lock()
+	j.running += n
+	j.mu.Unlock()
 }
 
 type s struct {
-	id   int
-	err  error
-	r    Runner
-	ctx  context.Context
-	stop bool
+	id    int
+	err   error
+	r     Runner
+	ctx   context.Context
+	stop  bool
+	drain bool
 }
 
 // Init initializes the jobs queue and the jobs database tables (if
@@ -45,7 +86,7 @@ func Init(dtb db.DB) error {
 		cancelFuncs: make(map[int]context.CancelFunc),
 		db:          dtb,
 	}
-	go func() { jobs() }()
+	go jobs(js)
 	return nil
 }
 
@@ -63,6 +104,34 @@ func Close() error {
 	return nil
 }
 
+// Drain waits for all running jobs to finish and closes the jobs
+// queue.  If the given context is done before all jobs have finished,
+// the remaining jobs are canceled (see Close) and the context's error
+// is returned.  No new jobs must be started while the queue is
+// drained.  Register it with service.OnShutdown to drain the queue on
+// shutdown.
+func Drain(ctx context.Context) error {
+	// make sure that all queued jobs have been started
+	select {
+	case js.queue <- s{drain: true}:
+	case <-ctx.Done():
+		Close()
+		return ctx.Err()
+	}
+	done := make(chan struct{})
+	go func() {
+		js.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return Close()
+	case <-ctx.Done():
+		Close()
+		return ctx.Err()
+	}
+}
+
 // Runner defines the interface for any running job
 type Runner interface {
 	BookID() int               // returns the book id of the job
@@ -75,29 +144,121 @@ type Runner interface {
 // without blocking.  If a job for the given book is already running,
 // this job's id information is returned.  You can check the status of
 // the job with the Job function at any given time.
+//
+// The context that is passed to the runner is derived from the given
+// context.  All values of the given context (e.g. trace IDs) are
+// visible to the runner.  The runner's context is canceled if the
+// given context is canceled or if the jobs queue is closed.
 func Start(ctx context.Context, r Runner) (int, error) {
+	id, running, err := newJob(r)
+	if err != nil || running {
+		return id, err
+	}
+	js.addQueued(1)
+	defer js.addQueued(-1)
+	js.queue <- s{id: id, r: r, ctx: ctx}
+	return id, nil
+}
+
+// StartContext runs the given callback function as a background job
+// like Start.  Other than Start, StartContext stops waiting for the
+// jobs queue to accept the job if the given context is canceled.  In
+// this case the job is marked as failed and the context's error is
+// returned.  The given context is also used as the parent context of
+// the runner (see Start).
+func StartContext(ctx context.Context, r Runner) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	id, running, err := newJob(r)
+	if err != nil || running {
+		return id, err
+	}
+	js.addQueued(1)
+	defer js.addQueued(-1)
+	select {
+	case js.queue <- s{id: id, r: r, ctx: ctx}:
+		return id, nil
+	case <-ctx.Done():
+		if err := db.FinishJob(js.db, id, db.StatusIDFailed); err != nil {
+			ulog.Write("cannot set job status", "status", db.StatusFailed, "err", err)
+		}
+		return 0, ctx.Err()
+	}
+}
+
+// StartBatch starts the given runners as jobs (see StartContext) and
+// groups them into a new batch.  It returns the batch id and the ids
+// of the jobs in the order of the given runners.  Use BatchStatus to
+// track the progress of the batch.  If a job cannot be started, no
+// batch is created and the ids of the already started jobs are
+// returned with the error; these jobs keep running.
+func StartBatch(ctx context.Context, runners []Runner) (int, []int, error) {
+	ids := make([]int, 0, len(runners))
+	for _, r := range runners {
+		id, err := StartContext(ctx, r)
+		if err != nil {
+			return 0, ids, fmt.Errorf("cannot start batch: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	batchID, err := db.NewJobBatch(js.db, ids)
+	if err != nil {
+		return 0, ids, fmt.Errorf("cannot start batch: %v", err)
+	}
+	return batchID, ids, nil
+}
+
+// BatchStatus returns the aggregated status of the jobs of the batch
+// with the given id.  If the batch cannot be found or if any other
+// error occurs, an empty status is returned.
+func BatchStatus(batchID int) api.BatchStatus {
+	status := api.BatchStatus{BatchID: batchID}
+	counts, ok, err := db.FindJobBatchStatus(js.db, batchID)
+	if err != nil {
+		ulog.Write("cannot query for batch", "id", batchID, "err", err)
+		return status
+	}
+	if !ok {
+		ulog.Write("cannot query for batch", "id", batchID, "err", "no such batch id")
+		return status
+	}
+	for id, n := range counts {
+		status.Total += n
+		switch id {
+		case db.StatusIDRunning:
+			status.Running += n
+		case db.StatusIDFailed:
+			status.Failed += n
+		default:
+			status.Done += n
+		}
+	}
+	return status
+}
+
+// newJob creates or restarts the job for the given runner and returns
+// its id.  If the job is already running, its id is returned and
+// running is set to true.
+func newJob(r Runner) (id int, running bool, err error) {
 	job, ok, err := db.FindJobByID(js.db, r.BookID())
 	if err != nil {
-		return 0, fmt.Errorf("cannot start job id %d: %v", r.BookID(), err)
+		return 0, false, fmt.Errorf("cannot start job id %d: %v", r.BookID(), err)
 	}
 	if ok && job.StatusID == db.StatusIDRunning {
-		return Job(r.BookID()).JobID, nil
+		return Job(r.BookID()).JobID, true, nil
 	}
-	var id int
 	if ok {
-		if err := db.SetJobStatusWithText(js.db, job.JobID, db.StatusIDRunning, r.Name()); err != nil {
-			return 0, fmt.Errorf("cannot start job id %d: %v", job.JobID, err)
+		if err := db.RestartJob(js.db, job.JobID, r.Name()); err != nil {
+			return 0, false, fmt.Errorf("cannot start job id %d: %v", job.JobID, err)
 		}
-		id = job.JobID
-	} else {
-		xid, err := db.NewJob(js.db, r.BookID(), r.Name())
-		if err != nil {
-			return 0, fmt.Errorf("cannot start job id %d: %v", r.BookID(), err)
-		}
-		id = xid
+		return job.JobID, false, nil
 	}
-	js.queue <- s{id: id, r: r, ctx: ctx}
-	return id, nil
+	id, err = db.NewJob(js.db, r.BookID(), r.Name())
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot start job id %d: %v", r.BookID(), err)
+	}
+	return id, false, nil
 }
 
 // Job returns information about the job with the given id.  If the
@@ -116,13 +277,20 @@ func Job(id int) *api.JobStatus {
 	return job
 }
 
-func jobs() {
+// jobs runs the dispatcher of the given jobs queue.  The queue is
+// passed explicitly, so a dispatcher that is still shutting down never
+// touches the jobs of a newly initialized queue.
+func jobs(js *j) {
 	for job := range js.queue {
 		if job.r != nil {
 			ulog.Write("handling job", "id", job.id, "err", job.err, "runner", job.r.Name())
 		} else {
 			ulog.Write("handling job", "id", job.id, "err", job.err)
 		}
+		// drain signal: all previously queued jobs are running
+		if job.drain {
+			continue
+		}
 		// we are done: cancel all running jobs
 		if job.stop {
 			for _, cancel := range js.cancelFuncs {
@@ -134,38 +302,71 @@ func jobs() {
 		if job.r != nil {
 			ctx, cancel := context.WithCancel(job.ctx)
 			js.cancelFuncs[job.id] = cancel
+			js.addRunning(1)
 			r := job.r // must copy function
 			id := job.id
 			js.wg.Add(1)
 			go func() {
 				defer js.wg.Done()
-				js.queue <- s{id: id, err: r.Run(ctx)}
+				js.queue <- s{id: id, err: run(ctx, r)}
 				ulog.Write("job done", "id", id)
 			}()
 			continue
 		}
 		// finished job: handle result and status accordingly
 		delete(js.cancelFuncs, job.id)
+		js.addRunning(-1)
 		if job.err != nil {
 			ulog.Write("job failed", "id", job.id, "err", job.err)
-			if err := db.SetJobStatus(js.db, job.id, db.StatusIDFailed); err != nil {
+			if err := db.FinishJob(js.db, job.id, db.StatusIDFailed); err != nil {
 				ulog.Write("cannot set job status", "status", db.StatusFailed, "err", err)
 			}
+			complete(job.id, db.StatusIDFailed, job.err)
 			continue
 		}
-		if err := db.SetJobStatus(js.db, job.id, db.StatusIDDone); err != nil {
-			ulog.Write("cannot set job status", "status", db.StatusFailed, "err", err)
+		if err := db.FinishJob(js.db, job.id, db.StatusIDDone); err != nil {
+			ulog.Write("cannot set job status", "status", db.StatusDone, "err", err)
 		}
+		complete(job.id, db.StatusIDDone, nil)
 	}
 	ulog.Write("queue closed")
 }
 
+// complete calls OnComplete (if set) in the background.
+func complete(id, status int, err error) {
+	if OnComplete != nil {
+		go OnComplete(id, status, err)
+	}
+}
+
+// run runs the given runner.  Panics of the runner are recovered and
+// returned as errors.
+func run(ctx context.Context, r Runner) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			ulog.Write("job panicked", "runner", r.Name(), "panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()))
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return r.Run(ctx)
+}
+
 // Run executes a command with the given context and arguments.  The
 // command's stderr is logged using log.Debug.  Run waits for the
 // command to finish and returns its result.
+//
+// The command is started in its own process group (on systems that
+// support it).  If the context is canceled, the whole process group
+// is killed, so any processes spawned by the command are terminated
+// as well.
 func Run(ctx context.Context, cmd string, args ...string) error {
 	ulog.Write("running command", "cmd", cmd, "args", args)
-	exe := exec.CommandContext(ctx, cmd, args...)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("cannot run command: %v", err)
+	}
+	exe := exec.Command(cmd, args...)
+	setpgid(exe)
 	stderr, err := exe.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("cannot connect to command's stderr: %v", err)
@@ -179,7 +380,24 @@ func Run(ctx context.Context, cmd string, args ...string) error {
 		// we do not care about errors
 	}()
 	// we ignore command's stdout
-	if err := exe.Run(); err != nil {
+	if err := exe.Start(); err != nil {
+		return fmt.Errorf("cannot run command: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := kill(exe); err != nil {
+				ulog.Write("cannot kill command", "cmd", cmd, "err", err)
+			}
+		case <-done:
+		}
+	}()
+	if err := exe.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("cannot run command: %v", ctx.Err())
+		}
 		return fmt.Errorf("cannot run command: %v", err)
 	}
 	return nil
@@ -4,9 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/finkf/pcwgo/api"
+	"github.com/finkf/pcwgo/db"
 	"github.com/finkf/pcwgo/db/sqlite"
+	"github.com/finkf/pcwgo/service"
 )
 
 type runner struct {
@@ -59,9 +64,312 @@ func Test(t *testing.T) {
 	})
 }
 
+type ctxKey struct{}
+
+func TestStartContextValues(t *testing.T) {
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := Init(dtb); err != nil {
+			t.Fatalf("cannot initialize: %v", err)
+		}
+		defer Close()
+		values := make(chan interface{}, 1)
+		ctx := context.WithValue(context.Background(), ctxKey{}, "trace")
+		_, err := Start(ctx, testRunner(1, func(ctx context.Context) error {
+			values <- ctx.Value(ctxKey{})
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("cannot start: %v", err)
+		}
+		if got := <-values; got != "trace" {
+			t.Fatalf("expected value %q; got %v", "trace", got)
+		}
+	})
+}
+
+func TestPanickingRunner(t *testing.T) {
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := Init(dtb); err != nil {
+			t.Fatalf("cannot initialize: %v", err)
+		}
+		defer Close()
+		id, err := Start(context.Background(), testRunner(1, func(context.Context) error {
+			panic("bad runner")
+		}))
+		if err != nil {
+			t.Fatalf("cannot start: %v", err)
+		}
+		if got := waitFor(t, id); got != db.StatusIDFailed {
+			t.Fatalf("expected status %d; got %d", db.StatusIDFailed, got)
+		}
+		// the queue must still work
+		id, err = Start(context.Background(), testRunner(2, func(context.Context) error {
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("cannot start: %v", err)
+		}
+		if got := waitFor(t, id); got != db.StatusIDDone {
+			t.Fatalf("expected status %d; got %d", db.StatusIDDone, got)
+		}
+	})
+}
+
+func TestStartContextCanceled(t *testing.T) {
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := db.CreateTableJobs(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// Simulate a full queue: nobody reads from the queue.
+		defer func(old *j) { js = old }(js)
+		js = &j{
+			queue:       make(chan s),
+			cancelFuncs: make(map[int]context.CancelFunc),
+			db:          dtb,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := StartContext(ctx, testRunner(1, func(context.Context) error {
+			return nil
+		}))
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected %v; got %v", context.DeadlineExceeded, err)
+		}
+		if got := Job(1).StatusID; got != db.StatusIDFailed {
+			t.Fatalf("expected status %d; got %d", db.StatusIDFailed, got)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := db.CreateTableJobs(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// Simulate a full queue: nobody reads from the queue.
+		defer func(old *j) { js = old }(js)
+		js = &j{
+			queue:       make(chan s),
+			cancelFuncs: make(map[int]context.CancelFunc),
+			db:          dtb,
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		const n = 3
+		var wg sync.WaitGroup
+		for i := 1; i <= n; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				StartContext(ctx, testRunner(id, func(context.Context) error {
+					return nil
+				}))
+			}(i)
+		}
+		for i := 0; Metrics().Queued != n; i++ {
+			if i == 1000 {
+				t.Fatalf("expected %d queued jobs; got %v", n, Metrics())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if got := Metrics(); got != (QueueMetrics{Queued: n}) {
+			t.Fatalf("invalid metrics: %v", got)
+		}
+		cancel()
+		wg.Wait()
+		if got := Metrics(); got != (QueueMetrics{}) {
+			t.Fatalf("invalid metrics: %v", got)
+		}
+	})
+}
+
+func TestOnComplete(t *testing.T) {
+	type result struct {
+		id, status int
+		err        error
+	}
+	results := make(chan result, 2)
+	defer func(f func(int, int, error)) { OnComplete = f }(OnComplete)
+	OnComplete = func(id, status int, err error) {
+		results <- result{id, status, err}
+	}
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := Init(dtb); err != nil {
+			t.Fatalf("cannot initialize: %v", err)
+		}
+		defer Close()
+		tests := []struct {
+			name   string
+			err    error
+			status int
+		}{
+			{"done", nil, db.StatusIDDone},
+			{"failed", fmt.Errorf("error"), db.StatusIDFailed},
+		}
+		for i, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				id, err := Start(context.Background(), testRunner(i+1, func(context.Context) error {
+					return tc.err
+				}))
+				if err != nil {
+					t.Fatalf("cannot start: %v", err)
+				}
+				select {
+				case got := <-results:
+					if got.id != id || got.status != tc.status || got.err != tc.err {
+						t.Fatalf("expected {%d %d %v}; got %v", id, tc.status, tc.err, got)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("callback was not called")
+				}
+			})
+		}
+		select {
+		case got := <-results:
+			t.Fatalf("unexpected callback: %v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+// waitFor waits until the job with the given id is not running
+// anymore and returns its status id.
+func waitFor(t *testing.T, id int) int {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if status := Job(id).StatusID; status != db.StatusIDRunning {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %d is still running", id)
+	return 0
+}
+
 func testStart(t *testing.T, r Runner) {
 	t.Helper()
 	if _, err := Start(context.Background(), r); err != nil {
 		t.Fatalf("cannot start: %v", err)
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := Init(dtb); err != nil {
+			t.Fatalf("cannot initialize: %v", err)
+		}
+		defer func(old *sql.DB) { service.SetPool(old) }(service.Pool())
+		service.SetPool(dtb)
+		// shutdown functions are called in reverse order: the queue is
+		// drained before the status of the job is checked
+		var calls, status int
+		var id int
+		service.OnShutdown(func(context.Context) error {
+			calls++
+			status = Job(id).StatusID
+			return nil
+		})
+		service.OnShutdown(Drain)
+		release := make(chan struct{})
+		id, err := Start(context.Background(), testRunner(1, func(ctx context.Context) error {
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}))
+		if err != nil {
+			t.Fatalf("cannot start: %v", err)
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for i := 0; i < 2; i++ {
+			if err := service.Shutdown(ctx); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		if calls != 1 {
+			t.Fatalf("expected shutdown functions to be called once; got %d", calls)
+		}
+		if status != db.StatusIDDone {
+			t.Fatalf("expected status %d; got %d", db.StatusIDDone, status)
+		}
+		if _, err := service.PoolOrErr(); err != service.ErrNotInitialized {
+			t.Fatalf("expected pool to be closed; got %v", err)
+		}
+		if err := dtb.Ping(); err == nil {
+			t.Fatalf("expected closed database")
+		}
+	})
+}
+
+func TestBatchStatus(t *testing.T) {
+	completed := make(chan int, 3)
+	defer func(f func(int, int, error)) { OnComplete = f }(OnComplete)
+	OnComplete = func(id, _ int, _ error) { completed <- id }
+	sqlite.With("jobs.sqlite", func(dtb *sql.DB) {
+		dtb.SetMaxOpenConns(1)
+		if err := Init(dtb); err != nil {
+			t.Fatalf("cannot initialize: %v", err)
+		}
+		defer Close()
+		results := make([]chan error, 3)
+		runners := make([]Runner, len(results))
+		for i := range results {
+			res := make(chan error)
+			results[i] = res
+			runners[i] = testRunner(i+1, func(context.Context) error { return <-res })
+		}
+		batchID, ids, err := StartBatch(context.Background(), runners)
+		if err != nil {
+			t.Fatalf("cannot start batch: %v", err)
+		}
+		if len(ids) != len(runners) {
+			t.Fatalf("expected %d ids; got %v", len(runners), ids)
+		}
+		want := api.BatchStatus{BatchID: batchID, Total: 3, Running: 3}
+		if got := BatchStatus(batchID); got != want {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+		tests := []struct {
+			name    string
+			i       int
+			err     error
+			running int
+			done    int
+			failed  int
+		}{
+			{"first-done", 0, nil, 2, 1, 0},
+			{"second-failed", 1, fmt.Errorf("error"), 1, 1, 1},
+			{"third-done", 2, nil, 0, 2, 1},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				results[tc.i] <- tc.err
+				select {
+				case id := <-completed:
+					if id != ids[tc.i] {
+						t.Fatalf("expected job %d to complete; got %d", ids[tc.i], id)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("job %d did not complete", ids[tc.i])
+				}
+				want := api.BatchStatus{BatchID: batchID, Total: 3,
+					Running: tc.running, Done: tc.done, Failed: tc.failed}
+				if got := BatchStatus(batchID); got != want {
+					t.Fatalf("expected %v; got %v", want, got)
+				}
+			})
+		}
+		if got := BatchStatus(batchID + 1); got != (api.BatchStatus{BatchID: batchID + 1}) {
+			t.Fatalf("expected empty status; got %v", got)
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcwgo-jobs")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "pid")
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		errs <- Run(ctx, "sh", "-c", "sleep 100 & echo $! > "+pidfile+"; wait")
+	}()
+	var pid int
+	for i := 0; pid == 0 && i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+		content, err := ioutil.ReadFile(pidfile)
+		if err != nil {
+			continue
+		}
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+	if pid == 0 {
+		t.Fatalf("cannot read grandchild's pid")
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("command was not killed")
+	}
+	for i := 0; alive(pid); i++ {
+		if i == 100 {
+			t.Fatalf("grandchild %d is still running", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// alive returns true if the process with the given pid is still
+// running.  Zombie processes are considered to be dead.
+func alive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] != "Z"
+}
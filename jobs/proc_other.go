@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package jobs
+
+import "os/exec"
+
+// setpgid is a no-op on systems without process groups.
+func setpgid(cmd *exec.Cmd) {}
+
+// kill kills the given (started) command.  Child processes of the
+// command are not killed on systems without process groups.
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
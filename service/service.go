@@ -1,23 +1,37 @@
 package service // import "github.com/finkf/pcwgo/service"
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/UNO-SOFT/ulog"
 	"github.com/finkf/pcwgo/api"
 	"github.com/finkf/pcwgo/db"
-	_ "github.com/go-sql-driver/mysql" // to connect with mysql
+	"github.com/go-sql-driver/mysql"
 )
 
 type key int
@@ -30,41 +44,110 @@ const (
 	pageIDKey
 	lineIDKey
 	jobIDKey
+	traceIDKey
 )
 
+// middlewares maps the context keys to the middleware that registers
+// them.
+var middlewares = map[key]string{
+	authKey:      "WithAuth",
+	projectKey:   "WithProject",
+	userIDKey:    "WithUserID",
+	projectIDKey: "WithProjectID",
+	pageIDKey:    "WithPageID",
+	lineIDKey:    "WithLineID",
+	jobIDKey:     "WithJobID",
+	traceIDKey:   "WithTraceID",
+}
+
+// missingCtxError is the panic value of the context accessors if the
+// middleware that registers the requested value was not applied.
+type missingCtxError struct {
+	middleware string
+}
+
+func (err missingCtxError) Error() string {
+	return err.middleware + " middleware not applied"
+}
+
+// requireCtx returns the registered value for the given key.  It
+// panics with a missingCtxError if no value was registered.  Handlers
+// wrapped with WithMethods or WithRecover answer such panics with an
+// internal server error.
+func requireCtx(ctx context.Context, k key) interface{} {
+	v := ctx.Value(k)
+	if v == nil {
+		panic(missingCtxError{middlewares[k]})
+	}
+	return v
+}
+
 // AuthFromCtx returns the registered session from a context.
 func AuthFromCtx(ctx context.Context) *api.Session {
-	return ctx.Value(authKey).(*api.Session)
+	return requireCtx(ctx, authKey).(*api.Session)
+}
+
+// AuthFromCtxOK returns the registered session from a context.  It
+// returns false if no session was registered.
+func AuthFromCtxOK(ctx context.Context) (*api.Session, bool) {
+	s, ok := ctx.Value(authKey).(*api.Session)
+	return s, ok
+}
+
+// UserFromCtx returns the user of the registered session from a
+// context without querying the database.  The user reflects the
+// state at the creation of the session.  It returns false if no
+// session was registered.
+func UserFromCtx(ctx context.Context) (api.User, bool) {
+	s, ok := AuthFromCtxOK(ctx)
+	if !ok {
+		return api.User{}, false
+	}
+	return s.User, true
+}
+
+// IsAdmin returns true if the user of the registered session is an
+// administrator.  It returns false if no session was registered.
+func IsAdmin(ctx context.Context) bool {
+	u, ok := UserFromCtx(ctx)
+	return ok && u.Admin
+}
+
+// TraceIDFromCtx returns the registered trace ID from a context.  It
+// returns the empty string if no trace ID was registered.
+func TraceIDFromCtx(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey).(string)
+	return id
 }
 
 // ProjectFromCtx returns the registered project from a context.
 func ProjectFromCtx(ctx context.Context) *db.Project {
-	return ctx.Value(projectKey).(*db.Project)
+	return requireCtx(ctx, projectKey).(*db.Project)
 }
 
 // UserIDFromCtx returns the registered user ID from a context.
 func UserIDFromCtx(ctx context.Context) int {
-	return ctx.Value(userIDKey).(int)
+	return requireCtx(ctx, userIDKey).(int)
 }
 
 // ProjectIDFromCtx returns the registered project ID from a context.
 func ProjectIDFromCtx(ctx context.Context) int {
-	return ctx.Value(projectIDKey).(int)
+	return requireCtx(ctx, projectIDKey).(int)
 }
 
 // PageIDFromCtx returns the registered page ID from a context.
 func PageIDFromCtx(ctx context.Context) int {
-	return ctx.Value(pageIDKey).(int)
+	return requireCtx(ctx, pageIDKey).(int)
 }
 
 // LineIDFromCtx returns the registered line ID from a context.
 func LineIDFromCtx(ctx context.Context) int {
-	return ctx.Value(lineIDKey).(int)
+	return requireCtx(ctx, lineIDKey).(int)
 }
 
 // JobIDFromCtx returns the registered job ID from a context.
 func JobIDFromCtx(ctx context.Context) int {
-	return ctx.Value(jobIDKey).(int)
+	return requireCtx(ctx, jobIDKey).(int)
 }
 
 // MaxRetries defines the number of times wait tries to connect to the
@@ -78,6 +161,9 @@ var Wait = 2 * time.Second
 // internal sql handle
 var pool *sql.DB
 
+// data source name of the pool
+var dsn string
+
 // InitDebug sets up the mysql database connection pool using the
 // supplied DSN `user:pass@proto(host/dbname)` and sets the log level
 // to debug if debug=true.  It then calls Init(dsn) and returns its
@@ -92,41 +178,85 @@ func InitDebug(dsn string, _ bool) error {
 // DSN `user:pass@proto(host/dbname)`.  Init waits for the databsase
 // to be online.  It is not save to call Init from different go
 // routines.
-func Init(dsn string) error {
+func Init(d string) error {
+	return InitContext(context.Background(), d)
+}
+
+// InitContext sets up the mysql database connection pool like Init.
+// Waiting for the database can be cancelled with the given context.
+func InitContext(ctx context.Context, d string) error {
 	// connect to db
-	ulog.Write("connecting to database with", "dsn", dsn)
-	dtb, err := sql.Open("mysql", dsn)
+	ulog.Write("connecting to database with", "dsn", redactDSN(d))
+	dtb, err := sql.Open("mysql", d)
 	if err != nil {
 		return err
 	}
 	pool = dtb
+	dsn = d
 	// pool.SetMaxOpenConns(100)
 	// pool.SetConnMaxLifetime(100)
 	// pool.SetMaxIdleConns(10)
 
 	// wait for the database and return
-	return wait(MaxRetries, Wait)
+	return wait(ctx, MaxRetries, Wait)
 }
 
-func wait(retries int, sleep time.Duration) error {
+// wait waits for the database to be online.  Connection errors are
+// retried; permanent errors (e.g. authentication errors) are returned
+// immediately.
+func wait(ctx context.Context, retries int, sleep time.Duration) error {
+	var err error
 	for i := 0; retries == 0 || i < retries; i++ {
-		rows, err := db.Query(pool, "SELECT id FROM users")
-		if err != nil {
-			ulog.Write("error connecting to the database", "err", err)
-			time.Sleep(sleep)
-			continue
+		var rows *sql.Rows
+		rows, err = db.Query(pool, "SELECT id FROM users")
+		if err == nil {
+			// successfully connected to the database
+			rows.Close()
+			ulog.Write("connected sucessfully to database")
+			return nil
+		}
+		if permanentError(err) {
+			return fmt.Errorf("cannot connect to database: %v", err)
+		}
+		ulog.Write("error connecting to the database", "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cannot connect to database: %v (last error: %v)", ctx.Err(), err)
+		case <-time.After(sleep):
 		}
-		// successfully connected to the database
-		rows.Close()
-		ulog.Write("connected sucessfully to database")
-		return nil
 	}
-	return fmt.Errorf("failed to connect to database after %d attempts", retries)
+	return fmt.Errorf("failed to connect to database after %d attempts: %v", retries, err)
 }
 
-// Close closes the database pool.
+// permanentError returns true if the given error is a mysql error
+// that will not recover by retrying (access denied errors).
+func permanentError(err error) bool {
+	var merr *mysql.MySQLError
+	if !errors.As(err, &merr) {
+		return false
+	}
+	switch merr.Number {
+	case 1044, // ER_DBACCESS_DENIED_ERROR
+		1045, // ER_ACCESS_DENIED_ERROR
+		1698: // ER_ACCESS_DENIED_NO_PASSWORD_ERROR
+		return true
+	}
+	return false
+}
+
+// ErrNotInitialized is returned if the database connection pool is
+// accessed before a call to Init.
+var ErrNotInitialized = errors.New("database pool not initialized")
+
+// Close closes the database pool.  It is save to call Close before
+// Init.
 func Close() {
+	if pool == nil {
+		return
+	}
 	pool.Close()
+	pool = nil
+	dsn = ""
 }
 
 // Pool returns the database connection pool that was initialized with
@@ -135,30 +265,228 @@ func Pool() *sql.DB {
 	return pool
 }
 
+// SetPool sets the database connection pool to the given database
+// handle.  It can be used instead of Init to use an existing database
+// handle (e.g. a sqlite database in tests).  It is not save to call
+// SetPool from different go routines.
+func SetPool(dtb *sql.DB) {
+	pool = dtb
+	dsn = ""
+}
+
+// PoolOrErr returns the database connection pool that was initialized
+// with Init.  If Init was not called (or if the pool was closed),
+// ErrNotInitialized is returned.
+func PoolOrErr() (*sql.DB, error) {
+	if pool == nil {
+		return nil, ErrNotInitialized
+	}
+	return pool, nil
+}
+
+// ShutdownTimeout defines the time RunServer waits for in-flight
+// requests and the functions registered with OnShutdown to finish.
+var ShutdownTimeout = 30 * time.Second
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownFuncs []func(context.Context) error
+)
+
+// OnShutdown registers a function that is called by Shutdown before
+// the database pool is closed (e.g. jobs.Drain).  The functions are
+// called in the reverse order of their registration.
+func OnShutdown(f func(context.Context) error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownFuncs = append(shutdownFuncs, f)
+}
+
+// Shutdown calls all functions registered with OnShutdown and closes
+// the database pool afterwards.  The registered functions should
+// return when the given context is done.  The pool is closed even if
+// any of the functions fail.  The first error is returned.  Calling
+// Shutdown again only closes a newly initialized pool.
+func Shutdown(ctx context.Context) error {
+	shutdownMu.Lock()
+	funcs := shutdownFuncs
+	shutdownFuncs = nil
+	shutdownMu.Unlock()
+	var err error
+	for i := len(funcs) - 1; i >= 0; i-- {
+		if ferr := funcs[i](ctx); ferr != nil && err == nil {
+			err = fmt.Errorf("cannot shutdown: %v", ferr)
+		}
+	}
+	Close()
+	return err
+}
+
+// RunServer serves the given handler on the given address until the
+// given context is canceled or the process receives an interrupt or
+// termination signal.  The server stops accepting new requests and
+// waits for in-flight requests; then Shutdown is called.  Both steps
+// are limited by ShutdownTimeout.  If both steps fail, the returned
+// error reports the server error and wraps the error of Shutdown.
+func RunServer(ctx context.Context, addr string, handler http.Handler) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	srv := &http.Server{Addr: addr, Handler: handler}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("cannot run server: %v", err)
+	case sig := <-sigs:
+		ulog.Write("shutting down", "signal", sig.String())
+	case <-ctx.Done():
+		ulog.Write("shutting down", "err", ctx.Err())
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		if serr := Shutdown(sctx); serr != nil {
+			return fmt.Errorf("cannot shutdown server: %v: %w", err, serr)
+		}
+		return fmt.Errorf("cannot shutdown server: %v", err)
+	}
+	return Shutdown(sctx)
+}
+
+// Stats returns the statistics of the database connection pool.  If
+// the pool is not initialized, empty statistics are returned.
+func Stats() sql.DBStats {
+	if pool == nil {
+		return sql.DBStats{}
+	}
+	return pool.Stats()
+}
+
+// RedactedDSN returns the DSN that was used to initialize the
+// database connection pool with a masked password.  If the pool was
+// not initialized with Init, the empty string is returned.
+func RedactedDSN() string {
+	return redactDSN(dsn)
+}
+
+// redactDSN masks the password of the given DSN
+// `user:pass@proto(host)/dbname`.  The password may contain `@`
+// characters, so the last `@` before the last `/` ends the password.
+func redactDSN(dsn string) string {
+	end := strings.LastIndex(dsn, "/")
+	if end == -1 {
+		end = len(dsn)
+	}
+	at := strings.LastIndex(dsn[:end], "@")
+	if at == -1 {
+		return dsn
+	}
+	colon := strings.Index(dsn[:at], ":")
+	if colon == -1 {
+		return dsn
+	}
+	return dsn[:colon+1] + "*****" + dsn[at:]
+}
+
+// HandleDBStats sends the redacted DSN and the statistics of the
+// database connection pool as json.  Only administrators are allowed
+// to access the statistics, so the handler must be wrapped with
+// WithAuth.  It is meant to be mounted at `/debug/dbstats`.
+func HandleDBStats(ctx context.Context, w http.ResponseWriter, _ *http.Request) {
+	if !IsAdmin(ctx) {
+		ErrorResponse(w, http.StatusForbidden, "cannot access db stats: not an admin")
+		return
+	}
+	JSONResponse(w, struct {
+		DSN   string      `json:"dsn"`
+		Stats sql.DBStats `json:"stats"`
+	}{RedactedDSN(), Stats()})
+}
+
+// HandleMetrics returns a handler that sends the result of the given
+// metrics function as json (e.g. jobs.Metrics).  Only administrators
+// are allowed to access the metrics, so the handler must be wrapped
+// with WithAuth.
+func HandleMetrics(metrics func() interface{}) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, _ *http.Request) {
+		if !IsAdmin(ctx) {
+			ErrorResponse(w, http.StatusForbidden, "cannot access metrics: not an admin")
+			return
+		}
+		JSONResponse(w, metrics())
+	}
+}
+
+// StartSessionGC starts a background go routine that periodically
+// deletes all expired sessions from the database connection pool.
+// The go routine returns if the given context is canceled.
+func StartSessionGC(ctx context.Context, interval time.Duration) {
+	go sessionGC(ctx, interval)
+}
+
+func sessionGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dtb, err := PoolOrErr()
+			if err != nil {
+				ulog.Write("cannot delete expired sessions", "err", err)
+				continue
+			}
+			n, err := db.DeleteExpiredSessions(dtb)
+			if err != nil {
+				ulog.Write("cannot delete expired sessions", "err", err)
+				continue
+			}
+			ulog.Write("deleted expired sessions", "n", n)
+		}
+	}
+}
+
 // HandlerFunc defines the callback function to handle callbacks with
 // data.
 type HandlerFunc func(context.Context, http.ResponseWriter, *http.Request)
 
 // WithProject loads the project data for the given project id and
 // puts it into the context.  It can be retrieved with
-// ProjectFromCtx(ctx).
+// ProjectFromCtx(ctx).  Use WithProject for routes of the form
+// `/books/<project id>`.  Use WithBookProject for routes that contain
+// a book id.
 func WithProject(f HandlerFunc) HandlerFunc {
+	return withProject("project", db.FindProjectByID, f)
+}
+
+// WithBookProject loads the project data of the book with the given
+// book id and puts it into the context.  It can be retrieved with
+// ProjectFromCtx(ctx).  Use WithBookProject for routes of the form
+// `/books/<book id>`.  See db.FindProjectByBookID for how the
+// project of a book is determined.
+func WithBookProject(f HandlerFunc) HandlerFunc {
+	return withProject("book", db.FindProjectByBookID, f)
+}
+
+func withProject(what string, find func(db.DB, int) (*db.Project, bool, error), f HandlerFunc) HandlerFunc {
 	re := regexp.MustCompile(`/books/(\d+)`)
 	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		var id int
 		if n := ParseIDs(r.URL.String(), re, &id); n != 1 {
-			ErrorResponse(w, http.StatusNotFound, "cannot find project ID: %s", r.URL)
+			ErrorResponse(w, http.StatusNotFound, "cannot find %s ID: %s", what, r.URL)
 			return
 		}
-		p, found, err := db.FindProjectByID(pool, id)
+		p, found, err := find(pool, id)
 		if err != nil {
 			ErrorResponse(w, http.StatusInternalServerError,
-				"cannot find project ID %d: %v", id, err)
+				"cannot find %s ID %d: %v", what, id, err)
 			return
 		}
 		if !found {
 			ErrorResponse(w, http.StatusNotFound,
-				"cannot find project ID %d", id)
+				"cannot find %s ID %d", what, id)
 			return
 		}
 		f(context.WithValue(ctx, projectKey, p), w, r)
@@ -188,6 +516,10 @@ func WithMethods(args ...interface{}) http.HandlerFunc {
 		}
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*statusWriter); !ok {
+			w = &statusWriter{ResponseWriter: w}
+		}
+		defer recoverPanic(w, r)
 		f, ok := methods[r.Method]
 		if !ok {
 			ErrorResponse(w, http.StatusMethodNotAllowed,
@@ -283,6 +615,7 @@ func WithJobID(f HandlerFunc) HandlerFunc {
 // given id is optional.  If all keys can be found the function return
 // true or false if a key is missing.  Missing optional keys do not
 // cause this function to return false if the key/id pair is missing.
+// IDs are parsed as 64-bit integers (see ParseIDs).
 func GetIDs(ids map[string]int, url string) bool {
 	for key := range ids {
 		var opt bool
@@ -315,16 +648,381 @@ func parseInt(str string) (int, string, error) {
 	if pos == -1 {
 		pos = len(str)
 	}
-	id, err := strconv.Atoi(str[0:pos])
+	id, err := parseID(str[0:pos])
 	if err != nil {
 		return 0, "", fmt.Errorf("cannot parse id in string: %s", str)
 	}
 	return id, str[pos:], nil
 }
 
+// parseID parses an id.  IDs are parsed as 64-bit integers.  IDs that
+// do not fit into an int (on platforms with 32-bit ints) result in an
+// error.
+func parseID(str string) (int, error) {
+	id, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if int64(int(id)) != id {
+		return 0, fmt.Errorf("id out of range: %d", id)
+	}
+	return int(id), nil
+}
+
+// MaxGzipRequestSize defines the maximal size of decompressed request
+// bodies that are accepted by WithGzipRequest.
+var MaxGzipRequestSize int64 = 100 << 20
+
+// WithGzipRequest transparently decompresses gzipped request bodies
+// (`Content-Encoding: gzip`).  The size of the decompressed body is
+// limited to MaxGzipRequestSize bytes.  Reading beyond this limit
+// results in an error.  Requests without gzip encoding are passed
+// unchanged.
+func WithGzipRequest(f HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			f(ctx, w, r)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest,
+				"cannot decompress request: %v", err)
+			return
+		}
+		defer gz.Close()
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.Body = http.MaxBytesReader(w, gz, MaxGzipRequestSize)
+		f(ctx, w, r)
+	}
+}
+
+// MaxResponseCacheSize defines the maximal size of responses that are
+// buffered by WithResponseCache.  Larger responses are streamed
+// without an ETag.
+var MaxResponseCacheSize int64 = 1 << 20
+
+// WithResponseCache adds conditional GET support to the given handler.
+// The response of GET and HEAD requests is buffered and its ETag (a
+// hash of the response body) is computed.  If the ETag matches the
+// `If-None-Match` header of the request, 304 Not Modified is sent
+// instead of the response.  Only successful (200) responses are
+// cached.  Responses larger than MaxResponseCacheSize are streamed
+// straight through without an ETag.
+func WithResponseCache(f HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			f(ctx, w, r)
+			return
+		}
+		cw := &cacheWriter{ResponseWriter: w}
+		f(ctx, cw, r)
+		if cw.streaming {
+			return
+		}
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if cw.status == http.StatusOK {
+			sum := sha256.Sum256(cw.buf.Bytes())
+			etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			w.Header().Set("ETag", etag)
+			if etagMatch(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Length")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(cw.status)
+		if _, err := w.Write(cw.buf.Bytes()); err != nil {
+			ulog.Write("cannot write cached response", "err", err)
+		}
+	}
+}
+
+// etagMatch returns true if the given If-None-Match header matches the
+// given etag.  Weak comparison is used.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheWriter buffers the response until it exceeds
+// MaxResponseCacheSize bytes.
+type cacheWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	status    int
+	streaming bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+	if int64(w.buf.Len()+len(p)) <= MaxResponseCacheSize {
+		return w.buf.Write(p)
+	}
+	// too large: stream the response
+	w.streaming = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	w.buf.Reset()
+	return w.ResponseWriter.Write(p)
+}
+
+// IdempotencyKeyHeader defines the header of the idempotency keys (see
+// WithIdempotency).
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyTTL defines how long the responses of idempotent requests
+// are stored (see WithIdempotency).
+var IdempotencyTTL = 24 * time.Hour
+
+// StoredResponse defines a response that is stored for an
+// idempotency key.
+type StoredResponse struct {
+	Header http.Header
+	Body   []byte
+	Status int
+}
+
+// IdempotencyStore stores the responses of idempotent requests (see
+// WithIdempotency).  Get must not return responses whose TTL has
+// expired.  Implementations must be safe for concurrent use.  A
+// database backed store can be used to share the responses between
+// multiple instances of a service.
+type IdempotencyStore interface {
+	Get(key string) (*StoredResponse, bool, error)
+	Put(key string, r StoredResponse, ttl time.Duration) error
+}
+
+// NewMemoryIdempotencyStore returns a new in-memory IdempotencyStore.
+// Expired responses are removed with the next call to Put.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryStore{responses: make(map[string]memoryResponse)}
+}
+
+type memoryResponse struct {
+	expires time.Time
+	r       StoredResponse
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	responses map[string]memoryResponse
+}
+
+func (s *memoryStore) Get(key string) (*StoredResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.responses[key]
+	if !ok || time.Now().After(r.expires) {
+		return nil, false, nil
+	}
+	return &r.r, true, nil
+}
+
+func (s *memoryStore) Put(key string, r StoredResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, r := range s.responses {
+		if now.After(r.expires) {
+			delete(s.responses, k)
+		}
+	}
+	s.responses[key] = memoryResponse{expires: now.Add(ttl), r: r}
+	return nil
+}
+
+// WithIdempotency makes requests with an Idempotency-Key header
+// idempotent.  The response to the first request with a key is stored
+// in the given store for IdempotencyTTL.  Repeated requests with the
+// same key get the stored response and the given callback function is
+// not called again.  A repeated request that arrives while the first
+// request is still handled gets 409 Conflict.  Keys are scoped to the
+// user of the registered session (if any), the method and the path of
+// the request.  Server errors (5xx) and responses larger than
+// MaxResponseCacheSize are not stored, so these requests can be
+// retried.  The TraceIDHeader and hop-by-hop headers of the response
+// are neither stored nor replayed.  Requests without the header are
+// not affected.
+func WithIdempotency(store IdempotencyStore, f HandlerFunc) HandlerFunc {
+	var mu sync.Mutex
+	inflight := make(map[string]bool)
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			f(ctx, w, r)
+			return
+		}
+		var uid int64
+		if u, ok := UserFromCtx(ctx); ok {
+			uid = u.ID
+		}
+		key = fmt.Sprintf("%d %s %s %s", uid, r.Method, r.URL.Path, key)
+		mu.Lock()
+		if inflight[key] {
+			mu.Unlock()
+			ErrorResponse(w, http.StatusConflict,
+				"cannot handle request: request with the same %s in progress", IdempotencyKeyHeader)
+			return
+		}
+		inflight[key] = true
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(inflight, key)
+			mu.Unlock()
+		}()
+		stored, found, err := store.Get(key)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError,
+				"cannot handle request: %v", err)
+			return
+		}
+		if found {
+			for k, v := range replayableHeader(stored.Header) {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(stored.Status)
+			if _, err := w.Write(stored.Body); err != nil {
+				ulog.Write("cannot write stored response", "err", err)
+			}
+			return
+		}
+		cw := &cacheWriter{ResponseWriter: w}
+		f(ctx, cw, r)
+		if cw.streaming {
+			return
+		}
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if cw.status < 500 {
+			resp := StoredResponse{Header: replayableHeader(w.Header()), Body: cw.buf.Bytes(), Status: cw.status}
+			if err := store.Put(key, resp, IdempotencyTTL); err != nil {
+				ulog.Write("cannot store response", "err", err)
+			}
+		}
+		w.WriteHeader(cw.status)
+		if _, err := w.Write(cw.buf.Bytes()); err != nil {
+			ulog.Write("cannot write response", "err", err)
+		}
+	}
+}
+
+// unreplayableHeaders lists the headers that must not be replayed from
+// stored responses: the per-request trace id and the hop-by-hop headers
+// (RFC 7230, section 6.1).
+var unreplayableHeaders = []string{
+	TraceIDHeader,
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// replayableHeader returns a copy of the given header without the
+// unreplayable headers.
+func replayableHeader(h http.Header) http.Header {
+	ret := h.Clone()
+	for _, k := range unreplayableHeaders {
+		ret.Del(k)
+	}
+	return ret
+}
+
+// WithContentLengthLimit rejects requests with a Content-Length
+// larger than max bytes with 413 Request Entity Too Large.  The
+// request body is additionally limited to max bytes, so requests
+// without a Content-Length (e.g. chunked requests) are bounded as
+// well.  Reading more than max bytes from such a body results in an
+// error.
+func WithContentLengthLimit(max int64, f HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			ErrorResponse(w, http.StatusRequestEntityTooLarge,
+				"request too large: %d bytes (max %d bytes)", r.ContentLength, max)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		f(ctx, w, r)
+	}
+}
+
+// TraceIDHeader defines the header of request (trace) IDs.
+const TraceIDHeader = "X-Request-ID"
+
+// maxTraceIDLen defines the maximal length of accepted incoming trace
+// IDs.
+const maxTraceIDLen = 128
+
+// WithTraceID reads the request ID from the X-Request-ID header of the
+// request or generates a new one if the header is missing or invalid.
+// The ID is put into the context and can be retrieved with
+// TraceIDFromCtx(ctx).  The ID is echoed in the X-Request-ID header of
+// the response and included in the bodies of error responses.
+func WithTraceID(f HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(TraceIDHeader)
+		if !validTraceID(id) {
+			id = newTraceID()
+		}
+		w.Header().Set(TraceIDHeader, id)
+		f(context.WithValue(ctx, traceIDKey, id), w, r)
+	}
+}
+
+func validTraceID(id string) bool {
+	if id == "" || len(id) > maxTraceIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' { // printable ascii only
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// should not happen; fall back to a time based id
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
 // WithAuth checks if the given request contains a valid
 // authentication token.  The authentification token can either be a
-// auth=xyz query parameter or an Authorization header.
+// auth=xyz query parameter or an Authorization header.  The name of
+// the query parameter is configured with api.AuthParam.
 //
 // If not an appropriate error is returned before the given callback
 // function is called.  If the authentification succeeds, the session
@@ -362,18 +1060,216 @@ func WithAuth(f HandlerFunc) HandlerFunc {
 	}
 }
 
+// WithAuthOptional works like WithAuth, but does not require a valid
+// authentication.  If the request contains a valid authentication
+// token, the session is put into the context.  Otherwise the given
+// callback function is called without a session.  Use
+// AuthFromCtxOK(ctx) to check if a session is available.
+func WithAuthOptional(f HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		auth, ok := checkAuth(r)
+		if !ok {
+			f(ctx, w, r)
+			return
+		}
+		s, found, err := db.FindSessionByID(pool, auth)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError,
+				"cannot authenticate: %v", err)
+			return
+		}
+		if !found || s.Expired() {
+			ulog.Write("ignoring invalid authentication", "auth", auth)
+			f(ctx, w, r)
+			return
+		}
+		f(context.WithValue(ctx, authKey, s), w, r)
+	}
+}
+
+// WithBasicAuth works like WithAuth, but additionally accepts HTTP
+// basic authentication for clients that cannot use the login flow.
+// If the request contains an `Authorization: Basic` header, the user
+// is looked up by its email and authenticated with the given
+// password.  On success a synthetic session (with an empty auth
+// token) is put into the context; the session is never stored in the
+// database.  All other requests are handled by WithAuth.
+//
+// Basic authentication hashes the password on every request and is
+// therefore much more expensive than token based authentication.  Use
+// it only for the handlers that need it.
+func WithBasicAuth(f HandlerFunc) HandlerFunc {
+	withAuth := WithAuth(f)
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		email, password, ok := r.BasicAuth()
+		if !ok {
+			withAuth(ctx, w, r)
+			return
+		}
+		ulog.Write("authenticating (basic)", "email", email)
+		user, found, err := db.FindUserByEmail(pool, email)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError,
+				"cannot authenticate: %v", err)
+			return
+		}
+		if !found || db.AuthenticateUser(pool, user, password) != nil {
+			ErrorResponse(w, http.StatusUnauthorized,
+				"cannot authenticate: invalid authentification")
+			return
+		}
+		s := &api.Session{User: user, Expires: time.Now().Add(db.Expires).Unix()}
+		ulog.Write("authenticated (basic)", "user", s.User)
+		f(context.WithValue(ctx, authKey, s), w, r)
+	}
+}
+
+// roles ranks the roles; see api.RoleUser.
+var roles = map[string]int{
+	api.RoleUser:        1,
+	api.RoleCoordinator: 2,
+	api.RoleAdmin:       3,
+}
+
+// WithRole checks that the user of the registered session has at
+// least the given role (see api.RoleUser) before the given callback
+// function is called.  It must be used after WithAuth.  If a project
+// was registered (see WithProject), the role is determined with
+// respect to the project: only the owner, coordinators of the owner's
+// institute and admins can access it (see db.FindUserRole).  Use
+// WithRole(api.RoleUser, f) to restrict projects to these users.
+//
+// WithRole panics if the given role is unknown.
+func WithRole(role string, f HandlerFunc) HandlerFunc {
+	if _, ok := roles[role]; !ok {
+		panic(fmt.Sprintf("invalid role: %q", role))
+	}
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		s := AuthFromCtx(ctx)
+		if s.Expired() {
+			ErrorResponse(w, http.StatusUnauthorized,
+				"cannot authenticate: session expired: %s",
+				time.Unix(s.Expires, 0).Format(time.RFC3339))
+			return
+		}
+		p, _ := ctx.Value(projectKey).(*db.Project)
+		got, err := db.FindUserRole(pool, s.User, p)
+		if err != nil {
+			ErrorResponse(w, http.StatusInternalServerError,
+				"cannot find role: %v", err)
+			return
+		}
+		if roles[got] < roles[role] {
+			ErrorResponse(w, http.StatusForbidden,
+				"cannot access %s: user %s is not a %s", r.URL.Path, s.User, role)
+			return
+		}
+		f(ctx, w, r)
+	}
+}
+
 func checkAuth(r *http.Request) (string, bool) {
 	auth := r.Header.Get("Authorization")
 	if auth != "" {
 		return auth, true
 	}
-	auth = r.URL.Query().Get("auth")
+	auth = r.URL.Query().Get(api.AuthParam)
 	if auth != "" {
 		return auth, true
 	}
 	return "", false
 }
 
+// WithConcurrencyLimit limits the number of concurrently handled
+// requests of the given handler to max.  Requests exceeding the limit
+// are not queued but rejected immediately with 503 Service
+// Unavailable and a `Retry-After` header of one second.
+//
+// WithConcurrencyLimit panics if max is not positive.
+func WithConcurrencyLimit(max int, f http.HandlerFunc) http.HandlerFunc {
+	if max <= 0 {
+		panic(fmt.Sprintf("invalid concurrency limit: %d", max))
+	}
+	sem := make(chan struct{}, max)
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			f(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			ErrorResponse(w, http.StatusServiceUnavailable,
+				"cannot handle request: too many concurrent requests")
+		}
+	}
+}
+
+// FrameOptions defines the value of the X-Frame-Options header that
+// is set by WithSecureHeaders.  Set it to "SAMEORIGIN" to allow
+// embedding of views in iframes of the same origin.
+var FrameOptions = "DENY"
+
+// StrictTransportSecurity defines the value of the
+// Strict-Transport-Security header that is set by WithSecureHeaders
+// for requests served over TLS.  If empty, no HSTS header is set.
+var StrictTransportSecurity = "max-age=63072000; includeSubDomains"
+
+// WithSecureHeaders sets security related headers on every response:
+// `X-Content-Type-Options: nosniff`, `X-Frame-Options` (see
+// FrameOptions) and `Referrer-Policy: no-referrer`.  For requests
+// served over TLS the Strict-Transport-Security header is set as well
+// (see StrictTransportSecurity).
+func WithSecureHeaders(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", FrameOptions)
+		h.Set("Referrer-Policy", "no-referrer")
+		if r.TLS != nil && StrictTransportSecurity != "" {
+			h.Set("Strict-Transport-Security", StrictTransportSecurity)
+		}
+		f(w, r)
+	}
+}
+
+// WithRecover recovers from panics of the given handler and answers
+// them with an internal server error.  Panics of context accessors
+// (e.g. ProjectFromCtx) name the middleware that was not applied.
+// WithMethods recovers from panics, too.
+func WithRecover(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*statusWriter); !ok {
+			w = &statusWriter{ResponseWriter: w}
+		}
+		defer recoverPanic(w, r)
+		f(w, r)
+	}
+}
+
+// recoverPanic logs the recovered panic with its stack trace and
+// answers it with an internal server error.  The panic value is not
+// sent to the client.  If the handler already sent the status of the
+// response, no error response is written.
+func recoverPanic(w http.ResponseWriter, r *http.Request) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler { // let net/http abort the response
+		panic(p)
+	}
+	ulog.Write("panic", "method", r.Method, "url", r.URL.String(),
+		"panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+	if sw, ok := w.(*statusWriter); ok && sw.status != 0 {
+		return
+	}
+	if err, ok := p.(missingCtxError); ok {
+		ErrorResponse(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	ErrorResponse(w, http.StatusInternalServerError, "internal server error")
+}
+
 // WithLog wraps logging around the handling of the request.
 func WithLog(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -383,31 +1279,387 @@ func WithLog(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// ErrorResponse writes an error response.  It sets the according
-// response header and sends a json-formatted response object.
+// ErrorFormatter writes the body of error responses (see
+// ErrorResponse).  It can be replaced to change the format of all
+// error responses.  The trace ID of the request (if any) is available
+// in the TraceIDHeader of the response.  The default formatter sends
+// a json-formatted object with the fields code, status, message and
+// traceId.
+var ErrorFormatter = formatError
+
+// ErrorResponse writes an error response.  It logs the error and
+// writes the response using ErrorFormatter.  By default a
+// json-formatted response object is sent.  If the request was wrapped
+// with WithTraceID, the response contains the trace ID of the
+// request.
 func ErrorResponse(w http.ResponseWriter, s int, f string, args ...interface{}) {
 	message := fmt.Sprintf(f, args...)
-	status := http.StatusText(s)
-	ulog.Write("error response", "err", message, "status", status, "code", s)
-	// We must set the Content-Type before the call to WriteHeader.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(s)
-	JSONResponse(w, struct {
+	ulog.Write("error response", "err", message, "status", http.StatusText(s),
+		"code", s, "traceId", w.Header().Get(TraceIDHeader))
+	ErrorFormatter(w, s, message)
+}
+
+var (
+	messagesMu sync.RWMutex
+	messages   = make(map[string]map[string]string)
+)
+
+// RegisterMessages registers the translations of error messages for
+// the given language (e.g. `de` or `de-at`).  The keys of the given
+// map are the (English) format strings that are passed to
+// LocalizedErrorResponse; the values are the translated format
+// strings.  Registering messages for the same language again adds to
+// the existing translations.
+func RegisterMessages(lang string, m map[string]string) {
+	lang = strings.ToLower(lang)
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	if messages[lang] == nil {
+		messages[lang] = make(map[string]string, len(m))
+	}
+	for k, v := range m {
+		messages[lang][k] = v
+	}
+}
+
+// LocalizedErrorResponse works like ErrorResponse, but translates the
+// given message key (an English format string) into the language that
+// is preferred by the Accept-Language header of the given request
+// (see RegisterMessages).  If no translation exists, the key itself is
+// used.  The English message is logged.
+func LocalizedErrorResponse(w http.ResponseWriter, r *http.Request, s int, key string, args ...interface{}) {
+	message := fmt.Sprintf(key, args...)
+	ulog.Write("error response", "err", message, "status", http.StatusText(s),
+		"code", s, "traceId", w.Header().Get(TraceIDHeader))
+	ErrorFormatter(w, s, fmt.Sprintf(translate(r.Header.Get("Accept-Language"), key), args...))
+}
+
+// translate returns the translation of the given key into the most
+// preferred language of the given Accept-Language header.  Regional
+// languages (e.g. `de-at`) fall back to their primary language (`de`).
+func translate(acceptLanguage, key string) string {
+	messagesMu.RLock()
+	defer messagesMu.RUnlock()
+	for _, lang := range acceptLanguages(acceptLanguage) {
+		if m, ok := messages[lang]; ok {
+			if t, ok := m[key]; ok {
+				return t
+			}
+		}
+		if i := strings.IndexByte(lang, '-'); i > 0 {
+			if t, ok := messages[lang[:i]][key]; ok {
+				return t
+			}
+		}
+	}
+	return key
+}
+
+// acceptLanguages returns the (lowercase) languages of the given
+// Accept-Language header ordered by their quality values.  Languages
+// with a quality of 0 are skipped.
+func acceptLanguages(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		langs = append(langs, lang{tag, q})
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+func formatError(w http.ResponseWriter, s int, message string) {
+	JSONResponseStatus(w, s, struct {
 		Code    int    `json:"code"`
 		Status  string `json:"status"`
 		Message string `json:"message"`
-	}{s, status, message})
+		TraceID string `json:"traceId,omitempty"`
+	}{s, http.StatusText(s), message, w.Header().Get(TraceIDHeader)})
 }
 
-// JSONResponse writes a json-formatted response.  Any errors are
-// being logged.
+// JSONResponse writes a json-formatted response with an implicit
+// status of 200.  Any errors are being logged.
 func JSONResponse(w http.ResponseWriter, data interface{}) {
+	JSONResponseStatus(w, http.StatusOK, data)
+}
+
+// JSONResponseStatus writes a json-formatted response with the given
+// status code.  If the response was already written by a previous
+// call (only detectable for response writers wrapped by WithMethods
+// or WithRecover), nothing is written and a warning is logged.  Any
+// errors are being logged.
+func JSONResponseStatus(w http.ResponseWriter, status int, data interface{}) {
+	if sw, ok := w.(*statusWriter); ok && sw.status != 0 {
+		ulog.Write("response already written", "status", sw.status, "ignored", status)
+		return
+	}
+	// We must set the Content-Type before the call to WriteHeader.
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		ulog.Write("cannot write json response", "err", err)
 	}
 }
 
+// WriteAttachment streams the content of the given reader as a file
+// download with the given file name and content type.  Non-ASCII
+// file names are encoded according to RFC 5987; browsers that do not
+// support the encoding see an ASCII approximation of the name.
+func WriteAttachment(w http.ResponseWriter, filename, contentType string, r io.Reader) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(filename))
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("cannot write attachment %s: %v", filename, err)
+	}
+	return nil
+}
+
+// contentDisposition returns the Content-Disposition header for an
+// attachment with the given file name.
+func contentDisposition(filename string) string {
+	var ascii strings.Builder
+	plain := true
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			ascii.WriteByte('_')
+		case r < 0x20 || r >= 0x7f:
+			plain = false
+			ascii.WriteByte('_')
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+	h := `attachment; filename="` + ascii.String() + `"`
+	if plain {
+		return h
+	}
+	return h + "; filename*=UTF-8''" + rfc5987Escape(filename)
+}
+
+// rfc5987Escape percent-encodes all bytes of str that are not
+// attr-chars as defined by RFC 5987.
+func rfc5987Escape(str string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// WriteBookZip streams a ZIP archive of the given project as file
+// download.  The archive contains the image (if any) and the
+// corrected text of each page of the project.  The files of page 7
+// are named pages/00007.<ext> and pages/00007.txt.  The image paths
+// are resolved relative to the book's directory (see
+// db.Book.ResolvePath); paths outside of the directory are rejected.
+//
+// The archive is written while the files are read, so the memory
+// usage does not depend on the size of the book.  All pages are
+// checked before anything is written; if an error is returned and the
+// response was not yet written, the caller can still send an error
+// response.
+func WriteBookZip(ctx context.Context, w http.ResponseWriter, dtb db.DB, p *db.Project) error {
+	ids, err := db.FindProjectPages(dtb, p.ProjectID)
+	if err != nil {
+		return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+	}
+	sort.Ints(ids)
+	images := make([]string, len(ids))
+	for i, id := range ids {
+		page, found, err := db.FindPageByID(dtb, p.BookID, id)
+		if err != nil {
+			return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+		}
+		if !found {
+			return fmt.Errorf("cannot write zip for project %d: missing page %d", p.ProjectID, id)
+		}
+		if page.ImagePath == "" {
+			continue
+		}
+		if images[i], err = p.ResolvePath(page.ImagePath); err != nil {
+			return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		contentDisposition(fmt.Sprintf("project-%d.zip", p.ProjectID)))
+	zw := zip.NewWriter(w)
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+		}
+		if images[i] != "" {
+			name := fmt.Sprintf("pages/%05d%s", id, filepath.Ext(images[i]))
+			if err := writeZipFile(zw, name, images[i]); err != nil {
+				return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+			}
+		}
+		text, err := db.PageText(dtb, p.BookID, id)
+		if err != nil {
+			return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+		}
+		out, err := zw.Create(fmt.Sprintf("pages/%05d.txt", id))
+		if err != nil {
+			return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+		}
+		if _, err := io.WriteString(out, text); err != nil {
+			return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("cannot write zip for project %d: %v", p.ProjectID, err)
+	}
+	return nil
+}
+
+// writeZipFile copies the file with the given path into the zip
+// archive.  The file is stored without compression, since images are
+// already compressed.
+func writeZipFile(zw *zip.Writer, name, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// statusWriter wraps a http.ResponseWriter and remembers the status
+// code that was written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the wrapped response writer if it supports flushing.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the connection of the wrapped response writer.  It
+// is an error if the wrapped response writer does not support
+// hijacking.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("cannot hijack connection: not supported")
+	}
+	return h.Hijack()
+}
+
+// MinGzipResponseSize defines the minimal size of json responses
+// that are gzipped by Respond.  Smaller responses are sent
+// uncompressed.
+var MinGzipResponseSize = 1024
+
+// Respond writes a json-formatted response with an implicit status of
+// 200.  The response is gzipped if the client accepts gzip encoded
+// responses (`Accept-Encoding: gzip`) and if the response is at least
+// MinGzipResponseSize bytes long.  Any errors are being logged.
+func Respond(w http.ResponseWriter, r *http.Request, data interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(data); err != nil {
+		ErrorResponse(w, http.StatusInternalServerError,
+			"cannot encode json response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Encoding")
+	if buf.Len() < MinGzipResponseSize || !acceptsGzip(r) {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			ulog.Write("cannot write json response", "err", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		ulog.Write("cannot write gzipped json response", "err", err)
+	}
+	if err := gz.Close(); err != nil {
+		ulog.Write("cannot write gzipped json response", "err", err)
+	}
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of the given
+// request contains gzip (with a non-zero quality).
+func acceptsGzip(r *http.Request) bool {
+	for _, h := range r.Header["Accept-Encoding"] {
+		for _, enc := range strings.Split(h, ",") {
+			fields := strings.Split(enc, ";")
+			if strings.TrimSpace(fields[0]) != "gzip" {
+				continue
+			}
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(param[2:], 64)
+					return err == nil && q > 0
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
 // GZIPJSONResponse writes a gzipped json-formatted response.  Any
 // errors are being logged.
 func GZIPJSONResponse(w http.ResponseWriter, data interface{}) {
@@ -421,12 +1673,14 @@ func GZIPJSONResponse(w http.ResponseWriter, data interface{}) {
 }
 
 // ParseIDs parses the numeric fields of the given regex into the
-// given id pointers.  It returns the number of ids parsed.
+// given id pointers.  It returns the number of ids parsed.  IDs are
+// parsed as 64-bit integers; on platforms with 32-bit ints, ids
+// outside of the int range are rejected.
 func ParseIDs(url string, re *regexp.Regexp, ids ...*int) int {
 	m := re.FindStringSubmatch(url)
 	var i int
 	for i = 0; i < len(ids) && i+1 < len(m); i++ {
-		id, err := strconv.Atoi(m[i+1])
+		id, err := parseID(m[i+1])
 		if err != nil {
 			return 0
 		}
@@ -435,14 +1689,54 @@ func ParseIDs(url string, re *regexp.Regexp, ids ...*int) int {
 	return i
 }
 
+// FileChecksum returns the hex-encoded sha256 checksum of the given
+// file.
+func FileChecksum(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot compute checksum: %v", err)
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", fmt.Errorf("cannot compute checksum: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // LinkOrCopy tries to hard link dest to src.  If the file or link
 // already exists nothing is done and no error is returned.  If the
-// linking fails, LinkOrCopy tries to copy src to dest.
-func LinkOrCopy(src, dest string) (err error) {
+// linking fails, LinkOrCopy tries to copy src to dest.  Use
+// ReplaceLinkOrCopy to replace existing files.
+func LinkOrCopy(src, dest string) error {
 	if err := os.Link(src, dest); err == nil || os.IsExist(err) {
 		return nil
 	}
-	// Cannot link -> copy
+	return copyFile(src, dest)
+}
+
+// ReplaceLinkOrCopy works like LinkOrCopy, but replaces an existing
+// dest that differs from src.  If dest already exists and is the same
+// file as src or has the same checksum, nothing is done and no error
+// is returned.
+func ReplaceLinkOrCopy(src, dest string) error {
+	err := os.Link(src, dest)
+	if os.IsExist(err) {
+		if sameFile(src, dest) {
+			return nil
+		}
+		if err := os.Remove(dest); err != nil {
+			return fmt.Errorf("cannot replace file: %v", err)
+		}
+		err = os.Link(src, dest)
+	}
+	if err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+func copyFile(src, dest string) (err error) {
 	in, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("cannot copy file: %v", err)
@@ -463,3 +1757,36 @@ func LinkOrCopy(src, dest string) (err error) {
 	}
 	return nil
 }
+
+// sameFile returns true if a and b are the same file (e.g. hard links
+// of each other) or if they have the same content.  The checksums of
+// the files are only computed if they are not the same file.
+func sameFile(a, b string) bool {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	if os.SameFile(sa, sb) {
+		return true
+	}
+	if sa.Size() != sb.Size() {
+		return false
+	}
+	return sameChecksum(a, b)
+}
+
+func sameChecksum(a, b string) bool {
+	ca, err := FileChecksum(a)
+	if err != nil {
+		return false
+	}
+	cb, err := FileChecksum(b)
+	if err != nil {
+		return false
+	}
+	return ca == cb
+}
@@ -1,11 +1,62 @@
 package service
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/finkf/pcwgo/api"
+	"github.com/finkf/pcwgo/db"
+	"github.com/finkf/pcwgo/db/sqlite"
+	"github.com/go-sql-driver/mysql"
 )
 
+// withSession sets up a temporary sessions database as the pool and
+// calls f with the pool and a valid session.
+func withSession(t *testing.T, f func(*sql.DB, *api.Session)) {
+	t.Helper()
+	sqlite.With("service.sqlite", func(dtb *sql.DB) {
+		if err := db.CreateTableUsers(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := db.CreateTableSessions(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		user := api.User{Name: "test", Email: "test@example.com"}
+		if err := db.InsertUser(dtb, &user); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		s, err := db.InsertSession(dtb, user)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		defer func(old *sql.DB) { pool = old }(pool)
+		pool = dtb
+		f(dtb, s)
+	})
+}
+
 func TestGetIDs(t *testing.T) {
 	tests := []struct {
 		url     string
@@ -24,6 +75,8 @@ func TestGetIDs(t *testing.T) {
 		{"/jobs/1?auth=xyz", []string{"jobs"}, map[string]int{"jobs": 1}, false},
 		/* not a valid int */
 		{"/jobs/1/books/3foobar/", []string{"jobs", "books"}, nil, true},
+		/* out of int64 range */
+		{"/jobs/9223372036854775808", []string{"jobs"}, nil, true},
 	}
 	for _, tc := range tests {
 		t.Run(tc.url, func(t *testing.T) {
@@ -45,6 +98,36 @@ func TestGetIDs(t *testing.T) {
 	}
 }
 
+func TestParseIDsInt64Range(t *testing.T) {
+	re := regexp.MustCompile(`/a/(\d+)`)
+	tests := []struct {
+		test string
+		want int64
+		n    int
+	}{
+		{"/a/0", 0, 1},
+		{"/a/2147483647", math.MaxInt32, 1},
+		{"/a/2147483648", math.MaxInt32 + 1, 1},
+		{"/a/9223372036854775807", math.MaxInt64, 1},
+		{"/a/9223372036854775808", 0, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.test, func(t *testing.T) {
+			n := tc.n
+			if strconv.IntSize == 32 && tc.want > math.MaxInt32 {
+				n = 0 // does not fit into int
+			}
+			var id int
+			if got := ParseIDs(tc.test, re, &id); got != n {
+				t.Fatalf("expected %d; got %d", n, got)
+			}
+			if n == 1 && int64(id) != tc.want {
+				t.Fatalf("expected %d; got %d", tc.want, id)
+			}
+		})
+	}
+}
+
 func TestParseIDs(t *testing.T) {
 	tests := []struct {
 		test string
@@ -104,3 +187,1243 @@ func TestParseIDs(t *testing.T) {
 		})
 	}
 }
+
+func TestJSONResponseStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(http.ResponseWriter)
+		want int
+	}{
+		{"201", func(w http.ResponseWriter) {
+			JSONResponseStatus(w, http.StatusCreated, "created")
+		}, http.StatusCreated},
+		{"200", func(w http.ResponseWriter) {
+			JSONResponse(w, "ok")
+		}, http.StatusOK},
+		{"double write", func(w http.ResponseWriter) {
+			JSONResponseStatus(w, http.StatusCreated, "created")
+			ErrorResponse(w, http.StatusInternalServerError, "error")
+		}, http.StatusCreated},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tc.f(&statusWriter{ResponseWriter: rec})
+			if rec.Code != tc.want {
+				t.Fatalf("expected status %d; got %d", tc.want, rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("invalid content type: %s", ct)
+			}
+			// the body must contain exactly one json value
+			dec := json.NewDecoder(rec.Body)
+			var data interface{}
+			if err := dec.Decode(&data); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if dec.More() {
+				t.Fatalf("expected one json value in the body")
+			}
+		})
+	}
+}
+
+func TestStatusWriterInterfaces(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = &statusWriter{ResponseWriter: rec}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatalf("expected a http.Flusher")
+	}
+	f.Flush()
+	if !rec.Flushed {
+		t.Fatalf("expected the wrapped writer to be flushed")
+	}
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		t.Fatalf("expected a http.Hijacker")
+	}
+	// httptest.ResponseRecorder does not support hijacking
+	if _, _, err := h.Hijack(); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestWithBasicAuth(t *testing.T) {
+	withSession(t, func(dtb *sql.DB, s *api.Session) {
+		if err := db.SetUserPassword(dtb, s.User, "password"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		tests := []struct {
+			name, email, password, auth string
+			want                        int
+		}{
+			{"valid", s.User.Email, "password", "", http.StatusOK},
+			{"invalid-password", s.User.Email, "invalid", "", http.StatusUnauthorized},
+			{"invalid-email", "invalid@example.com", "password", "", http.StatusUnauthorized},
+			{"token", "", "", s.Auth, http.StatusOK},
+			{"missing", "", "", "", http.StatusUnauthorized},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				var got *api.Session
+				h := WithBasicAuth(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+					got = AuthFromCtx(ctx)
+				})
+				r := httptest.NewRequest(http.MethodGet, "/books", nil)
+				if tc.email != "" {
+					r.SetBasicAuth(tc.email, tc.password)
+				}
+				if tc.auth != "" {
+					r.Header.Set("Authorization", tc.auth)
+				}
+				rec := httptest.NewRecorder()
+				h(context.Background(), rec, r)
+				if rec.Code != tc.want {
+					t.Fatalf("expected status %d; got %d", tc.want, rec.Code)
+				}
+				if tc.want != http.StatusOK {
+					return
+				}
+				if got == nil || got.User.ID != s.User.ID || got.Expired() {
+					t.Fatalf("invalid session: %v", got)
+				}
+			})
+		}
+		// no session is stored for basic authentication
+		sessions, err := db.FindSessionsByUser(dtb, s.User.ID)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if len(sessions) != 1 {
+			t.Fatalf("expected 1 session; got %d", len(sessions))
+		}
+	})
+}
+
+func TestWithAuthOptional(t *testing.T) {
+	withSession(t, func(_ *sql.DB, s *api.Session) {
+		tests := []struct {
+			name, auth string
+			want       bool
+		}{
+			{"valid", s.Auth, true},
+			{"missing", "", false},
+			{"invalid", "invalid", false},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				var called, got bool
+				h := WithAuthOptional(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+					called = true
+					_, got = AuthFromCtxOK(ctx)
+				})
+				r := httptest.NewRequest(http.MethodGet, "/books", nil)
+				if tc.auth != "" {
+					r.Header.Set("Authorization", tc.auth)
+				}
+				rec := httptest.NewRecorder()
+				h(context.Background(), rec, r)
+				if !called {
+					t.Fatalf("handler was not called: %d", rec.Code)
+				}
+				if got != tc.want {
+					t.Fatalf("expected session=%t; got %t", tc.want, got)
+				}
+			})
+		}
+	})
+}
+
+func TestUserFromCtx(t *testing.T) {
+	if _, ok := UserFromCtx(context.Background()); ok {
+		t.Fatalf("found user in empty context")
+	}
+	if IsAdmin(context.Background()) {
+		t.Fatalf("empty context is admin")
+	}
+	s := &api.Session{User: api.User{ID: 42, Email: "test@example.com", Admin: true}}
+	ctx := context.WithValue(context.Background(), authKey, s)
+	u, ok := UserFromCtx(ctx)
+	if !ok {
+		t.Fatalf("cannot find user")
+	}
+	if u != s.User {
+		t.Fatalf("expected user %s; got %s", s.User, u)
+	}
+	if !IsAdmin(ctx) {
+		t.Fatalf("expected admin")
+	}
+}
+
+func TestPoolBeforeInit(t *testing.T) {
+	defer func(old *sql.DB) { pool = old }(pool)
+	pool = nil
+	Close() // must not panic
+	if _, err := PoolOrErr(); err != ErrNotInitialized {
+		t.Fatalf("expected error %v; got %v", ErrNotInitialized, err)
+	}
+}
+
+func TestWithGzipRequest(t *testing.T) {
+	const payload = `{"correction":"test"}`
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(payload))
+	gz.Close()
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		max      int64
+		want     string
+		iserr    bool
+	}{
+		{"plain", []byte(payload), "", 1024, payload, false},
+		{"gzip", gzipped.Bytes(), "gzip", 1024, payload, false},
+		{"too large", gzipped.Bytes(), "gzip", 4, "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(old int64) { MaxGzipRequestSize = old }(MaxGzipRequestSize)
+			MaxGzipRequestSize = tc.max
+			var got string
+			var err error
+			h := WithGzipRequest(func(_ context.Context, w http.ResponseWriter, r *http.Request) {
+				var body []byte
+				body, err = ioutil.ReadAll(r.Body)
+				got = string(body)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/books", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			h(context.Background(), httptest.NewRecorder(), r)
+			if tc.iserr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcwgo-service")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		return path
+	}
+	checksum := func(path string) string {
+		c, err := FileChecksum(path)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		return c
+	}
+	a, b, c := write("a", "image"), write("b", "image"), write("c", "changed image")
+	if checksum(a) != checksum(b) {
+		t.Fatalf("identical files have different checksums")
+	}
+	if checksum(a) == checksum(c) {
+		t.Fatalf("different files have the same checksum")
+	}
+	// LinkOrCopy keeps existing destinations
+	if err := LinkOrCopy(c, b); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if checksum(b) != checksum(a) {
+		t.Fatalf("destination was replaced")
+	}
+	// ReplaceLinkOrCopy replaces existing different destinations
+	if err := ReplaceLinkOrCopy(c, b); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if checksum(b) != checksum(c) {
+		t.Fatalf("destination was not replaced")
+	}
+	if checksum(a) == checksum(c) {
+		t.Fatalf("source was changed")
+	}
+	// linking the same file again is a no-op
+	if err := ReplaceLinkOrCopy(c, b); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if !sameFile(c, b) {
+		t.Fatalf("expected the same file")
+	}
+}
+
+func TestWithRole(t *testing.T) {
+	sqlite.With("service.sqlite", func(dtb *sql.DB) {
+		if err := db.CreateAllTables(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := db.CreateTableSessions(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		defer func(old *sql.DB) { pool = old }(pool)
+		pool = dtb
+		sessions := make(map[string]*api.Session)
+		for _, u := range []api.User{
+			{Name: "owner", Email: "owner", Institute: "a"},
+			{Name: "coordA", Email: "coordA", Institute: "a"},
+			{Name: "coordB", Email: "coordB", Institute: "b"},
+			{Name: "memberA", Email: "memberA", Institute: "a"},
+		} {
+			if err := db.InsertUser(dtb, &u); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			s, err := db.InsertSession(dtb, u)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			sessions[u.Name] = s
+		}
+		if err := db.InsertCoordinator(dtb, sessions["coordA"].User.ID, "a"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if err := db.InsertCoordinator(dtb, sessions["coordB"].User.ID, "b"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// the first project is the book's own project (ID==BookID);
+		// the second one is a split project of the book
+		book := db.Book{BookID: 1, Directory: "dir", Lang: "german"}
+		if err := db.InsertBook(dtb, &book); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		p := db.Project{Book: book, Owner: sessions["owner"].User, Pages: 1}
+		if err := db.InsertProject(dtb, &p); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		ok := func(context.Context, http.ResponseWriter, *http.Request) {}
+		project := WithAuth(WithProject(WithRole(api.RoleUser, ok)))
+		coordinator := WithAuth(WithRole(api.RoleCoordinator, ok))
+		tests := []struct {
+			name, user string
+			h          HandlerFunc
+			want       int
+		}{
+			{"project-owner", "owner", project, http.StatusOK},
+			{"project-coordinator-within-institute", "coordA", project, http.StatusOK},
+			{"project-coordinator-outside-institute", "coordB", project, http.StatusForbidden},
+			{"project-member", "memberA", project, http.StatusForbidden},
+			{"coordinator", "coordA", coordinator, http.StatusOK},
+			{"coordinator-user", "owner", coordinator, http.StatusForbidden},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/books/%d", p.ProjectID), nil)
+				r.Header.Set("Authorization", sessions[tc.user].Auth)
+				rec := httptest.NewRecorder()
+				tc.h(context.Background(), rec, r)
+				if rec.Code != tc.want {
+					t.Fatalf("expected status %d; got %d", tc.want, rec.Code)
+				}
+			})
+		}
+	})
+}
+
+func TestWithProjectAndWithBookProject(t *testing.T) {
+	sqlite.With("service.sqlite", func(dtb *sql.DB) {
+		if err := db.CreateAllTables(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		defer func(old *sql.DB) { pool = old }(pool)
+		pool = dtb
+		user := api.User{Name: "test", Email: "test@example.com"}
+		if err := db.InsertUser(dtb, &user); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// the first project is the book's own project (ID==BookID);
+		// the second one is a split project of the book
+		book := db.Book{BookID: 1, Directory: "dir", Lang: "german"}
+		if err := db.InsertBook(dtb, &book); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		var projects []db.Project
+		for i := 0; i < 2; i++ {
+			p := db.Project{Book: book, Owner: user, Pages: 1}
+			if err := db.InsertProject(dtb, &p); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			projects = append(projects, p)
+		}
+		tests := []struct {
+			name   string
+			mw     func(HandlerFunc) HandlerFunc
+			url    string
+			want   int
+			status int
+		}{
+			{"project", WithProject, "/books/2", projects[1].ProjectID, http.StatusOK},
+			{"book", WithBookProject, "/books/1", projects[0].ProjectID, http.StatusOK},
+			{"book as project", WithProject, "/books/1", projects[0].ProjectID, http.StatusOK},
+			{"project as book", WithBookProject, "/books/2", 0, http.StatusNotFound},
+			{"unknown book", WithBookProject, "/books/100", 0, http.StatusNotFound},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				var got int
+				h := tc.mw(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+					got = ProjectFromCtx(ctx).ProjectID
+				})
+				rec := httptest.NewRecorder()
+				h(context.Background(), rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+				if rec.Code != tc.status {
+					t.Fatalf("expected status %d; got %d", tc.status, rec.Code)
+				}
+				if got != tc.want {
+					t.Fatalf("expected project ID %d; got %d", tc.want, got)
+				}
+			})
+		}
+	})
+}
+
+func TestWithContentLengthLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		status        int
+		iserr         bool
+	}{
+		{"ok", "0123456789", 10, http.StatusOK, false},
+		{"declared too large", "0123456789abc", 13, http.StatusRequestEntityTooLarge, false},
+		{"chunked ok", "0123456789", -1, http.StatusOK, false},
+		{"chunked too large", "0123456789abc", -1, http.StatusOK, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var err error
+			h := WithContentLengthLimit(10, func(_ context.Context, w http.ResponseWriter, r *http.Request) {
+				_, err = ioutil.ReadAll(r.Body)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(tc.body))
+			r.ContentLength = tc.contentLength
+			rec := httptest.NewRecorder()
+			h(context.Background(), rec, r)
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d", tc.status, rec.Code)
+			}
+			if (err != nil) != tc.iserr {
+				t.Fatalf("expected error=%t; got %v", tc.iserr, err)
+			}
+		})
+	}
+}
+
+func TestWithSecureHeaders(t *testing.T) {
+	defer func(old string) { FrameOptions = old }(FrameOptions)
+	tests := []struct {
+		frame string
+		tls   bool
+		hsts  string
+	}{
+		{"DENY", false, ""},
+		{"SAMEORIGIN", false, ""},
+		{"DENY", true, StrictTransportSecurity},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s-%t", tc.frame, tc.tls), func(t *testing.T) {
+			FrameOptions = tc.frame
+			req := httptest.NewRequest(http.MethodGet, "/books", nil)
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			w := httptest.NewRecorder()
+			WithSecureHeaders(func(w http.ResponseWriter, r *http.Request) {
+				JSONResponse(w, api.Version{Version: "1.0"})
+			})(w, req)
+			for _, h := range [][2]string{
+				{"X-Content-Type-Options", "nosniff"},
+				{"X-Frame-Options", tc.frame},
+				{"Referrer-Policy", "no-referrer"},
+				{"Strict-Transport-Security", tc.hsts},
+			} {
+				if got := w.Header().Get(h[0]); got != h[1] {
+					t.Fatalf("expected %s: %q; got %q", h[0], h[1], got)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactedDSN(t *testing.T) {
+	defer func(old string) { dsn = old }(dsn)
+	tests := []struct {
+		dsn, want string
+	}{
+		{"user:secret@tcp(db:3306)/pocoweb", "user:*****@tcp(db:3306)/pocoweb"},
+		{"user:s@c:r/et@tcp(db)/pocoweb?parseTime=true", "user:*****@tcp(db)/pocoweb?parseTime=true"},
+		{"user:@unix(/tmp/mysql.sock)/pocoweb", "user:*****@unix(/tmp/mysql.sock)/pocoweb"},
+		{"user@tcp(db)/pocoweb", "user@tcp(db)/pocoweb"},
+		{"/pocoweb", "/pocoweb"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.dsn, func(t *testing.T) {
+			dsn = tc.dsn
+			if got := RedactedDSN(); got != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHandleDBStats(t *testing.T) {
+	withSession(t, func(dtb *sql.DB, s *api.Session) {
+		for _, admin := range []bool{true, false} {
+			t.Run(fmt.Sprint(admin), func(t *testing.T) {
+				s.User.Admin = admin
+				ctx := context.WithValue(context.Background(), authKey, s)
+				w := httptest.NewRecorder()
+				HandleDBStats(ctx, w, httptest.NewRequest(http.MethodGet, "/debug/dbstats", nil))
+				want := http.StatusOK
+				if !admin {
+					want = http.StatusForbidden
+				}
+				if w.Code != want {
+					t.Fatalf("expected status %d; got %d", want, w.Code)
+				}
+			})
+		}
+	})
+}
+
+func TestHandleMetrics(t *testing.T) {
+	h := HandleMetrics(func() interface{} {
+		return map[string]int{"queued": 3}
+	})
+	for _, admin := range []bool{true, false} {
+		t.Run(fmt.Sprint(admin), func(t *testing.T) {
+			s := &api.Session{User: api.User{Admin: admin}}
+			ctx := context.WithValue(context.Background(), authKey, s)
+			w := httptest.NewRecorder()
+			h(ctx, w, httptest.NewRequest(http.MethodGet, "/debug/metrics", nil))
+			want := http.StatusOK
+			if !admin {
+				want = http.StatusForbidden
+			}
+			if w.Code != want {
+				t.Fatalf("expected status %d; got %d", want, w.Code)
+			}
+			if admin && strings.TrimSpace(w.Body.String()) != `{"queued":3}` {
+				t.Fatalf("invalid body: %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithTraceID(t *testing.T) {
+	tests := []struct {
+		name, header string
+		keep         bool
+	}{
+		{"incoming", "abc-123", true},
+		{"missing", "", false},
+		{"invalid", "abc 123", false},
+		{"too-long", strings.Repeat("x", maxTraceIDLen+1), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/books", nil)
+			if tc.header != "" {
+				req.Header.Set(TraceIDHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			var got string
+			WithTraceID(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				got = TraceIDFromCtx(ctx)
+				ErrorResponse(w, http.StatusNotFound, "not found")
+			})(context.Background(), w, req)
+			if got == "" {
+				t.Fatalf("missing trace id")
+			}
+			if tc.keep && got != tc.header {
+				t.Fatalf("expected trace id %q; got %q", tc.header, got)
+			}
+			if !tc.keep && got == tc.header {
+				t.Fatalf("expected a new trace id; got %q", got)
+			}
+			if h := w.Header().Get(TraceIDHeader); h != got {
+				t.Fatalf("expected header %q; got %q", got, h)
+			}
+			var body struct {
+				TraceID string `json:"traceId"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if body.TraceID != got {
+				t.Fatalf("expected trace id %q in body; got %q", got, body.TraceID)
+			}
+		})
+	}
+}
+
+// errDriver is a sql driver that fails to open connections with the
+// given error and counts the connection attempts.
+type errDriver struct {
+	err error
+	n   int
+}
+
+func (d *errDriver) Open(string) (driver.Conn, error) {
+	d.n++
+	return nil, d.err
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		retries int
+	}{
+		{"access-denied", &mysql.MySQLError{Number: 1045, Message: "Access denied"}, 1},
+		{"connection-refused", errors.New("connection refused"), 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func(old *sql.DB) { pool = old }(pool)
+			d := &errDriver{err: tc.err}
+			sql.Register("errdriver-"+tc.name, d)
+			dtb, err := sql.Open("errdriver-"+tc.name, "")
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			defer dtb.Close()
+			pool = dtb
+			err = wait(context.Background(), 3, time.Millisecond)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.Contains(err.Error(), tc.err.Error()) {
+				t.Fatalf("expected error to contain %q; got %v", tc.err, err)
+			}
+			if d.n != tc.retries {
+				t.Fatalf("expected %d attempts; got %d", tc.retries, d.n)
+			}
+		})
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	defer func(old *sql.DB) { pool = old }(pool)
+	sql.Register("errdriver-cancel", &errDriver{err: errors.New("connection refused")})
+	dtb, err := sql.Open("errdriver-cancel", "")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer dtb.Close()
+	pool = dtb
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := wait(ctx, 0, time.Hour); !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected a cancellation error; got %v", err)
+	}
+}
+
+func TestWithConcurrencyLimitInvalid(t *testing.T) {
+	for _, max := range []int{0, -1} {
+		t.Run(strconv.Itoa(max), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected a panic")
+				}
+			}()
+			WithConcurrencyLimit(max, func(http.ResponseWriter, *http.Request) {})
+		})
+	}
+}
+
+func TestWithConcurrencyLimit(t *testing.T) {
+	const max = 3
+	running := make(chan struct{})
+	release := make(chan struct{})
+	h := WithConcurrencyLimit(max, func(w http.ResponseWriter, r *http.Request) {
+		running <- struct{}{}
+		<-release
+	})
+	var wg sync.WaitGroup
+	codes := make([]int, max)
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			codes[i] = w.Code
+		}(i)
+		<-running
+	}
+	// max requests are in flight
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d; got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("missing Retry-After header")
+	}
+	close(release)
+	wg.Wait()
+	for _, code := range codes {
+		if code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, code)
+		}
+	}
+	// slots are available again
+	go func() { <-running }()
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestSessionGC(t *testing.T) {
+	withSession(t, func(dtb *sql.DB, s *api.Session) {
+		const stmt = "INSERT INTO " + db.SessionsTableName + "(Auth,UserID,Expires)values(?,?,?)"
+		if _, err := dtb.Exec(stmt, "expired", s.User.ID, 1); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			sessionGC(ctx, time.Millisecond)
+			close(done)
+		}()
+		for i := 0; ; i++ {
+			if _, found, _ := db.FindSessionByID(dtb, "expired"); !found {
+				break
+			}
+			if i == 1000 {
+				t.Fatalf("expired session was not deleted")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("session gc did not stop")
+		}
+		if _, found, err := db.FindSessionByID(dtb, s.Auth); !found || err != nil {
+			t.Fatalf("live session was deleted: %v", err)
+		}
+	})
+}
+
+func TestWithResponseCache(t *testing.T) {
+	defer func(old int64) { MaxResponseCacheSize = old }(MaxResponseCacheSize)
+	var data = api.Version{Version: "1.0"}
+	h := WithResponseCache(func(_ context.Context, w http.ResponseWriter, _ *http.Request) {
+		JSONResponse(w, data)
+	})
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api-version", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		h(context.Background(), w, req)
+		return w
+	}
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected status 200 with etag; got %d %q", w.Code, etag)
+	}
+	if w = get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected status 304; got %d", w.Code)
+	}
+	if w = get(`"other", W/` + etag); w.Code != http.StatusNotModified {
+		t.Fatalf("expected status 304; got %d", w.Code)
+	}
+	// changed data
+	data.Version = "2.0"
+	if w = get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected status 200 with new etag; got %d", w.Code)
+	}
+	// too large responses are streamed
+	MaxResponseCacheSize = 4
+	if w = get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") != "" {
+		t.Fatalf("expected status 200 without etag; got %d", w.Code)
+	}
+	var got api.Version
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got != data {
+		t.Fatalf("invalid streamed response: %v %v", got, err)
+	}
+}
+
+func TestMissingMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		h    http.HandlerFunc
+		want string
+	}{
+		{"project", WithMethods(http.MethodGet, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			JSONResponse(w, ProjectFromCtx(ctx).APIBook())
+		}), "WithProject middleware not applied"},
+		{"line-id", WithMethods(http.MethodGet, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			JSONResponse(w, LineIDFromCtx(ctx))
+		}), "WithLineID middleware not applied"},
+		{"recover", WithRecover(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}), "internal server error"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tc.h(rec, httptest.NewRequest(http.MethodGet, "/books/1", nil))
+			if rec.Code != http.StatusInternalServerError {
+				t.Fatalf("expected status %d; got %d", http.StatusInternalServerError, rec.Code)
+			}
+			var got struct{ Message string }
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got.Message != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got.Message)
+			}
+		})
+	}
+}
+
+func TestRecoverAfterWrite(t *testing.T) {
+	h := WithRecover(func(w http.ResponseWriter, r *http.Request) {
+		JSONResponse(w, api.Version{Version: "1"})
+		panic("boom")
+	})
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/api-version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != `{"version":"1"}` {
+		t.Fatalf("invalid body: %s", got)
+	}
+}
+
+func TestAuthParam(t *testing.T) {
+	defer func(param string) { api.AuthParam = param }(api.AuthParam)
+	api.AuthParam = "pcw-auth"
+	withSession(t, func(_ *sql.DB, s *api.Session) {
+		server := httptest.NewServer(WithMethods(http.MethodGet, WithAuth(
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				JSONResponse(w, AuthFromCtx(ctx).User)
+			})))
+		defer server.Close()
+		client := api.Authenticate(server.URL, s.Auth, false)
+		tests := []struct {
+			name, url string
+			want      int
+		}{
+			{"custom", client.AuthURL("books"), http.StatusOK},
+			{"custom-query", client.AuthURL("books?skip=1"), http.StatusOK},
+			{"default", client.URL("books?auth=%s", s.Auth), http.StatusUnauthorized},
+			{"missing", client.URL("books"), http.StatusUnauthorized},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				resp, err := http.Get(tc.url)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.want {
+					t.Fatalf("expected status %d; got %d", tc.want, resp.StatusCode)
+				}
+			})
+		}
+	})
+}
+
+func TestWriteAttachment(t *testing.T) {
+	tests := []struct {
+		filename, want string
+	}{
+		{"page-1.txt", `attachment; filename="page-1.txt"`},
+		{`a "quoted" name.txt`, `attachment; filename="a _quoted_ name.txt"`},
+		{"ſchön übel.txt", `attachment; filename="_ch_n _bel.txt"; ` +
+			`filename*=UTF-8''%C5%BFch%C3%B6n%20%C3%BCbel.txt`},
+		{"line\nbreak.csv", `attachment; filename="line_break.csv"; ` +
+			`filename*=UTF-8''line%0Abreak.csv`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.filename, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if err := WriteAttachment(rec, tc.filename, "text/plain; charset=utf-8",
+				strings.NewReader("ſchön")); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != tc.want {
+				t.Fatalf("expected %s; got %s", tc.want, got)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+				t.Fatalf("invalid content type: %s", got)
+			}
+			if got := rec.Body.String(); got != "ſchön" {
+				t.Fatalf("expected %q; got %q", "ſchön", got)
+			}
+		})
+	}
+}
+
+func TestRespond(t *testing.T) {
+	small := map[string]string{"status": "ok"}
+	large := map[string]string{"text": strings.Repeat("ſchön ", MinGzipResponseSize)}
+	tests := []struct {
+		name, accept string
+		data         interface{}
+		gzipped      bool
+	}{
+		{"small", "gzip", small, false},
+		{"large", "gzip", large, true},
+		{"large-list", "deflate, gzip;q=0.5", large, true},
+		{"large-not-accepted", "", large, false},
+		{"large-refused", "gzip;q=0", large, false},
+		{"large-identity", "identity", large, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/books", nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept-Encoding", tc.accept)
+			}
+			rec := httptest.NewRecorder()
+			Respond(rec, r, tc.data)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+			}
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tc.gzipped {
+				t.Fatalf("expected gzipped=%t; got %t", tc.gzipped, gzipped)
+			}
+			var body io.Reader = rec.Body
+			if gzipped {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("got error: %v", err)
+				}
+				body = gz
+			}
+			var got map[string]string
+			if err := json.NewDecoder(body).Decode(&got); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.data) {
+				t.Fatalf("invalid response data")
+			}
+		})
+	}
+}
+
+func TestRunServer(t *testing.T) {
+	sqlite.With("service.sqlite", func(dtb *sql.DB) {
+		shutdownMu.Lock()
+		oldPool, oldFuncs := pool, shutdownFuncs
+		shutdownFuncs = nil
+		shutdownMu.Unlock()
+		defer func() {
+			shutdownMu.Lock()
+			pool, shutdownFuncs = oldPool, oldFuncs
+			shutdownMu.Unlock()
+		}()
+		pool = dtb
+		var calls int
+		OnShutdown(func(context.Context) error {
+			calls++
+			return nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		if err := RunServer(ctx, "127.0.0.1:0", http.NotFoundHandler()); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if calls != 1 {
+			t.Fatalf("expected shutdown functions to be called once; got %d", calls)
+		}
+		if err := dtb.Ping(); err == nil {
+			t.Fatalf("expected the pool to be closed")
+		}
+		if err := RunServer(context.Background(), "invalid address", http.NotFoundHandler()); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+}
+
+func TestErrorFormatter(t *testing.T) {
+	defer func(f func(http.ResponseWriter, int, string)) { ErrorFormatter = f }(ErrorFormatter)
+	ErrorFormatter = func(w http.ResponseWriter, status int, msg string) {
+		JSONResponseStatus(w, status, api.ErrorResponse{
+			Cause:      msg,
+			Status:     http.StatusText(status),
+			StatusCode: status,
+		})
+	}
+	h := WithTraceID(func(_ context.Context, w http.ResponseWriter, _ *http.Request) {
+		ErrorResponse(w, http.StatusNotFound, "cannot find %s", "book")
+	})
+	rec := httptest.NewRecorder()
+	h(context.Background(), rec, httptest.NewRequest(http.MethodGet, "/books/1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d; got %d", http.StatusNotFound, rec.Code)
+	}
+	var got api.ErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	want := api.ErrorResponse{Cause: "cannot find book", Status: "Not Found",
+		StatusCode: http.StatusNotFound}
+	if got != want {
+		t.Fatalf("expected %v; got %v", want, got)
+	}
+}
+
+func TestWriteBookZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcwgo-service")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "page-1.png"), []byte("image-1"), 0644); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	sqlite.With("service.sqlite", func(dtb *sql.DB) {
+		if err := db.CreateAllTables(dtb); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		user := api.User{Name: "test", Email: "test@example.com"}
+		if err := db.InsertUser(dtb, &user); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		book := db.Book{BookID: 1, Directory: dir, Lang: "german"}
+		if err := db.InsertBook(dtb, &book); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		p := db.Project{Book: book, Owner: user, Pages: 2}
+		if err := db.InsertProject(dtb, &p); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		for _, page := range []db.Page{
+			{BookID: 1, PageID: 2}, // no image
+			{BookID: 1, PageID: 1, ImagePath: "page-1.png"},
+		} {
+			if err := db.InsertPage(dtb, &page); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			const stmt = "INSERT INTO " + db.ProjectPagesTableName + "(ProjectID,PageID) VALUES(?,?)"
+			if _, err := dtb.Exec(stmt, p.ProjectID, page.PageID); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+		}
+		line := db.Line{BookID: 1, PageID: 1, LineID: 1, Chars: db.Chars{
+			{OCR: 'a', Cor: 'b', Seq: 1}, {OCR: 'c', Seq: 2},
+		}}
+		if err := db.InsertLine(dtb, &line); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		if err := WriteBookZip(context.Background(), rec, dtb, &p); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/zip" {
+			t.Fatalf("invalid content type: %s", got)
+		}
+		if got := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+			t.Fatalf("invalid content disposition: %s", got)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		got := make(map[string]string)
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			content, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			got[f.Name] = string(content)
+		}
+		want := map[string]string{
+			"pages/00001.png": "image-1",
+			"pages/00001.txt": line.Chars.Cor(),
+			"pages/00002.txt": "",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %v; got %v", want, got)
+		}
+		// paths outside of the book's directory are rejected
+		const stmt = "UPDATE " + db.PagesTableName + " SET ImagePath=? WHERE PageID=2"
+		if _, err := dtb.Exec(stmt, "../page-1.png"); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		rec = httptest.NewRecorder()
+		if err := WriteBookZip(context.Background(), rec, dtb, &p); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "" {
+			t.Fatalf("response was written")
+		}
+	})
+}
+
+func TestLocalizedErrorResponse(t *testing.T) {
+	defer func(old map[string]map[string]string) { messages = old }(messages)
+	messages = make(map[string]map[string]string)
+	const key = "cannot find project %d"
+	RegisterMessages("de", map[string]string{key: "Projekt %d nicht gefunden"})
+	RegisterMessages("fr-CA", map[string]string{key: "projet %d introuvable"})
+	tests := []struct {
+		name, lang, want string
+	}{
+		{"de", "de", "Projekt 7 nicht gefunden"},
+		{"de-region", "de-AT", "Projekt 7 nicht gefunden"},
+		{"quality", "en;q=0.5, fr-CA, de;q=0.8", "projet 7 introuvable"},
+		{"fallback-language", "es, de;q=0.1", "Projekt 7 nicht gefunden"},
+		{"zero-quality", "de;q=0", "cannot find project 7"},
+		{"english", "en-US", "cannot find project 7"},
+		{"missing", "", "cannot find project 7"},
+		{"no-region-fallback", "fr", "cannot find project 7"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/books/7", nil)
+			if tc.lang != "" {
+				r.Header.Set("Accept-Language", tc.lang)
+			}
+			rec := httptest.NewRecorder()
+			LocalizedErrorResponse(rec, r, http.StatusNotFound, key, 7)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected status %d; got %d", http.StatusNotFound, rec.Code)
+			}
+			var got struct{ Message string }
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got.Message != tc.want {
+				t.Fatalf("expected %q; got %q", tc.want, got.Message)
+			}
+		})
+	}
+}
+
+func TestWithIdempotency(t *testing.T) {
+	var applied int
+	h := WithIdempotency(NewMemoryIdempotencyStore(),
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			applied++
+			w.Header().Set("X-Applied", strconv.Itoa(applied))
+			JSONResponseStatus(w, http.StatusCreated, applied)
+		})
+	tests := []struct {
+		name, method, path, key string
+		want                    int // the expected number of applications
+	}{
+		{"first", http.MethodPost, "/books/1", "a", 1},
+		{"repeated", http.MethodPost, "/books/1", "a", 1},
+		{"other-key", http.MethodPost, "/books/1", "b", 2},
+		{"other-path", http.MethodPost, "/books/2", "a", 3},
+		{"repeated-again", http.MethodPost, "/books/1", "a", 1},
+		{"no-key", http.MethodPost, "/books/1", "", 4},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.key != "" {
+				r.Header.Set(IdempotencyKeyHeader, tc.key)
+			}
+			rec := httptest.NewRecorder()
+			h(context.Background(), rec, r)
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("expected status %d; got %d", http.StatusCreated, rec.Code)
+			}
+			var got int
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected response %d; got %d", tc.want, got)
+			}
+			if h := rec.Header().Get("X-Applied"); h != strconv.Itoa(tc.want) {
+				t.Fatalf("expected header %d; got %s", tc.want, h)
+			}
+		})
+	}
+	if applied != 4 {
+		t.Fatalf("expected 4 applications; got %d", applied)
+	}
+}
+
+func TestWithIdempotencyHeaders(t *testing.T) {
+	h := WithIdempotency(NewMemoryIdempotencyStore(),
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("X-Applied", "true")
+			JSONResponseStatus(w, http.StatusCreated, true)
+		})
+	h = WithTraceID(h)
+	tests := []struct {
+		name, trace string
+	}{
+		{"first", "trace-1"},
+		{"repeated", "trace-2"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/books/1", nil)
+			r.Header.Set(IdempotencyKeyHeader, "a")
+			r.Header.Set(TraceIDHeader, tc.trace)
+			rec := httptest.NewRecorder()
+			h(context.Background(), rec, r)
+			if got := rec.Header().Get(TraceIDHeader); got != tc.trace {
+				t.Fatalf("expected trace id %s; got %s", tc.trace, got)
+			}
+			if got := rec.Header().Get("X-Applied"); got != "true" {
+				t.Fatalf("expected header true; got %s", got)
+			}
+			if tc.name == "repeated" && rec.Header().Get("Connection") != "" {
+				t.Fatalf("replayed hop-by-hop header")
+			}
+		})
+	}
+}
+
+func TestMemoryIdempotencyStoreTTL(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	if err := store.Put("a", StoredResponse{Status: http.StatusOK}, -time.Second); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if err := store.Put("b", StoredResponse{Status: http.StatusOK}, time.Hour); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if _, found, err := store.Get("a"); err != nil || found {
+		t.Fatalf("expected expired response; got found=%t, err=%v", found, err)
+	}
+	if _, found, err := store.Get("b"); err != nil || !found {
+		t.Fatalf("expected response; got found=%t, err=%v", found, err)
+	}
+}
@@ -0,0 +1,3 @@
+// Package servicetest provides an sqlite-backed test server for
+// integration tests of the service package.
+package servicetest // import "github.com/finkf/pcwgo/service/servicetest"
@@ -0,0 +1,97 @@
+package servicetest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/finkf/pcwgo/api"
+	"github.com/finkf/pcwgo/db"
+	"github.com/finkf/pcwgo/service"
+)
+
+// Credentials of the seeded test user.
+const (
+	Email    = "test@example.com"
+	Password = "test-password"
+)
+
+// TestServer sets up the given database as the service's connection
+// pool, creates all tables, seeds a test user (see Email and
+// Password) and returns a running test server.  The server handles
+// the following routes:
+//
+//	POST /login       login with an api.LoginRequest
+//	GET  /api-version returns the api.Version
+//	GET  /books/<id>  returns the api.Book of the project (authenticated)
+//
+// The returned cleanup function closes the server and the given
+// database and restores the previous connection pool.  Callers
+// should defer it.
+func TestServer(t testing.TB, dtb *sql.DB) (*httptest.Server, func()) {
+	t.Helper()
+	if err := db.CreateAllTables(dtb); err != nil {
+		t.Fatalf("cannot create tables: %v", err)
+	}
+	if err := db.CreateTableSessions(dtb); err != nil {
+		t.Fatalf("cannot create tables: %v", err)
+	}
+	user := api.User{Name: "test", Email: Email, Institute: "test"}
+	if err := db.InsertUser(dtb, &user); err != nil {
+		t.Fatalf("cannot insert user: %v", err)
+	}
+	if err := db.SetUserPassword(dtb, user, Password); err != nil {
+		t.Fatalf("cannot set password: %v", err)
+	}
+	old := service.Pool()
+	service.SetPool(dtb)
+	mux := http.NewServeMux()
+	mux.HandleFunc(api.LoginURL, service.WithMethods(http.MethodPost, login))
+	mux.HandleFunc(api.VersionURL, service.WithMethods(http.MethodGet, version))
+	mux.HandleFunc("/books/", service.WithMethods(http.MethodGet,
+		service.WithAuth(service.WithProject(getBook))))
+	srv := httptest.NewServer(mux)
+	return srv, func() {
+		srv.Close()
+		service.SetPool(old)
+		dtb.Close()
+	}
+}
+
+func login(_ context.Context, w http.ResponseWriter, r *http.Request) {
+	var req api.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		service.ErrorResponse(w, http.StatusBadRequest, "invalid login: %v", err)
+		return
+	}
+	user, found, err := db.FindUserByEmail(service.Pool(), req.Email)
+	if err != nil {
+		service.ErrorResponse(w, http.StatusInternalServerError, "cannot login: %v", err)
+		return
+	}
+	if !found {
+		service.ErrorResponse(w, http.StatusNotFound, "cannot login: invalid user")
+		return
+	}
+	if err := db.AuthenticateUser(service.Pool(), user, req.Password); err != nil {
+		service.ErrorResponse(w, http.StatusForbidden, "cannot login: %v", err)
+		return
+	}
+	s, err := db.InsertSession(service.Pool(), user)
+	if err != nil {
+		service.ErrorResponse(w, http.StatusInternalServerError, "cannot login: %v", err)
+		return
+	}
+	service.JSONResponseStatus(w, http.StatusCreated, s)
+}
+
+func version(_ context.Context, w http.ResponseWriter, _ *http.Request) {
+	service.JSONResponse(w, api.Version{Version: "test"})
+}
+
+func getBook(ctx context.Context, w http.ResponseWriter, _ *http.Request) {
+	service.JSONResponse(w, service.ProjectFromCtx(ctx).APIBook())
+}
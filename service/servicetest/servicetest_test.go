@@ -0,0 +1,67 @@
+package servicetest
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/finkf/pcwgo/api"
+	"github.com/finkf/pcwgo/db"
+	"github.com/finkf/pcwgo/db/sqlite"
+	"github.com/finkf/pcwgo/service"
+)
+
+func TestServerWithClient(t *testing.T) {
+	sqlite.With("servicetest.sqlite", func(dtb *sql.DB) {
+		srv, cleanup := TestServer(t, dtb)
+		defer cleanup()
+		user, _, err := db.FindUserByEmail(dtb, Email)
+		if err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		book := db.Book{BookID: 1, Title: "title", Author: "author", Directory: "dir", Lang: "german"}
+		if err := db.InsertBook(dtb, &book); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		p := db.Project{Book: book, Owner: user, Pages: 3}
+		if err := db.InsertProject(dtb, &p); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		// unauthenticated requests must fail
+		var b api.Book
+		c := api.NewClient(srv.URL, false)
+		err = c.Get(c.URL("books/%d", p.ProjectID), &b)
+		var errresp api.ErrorResponse
+		if !errors.As(err, &errresp) || errresp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected unauthorized; got %v", err)
+		}
+		c, err = api.Login(srv.URL, Email, Password, false)
+		if err != nil {
+			t.Fatalf("cannot login: %v", err)
+		}
+		if err := c.Get(c.URL("books/%d", p.ProjectID), &b); err != nil {
+			t.Fatalf("got error: %v", err)
+		}
+		if b.Title != "title" || b.ProjectID != p.ProjectID || b.Pages != 3 {
+			t.Fatalf("invalid book: %v", b)
+		}
+	})
+}
+
+func TestServerCleanup(t *testing.T) {
+	old := service.Pool()
+	sqlite.With("servicetest.sqlite", func(dtb *sql.DB) {
+		_, cleanup := TestServer(t, dtb)
+		if service.Pool() != dtb {
+			t.Fatalf("expected the test database as pool")
+		}
+		cleanup()
+		if service.Pool() != old {
+			t.Fatalf("expected the previous pool to be restored")
+		}
+		if err := dtb.Ping(); err == nil {
+			t.Fatalf("expected the test database to be closed")
+		}
+	})
+}